@@ -0,0 +1,21 @@
+package common
+
+// Types of messages exchanged between scheduler and executors run by the
+// local backend. Messages are JSON objects, one per line, written to fd 3
+// (scheduler to executor) and fd 4 (executor to scheduler) of executor.
+const (
+	LocalMsgLaunch    = "launch"   // launch task TaskId with Name and Data
+	LocalMsgKill      = "kill"     // kill task TaskId
+	LocalMsgShutdown  = "shutdown" // stop executor
+	LocalMsgStatus    = "status"   // State of task TaskId is changed
+	LocalMsgFramework = "message"  // framework message in Message
+)
+
+type LocalMessage struct {
+	Type    string `json:"type"`
+	TaskId  string `json:"taskId,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	State   string `json:"state,omitempty"` // name of mesos TaskState, e.g. TASK_RUNNING
+	Message string `json:"message,omitempty"`
+}
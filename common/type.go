@@ -1,5 +1,18 @@
 package common
 
+import (
+	"net/url"
+	"strings"
+)
+
+// Transfer modes of a task. In spool mode files are downloaded into the
+// executor's working directory before uploading, in stream mode downloaded
+// data is uploaded part by part without touching local disk.
+const (
+	TransferModeSpool  = "spool"
+	TransferModeStream = "stream"
+)
+
 type TransferTask struct {
 	Id           int64    `json:"id"`
 	UId          string   `json:"uid"`
@@ -13,14 +26,142 @@ type TransferTask struct {
 	AccessKey string `json:"accessKey"`
 	SecretKey string `json:"secretKey"`
 	TargetCluster string `json:"targetCluster"`
+	// S3 cluster which s3://bucket/key origins are read from, and keys of
+	// the user on it. Like target, the type is a name in cluster table in
+	// scheduler, and "s3" in executors.
+	SourceType      string `json:"sourceType,omitempty"`
+	SourceCluster   string `json:"sourceCluster,omitempty"`
+	SourceAccessKey string `json:"sourceAccessKey,omitempty"`
+	SourceSecretKey string `json:"sourceSecretKey,omitempty"`
+	TransferMode  string `json:"transferMode"` // in spool/stream
+	Threads       int    `json:"threads"`      // parallel connections per file, 0 for executor default
+	MaxSpeed      int64  `json:"maxSpeed"`     // bytes per second of all files in the task, 0 for unlimited
+	// multipart uploads started by previous runs of the task, keyed by origin url
+	Uploads map[string]*Upload `json:"uploads,omitempty"`
+	// checksums given by user, keyed by origin url
+	Checksums map[string]*Checksum `json:"checksums,omitempty"`
+	// object keys given by user, keyed by origin url, path of origin url is
+	// used if not given
+	TargetKeys map[string]string `json:"targetKeys,omitempty"`
+	// credentials to log in ftp:// and sftp:// origins, keyed by
+	// CredentialKey of origin url
+	Credentials map[string]*Credential `json:"credentials,omitempty"`
+}
+
+// Credential to log in an FTP or SFTP server, it's given by user in the same
+// form when submitting jobs
+type Credential struct {
+	User       string `json:"user"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private-key,omitempty"` // PEM encoded, SFTP only
+	HostKey    string `json:"host-key,omitempty"`    // SHA256 fingerprint of SFTP server, e.g. SHA256:nThbg6kX..., required for SFTP
+}
+
+// default ports of schemes taking credentials, which are omitted in
+// CredentialKey
+var credentialPorts = map[string]string{
+	"ftp":  "21",
+	"sftp": "22",
+}
+
+// CredentialKey returns which credential is used for the url, in form of
+// scheme://host[:port], port is omitted if it's the default one
+func CredentialKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); port != "" && port == credentialPorts[scheme] {
+		host = strings.ToLower(u.Hostname())
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6
+		}
+	}
+	return scheme + "://" + host
+}
+
+// Checksum of a file, digests are hex encoded
+type Checksum struct {
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Part is a stored part of a multipart upload
+type Part struct {
+	N    int    `json:"n"`
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
 }
 
+// Upload is the state of an unfinished multipart upload, with it an upload
+// could be continued by another executor
+type Upload struct {
+	UploadId string `json:"uploadId"`
+	Parts    []Part `json:"parts"`
+}
+
+// Classes of errors a file could fail with
+const (
+	ErrorOrigin4xx = "Origin4xx" // origin answered with a 4xx status
+	ErrorOrigin5xx = "Origin5xx" // origin answered with a 5xx status
+	ErrorDNS       = "DNS"       // origin host cannot be resolved
+	ErrorTimeout   = "Timeout"   // connecting to or reading from origin or target timed out
+	ErrorNetwork   = "Network"   // connection to origin or target is refused, reset or broken
+	ErrorS3Auth    = "S3Auth"    // S3 keys are invalid or have no access to the bucket
+	ErrorS3Quota   = "S3Quota"   // S3 quota of the user or bucket is exceeded
+	ErrorDisk      = "Disk"      // error reading or writing local file
+	ErrorChecksum  = "Checksum"  // transferred data doesn't match the checksum
+	ErrorUnknown   = "Unknown"
+)
+
 type UrlUpdate struct {
 	OriginUrl string `json:"originUrl"`
 	TargetUrl string `json:"targetUrl"`
 	TaskId    int64  `json:"taskId"`
-	Status    string `json:"status"` // status is in Pending/Finished/Failed
+	// status is in Pending/Downloading/Uploading/Finished/Failed/ChecksumFailed/Cancelled
+	Status    string `json:"status"`
 	Size      int64  `json:"size"`
+	// checksum of the transferred file
+	Checksum *Checksum `json:"checksum,omitempty"`
+	// set when status is Uploading, to checkpoint a multipart upload with
+	// the part just stored, which is appended to parts stored before.
+	// Uploading without Upload means the file starts uploading
+	Upload *Upload `json:"upload,omitempty"`
+	// set when status is Failed or ChecksumFailed
+	ErrorClass string `json:"errorClass,omitempty"`
+	HttpStatus int    `json:"httpStatus,omitempty"` // status code from origin or S3, if any
+	Message    string `json:"message,omitempty"`
+}
+
+// Types of framework messages sent by executors
+const (
+	MsgUrlUpdate = "url"      // state of a file is changed, in Update
+	MsgProgress  = "progress" // progress of files being transferred, in Progress
+)
+
+// ExecutorMessage is the framework message sent from executors to scheduler
+type ExecutorMessage struct {
+	Type     string            `json:"type"`
+	Update   *UrlUpdate        `json:"update,omitempty"`
+	Progress []*ProgressReport `json:"progress,omitempty"`
+}
+
+// Types of framework messages sent by scheduler
+const (
+	MsgRate = "rate" // rate limit of a running task is changed, in MaxSpeed
+)
+
+// SchedulerMessage is the framework message sent from scheduler to executors
+type SchedulerMessage struct {
+	Type     string `json:"type"`
+	TaskId   int64  `json:"taskId"`
+	MaxSpeed int64  `json:"maxSpeed"` // bytes per second, 0 for unlimited
+}
+
+// ProgressReport is the latest progress of a file in a task
+type ProgressReport struct {
+	TaskId  int64   `json:"taskId"`
+	JobUuid string  `json:"jobUuid"`
+	UId     string  `json:"uid"`
+	Info    UrlInfo `json:"info"`
 }
 
 type UrlInfo struct {
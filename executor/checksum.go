@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+	"legitlab.letv.cn/optimus/optimus/executor/s3"
+)
+
+// returned when transferred data doesn't match the checksum given by origin
+// or user, or the uploaded object doesn't match transferred data
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// digester computes checksums of data written to it
+type digester struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newDigester() *digester {
+	return &digester{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+func (d *digester) checksum() *common.Checksum {
+	return &common.Checksum{
+		MD5:    hex.EncodeToString(d.md5.Sum(nil)),
+		SHA256: hex.EncodeToString(d.sha256.Sum(nil)),
+	}
+}
+
+// streamDigest computes checksum of a file while it's downloaded. Data is
+// digested as it's written in order from the beginning of the file, data
+// written out of order, e.g. by parallel range connections or a resumed
+// download, is read back from the file when download is done.
+type streamDigest struct {
+	digester *digester
+	hashed   int64 // bytes from the beginning of file which are digested
+}
+
+func newStreamDigest() *streamDigest {
+	return &streamDigest{digester: newDigester()}
+}
+
+// writer returns file which digests data written to it
+func (d *streamDigest) writer(file io.WriterAt) io.WriterAt {
+	return &digestWriter{file: file, digest: d}
+}
+
+// reset starts over when the file is truncated
+func (d *streamDigest) reset() {
+	d.digester = newDigester()
+	d.hashed = 0
+}
+
+// finish digests the rest of file and returns checksum and size of the file
+func (d *streamDigest) finish(file io.ReadSeeker) (*common.Checksum, int64, error) {
+	_, err := file.Seek(d.hashed, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(d.digester, file)
+	d.hashed += n
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.digester.checksum(), d.digester.size, nil
+}
+
+type digestWriter struct {
+	file   io.WriterAt
+	digest *streamDigest
+}
+
+func (w *digestWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.file.WriteAt(p, off)
+	d := w.digest
+	if off <= d.hashed && off+int64(n) > d.hashed {
+		d.digester.Write(p[d.hashed-off : n])
+		d.hashed = off + int64(n)
+	}
+	return n, err
+}
+
+func base64ToHex(s string) string {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func hexToBase64(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func isMD5Hex(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// originChecksum collects checksum advertised by origin in its response
+// headers: Content-MD5, Digest(RFC 3230) and ETag. ETag is only trusted from
+// S3 servers, for objects not uploaded in parts nor encrypted with SSE-KMS,
+// other servers like CDNs make it up in their own ways.
+func originChecksum(header http.Header) *common.Checksum {
+	var sum common.Checksum
+	if header.Get("x-amz-request-id") != "" && s3.ETagIsMD5(header) {
+		sum.MD5 = strings.ToLower(strings.Trim(header.Get("ETag"), "\""))
+	}
+	if contentMD5 := base64ToHex(header.Get("Content-MD5")); isMD5Hex(contentMD5) {
+		sum.MD5 = contentMD5
+	}
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "MD5":
+			if v := base64ToHex(kv[1]); isMD5Hex(v) {
+				sum.MD5 = v
+			}
+		case "SHA-256":
+			if v := base64ToHex(kv[1]); len(v) == 64 {
+				sum.SHA256 = v
+			}
+		}
+	}
+	return &sum
+}
+
+// expectedChecksum merges checksum from origin and user, the ones given by
+// user take precedence
+func expectedChecksum(origin *common.Checksum, user *common.Checksum) *common.Checksum {
+	var sum common.Checksum
+	if origin != nil {
+		sum = *origin
+	}
+	if user != nil && user.MD5 != "" {
+		sum.MD5 = user.MD5
+	}
+	if user != nil && user.SHA256 != "" {
+		sum.SHA256 = user.SHA256
+	}
+	return &sum
+}
+
+// verifyChecksum compares checksum of transferred data with the expected
+// one, only digests present in both are compared
+func verifyChecksum(expected *common.Checksum, actual *common.Checksum) error {
+	if expected == nil || actual == nil {
+		return nil
+	}
+	if expected.MD5 != "" && !strings.EqualFold(expected.MD5, actual.MD5) {
+		fmt.Println("MD5 mismatch, expect", expected.MD5, "got", actual.MD5)
+		return errChecksumMismatch
+	}
+	if expected.SHA256 != "" && !strings.EqualFold(expected.SHA256, actual.SHA256) {
+		fmt.Println("SHA-256 mismatch, expect", expected.SHA256, "got", actual.SHA256)
+		return errChecksumMismatch
+	}
+	return nil
+}
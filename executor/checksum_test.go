@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func Test_StreamDigest(t *testing.T) {
+	file, err := ioutil.TempFile("", "digest")
+	if err != nil {
+		t.Fatal("Error creating file:", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data := []byte("0123456789abcdefghij")
+	sum := md5.Sum(data)
+	d := newStreamDigest()
+	w := d.writer(file)
+	// first block is digested while written, the second one is written out
+	// of order and read back
+	w.WriteAt(data[10:], 10)
+	w.WriteAt(data[:5], 0)
+	w.WriteAt(data[5:10], 5)
+	if d.hashed != 10 {
+		t.Error("Bytes digested while written:", d.hashed, "expected: 10")
+	}
+	checksum, size, err := d.finish(file)
+	if err != nil {
+		t.Fatal("Error finishing digest:", err)
+	}
+	if size != int64(len(data)) || checksum.MD5 != hex.EncodeToString(sum[:]) {
+		t.Error("Checksum of file:", checksum.MD5, size)
+	}
+}
+
+func Test_OriginChecksum(t *testing.T) {
+	etag := "\"0123456789abcdef0123456789abcdef\""
+	cases := []struct {
+		header http.Header
+		md5    string
+	}{
+		// ETag of other servers is not trusted
+		{http.Header{"Etag": {etag}}, ""},
+		{http.Header{"Etag": {etag}, "X-Amz-Request-Id": {"1"}},
+			"0123456789abcdef0123456789abcdef"},
+		{http.Header{"Etag": {etag}, "X-Amz-Request-Id": {"1"},
+			"X-Amz-Server-Side-Encryption": {"aws:kms"}}, ""},
+		{http.Header{"Etag": {"\"0123456789abcdef0123456789abcdef-2\""},
+			"X-Amz-Request-Id": {"1"}}, ""},
+		{http.Header{"Etag": {etag}, "Content-Md5": {"AAECAwQFBgcICQoLDA0ODw=="}},
+			"000102030405060708090a0b0c0d0e0f"},
+	}
+	for _, c := range cases {
+		if sum := originChecksum(c.header); sum.MD5 != c.md5 {
+			t.Error("MD5 of", c.header, "should be", c.md5, "but got", sum.MD5)
+		}
+	}
+}
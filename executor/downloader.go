@@ -1,45 +1,73 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 	"errors"
+
+	"legitlab.letv.cn/optimus/optimus/common"
 )
 
 const (
-	MaxThread = 1
+	MaxThread = 16    // Upper limit of parallel connections for a file
 	BufferSize = 4096   // How many bytes to read every time
 )
 
+// returned by downloadBlock when origin answers a ranged request with the
+// whole file, so the file has to be downloaded in a single stream
+var errRangeIgnored = errors.New("Range request is not supported by origin")
+
+// returned when resuming a download but the origin file has been changed
+var errOriginChanged = errors.New("Origin file has been changed")
+
+// returned when origin answers GET with a non-2xx status
+type originStatusError struct {
+	StatusCode int
+}
+
+func (e *originStatusError) Error() string {
+	return "Error GET Request with status " + strconv.Itoa(e.StatusCode)
+}
+
 type DlBuf  struct {
 	buf    []byte
 	off    int64
 	len    int64
 	idx    int
-	reset  bool
 	exit   bool
 	replyc chan bool
 }
 
-type progressCB func(speed int, dlSize int64, rkv *RedisKeyValue)
+type progressCB func(speed int, dlSize int64, prog *FileProgress)
 
 type FileDl struct {
 	Url  string
 	Size int64
 	MaxSpeed int64
-	File *os.File
-	rkv *RedisKeyValue
+	File io.WriterAt
+	prog *FileProgress
 
 	progress progressCB
 	stime time.Time
 	spend time.Time
 
+	Threads      int  // number of parallel range connections
+	AcceptRanges bool // whether origin advertises "Accept-Ranges: bytes"
+	ETag         string
+	LastModified string
+	IfRange      string // set when resuming a previous download
+	Checksum     *common.Checksum // advertised by origin, fields could be empty
+
 	BlockList []Block
-	err       [MaxThread]error
+	err       []error
+	ctx       context.Context // download is aborted when it's done
+	limiter   *tokenBucket    // limits download speed, nil for unlimited
+	origin    Origin          // origin of non-HTTP url, nil for HTTP
 
 	bytesDone  int64
 
@@ -51,69 +79,157 @@ type Block struct {
 	End   int64 `json:"end"`
 }
 
-func NewFileDl(url string, file *os.File, maxSpeed int64) (*FileDl, error) {
-	var size int64
-	var contentType string
+// FileInfo is what origin tells about a file before it's downloaded
+type FileInfo struct {
+	Size         int64 // -1 if unknown
+	ContentType  string
+	AcceptRanges bool
+	ETag         string
+	LastModified string
+	Checksum     *common.Checksum
+}
+
+// headFile gets FileInfo of url with HEAD
+func headFile(url string) *FileInfo {
+	var info = &FileInfo{Size: -1, Checksum: &common.Checksum{}}
 	var client = &http.Client{
 		Timeout: time.Second * 20,
 	}
 	resp, err := client.Head(url)
 	if err != nil {
 		fmt.Println("Head error")
-		size = -1
-		contentType = ""
 	} else {
 		if resp.StatusCode < 200 || resp.StatusCode > 299 {
 			fmt.Println("Error HEAD file: ", url, "with status", resp.StatusCode)
-			size = -1
-			contentType = ""
 		} else {
-			size = resp.ContentLength
-			contentType = resp.Header.Get("Content-Type")
+			info.Size = resp.ContentLength
+			info.ContentType = resp.Header.Get("Content-Type")
+			info.AcceptRanges = resp.Header.Get("Accept-Ranges") == "bytes"
+			info.ETag = resp.Header.Get("ETag")
+			info.LastModified = resp.Header.Get("Last-Modified")
+			info.Checksum = originChecksum(resp.Header)
 		}
+		resp.Body.Close()
+	}
+	return info
+}
+
+func NewFileDl(url string, file io.WriterAt, maxSpeed int64, threads int) (*FileDl, error) {
+	return NewFileDlWithInfo(url, file, maxSpeed, threads, headFile(url)), nil
+}
+
+// NewFileDlWithInfo returns a downloader of url whose FileInfo is already
+// known, e.g. signed urls which can't be HEAD
+func NewFileDlWithInfo(url string, file io.WriterAt, maxSpeed int64, threads int, info *FileInfo) *FileDl {
+	if threads > MaxThread {
+		threads = MaxThread
+	}
+	if threads < 1 || !info.AcceptRanges || info.Size <= 0 {
+		threads = 1
 	}
 
 	f := &FileDl{
 		Url:  url,
-		Size: size,
+		Size: info.Size,
 		File: file,
 		MaxSpeed: maxSpeed,
-		ContentType: contentType,
+		ContentType: info.ContentType,
+		Threads: threads,
+		AcceptRanges: info.AcceptRanges,
+		ETag: info.ETag,
+		LastModified: info.LastModified,
+		Checksum: info.Checksum,
+		ctx: context.Background(),
 	}
-	fmt.Println("maxSpeed:", maxSpeed)
-
-	for i := 0; i < MaxThread; i++ {
-		f.err[i] = nil
+	if maxSpeed > 0 {
+		f.limiter = newTokenBucket(maxSpeed)
 	}
+	fmt.Println("maxSpeed:", maxSpeed, "threads:", threads)
 
-	return f, nil
+	return f
 }
 
 func (f *FileDl) GetContentType() string {
 	return f.ContentType
 }
 
-func (f *FileDl) SetCB(rkv *RedisKeyValue, progress progressCB) {
+func (f *FileDl) SetContext(ctx context.Context) {
+	f.ctx = ctx
+}
+
+// SetLimiter makes the download share a rate limit with other transfers
+func (f *FileDl) SetLimiter(limiter *tokenBucket) {
+	f.limiter = limiter
+}
+
+func (f *FileDl) SetCB(prog *FileProgress, progress progressCB) {
 	f.progress = progress
-	f.rkv = rkv
+	f.prog = prog
 }
 
-func (f *FileDl) Download() (bytesDone int64, dlErr error) {
+// Validator returns a value which identifies current version of the origin
+// file, it's used as If-Range header when resuming.
+func (f *FileDl) Validator() string {
+	if f.ETag != "" && !strings.HasPrefix(f.ETag, "W/") {
+		return f.ETag
+	}
+	return f.LastModified
+}
+
+// Resume continues a previous download of the same file from blocks, which
+// is only possible if origin supports range requests and the file is still
+// the same version as validator.
+func (f *FileDl) Resume(blocks []Block, validator string) bool {
+	if len(blocks) == 0 || validator == "" || validator != f.Validator() || !f.AcceptRanges {
+		return false
+	}
+	f.BlockList = blocks
+	f.IfRange = validator
+	return true
+}
+
+// bytes already downloaded before current download starts
+func (f *FileDl) doneBytes() int64 {
 	if f.Size <= 0 {
-		f.BlockList = append(f.BlockList, Block{0, -1})
-	} else {
-		blockSize := f.Size / int64(MaxThread)
-		var begin int64
-		for i := 0; i < MaxThread; i++ {
-			var end = (int64(i) + 1) * blockSize
-			f.BlockList = append(f.BlockList, Block{begin, end})
-			begin = end + 1
+		return f.BlockList[0].Begin // single block if size is unknown
+	}
+	var remaining int64
+	for _, block := range f.BlockList {
+		if block.End >= block.Begin {
+			remaining += block.End + 1 - block.Begin
 		}
+	}
+	return f.Size - remaining
+}
 
-		f.BlockList[MaxThread-1].End = f.Size - 1
+func (f *FileDl) splitBlocks(threads int) {
+	f.BlockList = nil
+	if f.Size <= 0 {
+		f.BlockList = append(f.BlockList, Block{0, -1})
+		return
+	}
+	blockSize := f.Size / int64(threads)
+	var begin int64
+	for i := 0; i < threads; i++ {
+		var end = (int64(i) + 1) * blockSize
+		f.BlockList = append(f.BlockList, Block{begin, end})
+		begin = end + 1
+	}
+	f.BlockList[threads-1].End = f.Size - 1
+}
 
+func (f *FileDl) Download() (bytesDone int64, dlErr error) {
+	if len(f.BlockList) == 0 {
+		f.splitBlocks(f.Threads)
 	}
-	return f.download()
+	bytesDone, dlErr = f.download()
+	if dlErr == errRangeIgnored && f.Threads > 1 {
+		fmt.Println("Origin ignored range request, fall back to single stream: ", f.Url)
+		f.Threads = 1
+		f.splitBlocks(1)
+		bytesDone, dlErr = f.download()
+	}
+	return
 }
 
 func dlTimer(timeout chan bool) {
@@ -123,6 +239,7 @@ func dlTimer(timeout chan bool) {
 
 func (f *FileDl) download() (bytesDone int64, dlErr error) {
 	totalSlices := len(f.BlockList)
+	f.err = make([]error, totalSlices)
 	bufChan := make(chan *DlBuf, totalSlices)
 	for i := range f.BlockList {
 		go func(id int) {
@@ -134,6 +251,13 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 			var err error
 			for ; try != 0; try-- {
 				err = f.downloadBlock(id, bufChan)
+				if err == errRangeIgnored || err == errOriginChanged {
+					break
+				}
+				if f.ctx.Err() != nil {
+					err = f.ctx.Err()
+					break
+				}
 				if err != nil {
 					fmt.Println("Error downloading file block: id", id, "with error", err)
 					// re-download the file block
@@ -141,7 +265,7 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 				}
 				break
 			}
-			if try == 0 {
+			if try == 0 || err == errRangeIgnored || err == errOriginChanged || f.ctx.Err() != nil {
 				f.err[id] = err
 			}
 
@@ -149,14 +273,11 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 	}
 
 	f.stime = time.Now()
-	var delayTime int
-	if f.MaxSpeed > 0 {
-		delayTime = int(float64(1000000 * totalSlices * BufferSize) / float64(f.MaxSpeed))
-	}
+	resumed := f.doneBytes()
+	bytesDone = resumed
 
 	timeout := make (chan bool, 1)
 	go dlTimer(timeout)
-	var finished[MaxThread] int64
 	var bytesPerSecond int
 	var count int
 	for {
@@ -170,7 +291,7 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 				go dlTimer(timeout)
 			}
 		    if f.progress != nil {
-				f.progress(bytesPerSecond, bytesDone, f.rkv)
+				f.progress(bytesPerSecond, bytesDone, f.prog)
 		    }
 			//fmt.Println("downloaded size:", bytesDone, "downloaded speed:", bytesPerSecond)
 		}
@@ -183,10 +304,6 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 			if dlBuf.exit {
 				count++
 				continue
-			} else if dlBuf.reset {
-				bytesDone -= finished[dlBuf.idx]
-				finished[dlBuf.idx] = 0
-				continue
 			}
 			_, e := f.File.WriteAt(dlBuf.buf[:dlBuf.len], dlBuf.off)
 			if e != nil {
@@ -194,7 +311,6 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 				fmt.Println("Error writing file: idx:", dlBuf.idx, "len:", dlBuf.len, "error", e)
 				continue
 			}
-			finished[dlBuf.idx] += dlBuf.len
 			bytesDone += dlBuf.len
 			dlBuf.replyc <- true
 		} else {
@@ -202,26 +318,17 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 		}
 
 		now := time.Now()
-		bytesDone += dlBuf.len
-		bytesPerSecond = int(float64(bytesDone) / now.Sub(f.stime).Seconds())
-		if f.MaxSpeed > 0 {
-			var ratio = float64(bytesPerSecond) / float64(f.MaxSpeed)
-			if ratio > 1.05 {
-				delayTime += 10000;
-			} else if ratio < 0.95 && delayTime >= 10000 {
-				delayTime -= 10000;
-			} else if ratio <  0.95 {
-				delayTime = 0
-			}
-			time.Sleep(time.Duration(delayTime) * time.Microsecond)
-		}
+		bytesPerSecond = int(float64(bytesDone-resumed) / now.Sub(f.stime).Seconds())
 	}
 
 	for i := 0; i < totalSlices; i++ {
-		if f.err[i] != nil {
-			dlErr = f.err[i]
+		if f.err[i] == errOriginChanged {
+			dlErr = errOriginChanged
 			break
 		}
+		if f.err[i] != nil && (dlErr == nil || f.err[i] == errRangeIgnored) {
+			dlErr = f.err[i]
+		}
 	}
 	f.bytesDone = bytesDone
 
@@ -230,38 +337,63 @@ func (f *FileDl) download() (bytesDone int64, dlErr error) {
 
 // download a file block
 func (f *FileDl) downloadBlock(id int, bufChan chan *DlBuf) error {
+	if f.origin != nil {
+		return f.downloadOriginBlock(id, bufChan)
+	}
 	request, err := http.NewRequest("GET", f.Url, nil)
 	if err != nil {
 		return err
 	}
 	begin := f.BlockList[id].Begin
 	end := f.BlockList[id].End
+	if end != -1 && begin > end {
+		return nil // already done
+	}
 	if end != -1 {
 		request.Header.Set(
 			"Range",
 			"bytes="+strconv.FormatInt(begin, 10)+"-"+strconv.FormatInt(end, 10),
 		)
+	} else if begin > 0 {
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(begin, 10)+"-")
+	}
+	ranged := request.Header.Get("Range") != ""
+	if ranged && f.IfRange != "" {
+		request.Header.Set("If-Range", f.IfRange)
 	}
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := http.DefaultClient.Do(request.WithContext(f.ctx))
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		fmt.Println("Error GET file: ", f.Url, "with status", resp.StatusCode)
-		return errors.New("Error GET Request")
+		return &originStatusError{StatusCode: resp.StatusCode}
+	}
+	// a 200 response to a range request carries the whole file, which is only
+	// acceptable if the range covers the whole file
+	if ranged && resp.StatusCode != http.StatusPartialContent &&
+		(begin != 0 || end != f.Size-1) {
+		if f.IfRange != "" {
+			return errOriginChanged
+		}
+		return errRangeIgnored
 	}
 	if end == -1 {
 		f.ContentType = resp.Header.Get("Content-Type")
 	}
-	defer resp.Body.Close()
+	return f.readBlock(id, resp.Body, bufChan)
+}
 
+// read data of a file block from body and pass it to bufChan
+func (f *FileDl) readBlock(id int, body io.Reader, bufChan chan *DlBuf) error {
+	end := f.BlockList[id].End
 	var exit bool
 	replyc := make(chan bool, 1)
 	var buf = make([]byte, BufferSize)
-	bufChan <- &DlBuf{buf: nil, off: 0, len: 0, replyc: replyc, reset: true, idx: id}
 	for ; !exit; {
-		n, e := resp.Body.Read(buf)
+		n, e := body.Read(buf)
 		if (e != nil) && (e != io.EOF){
 			return e
 		} else if e == io.EOF {
@@ -277,16 +409,23 @@ func (f *FileDl) downloadBlock(id int, bufChan chan *DlBuf) error {
 			}
 		}
 
-		bufChan <- &DlBuf{buf: buf, off: f.BlockList[id].Begin, len: readLen, replyc: replyc, reset: false, idx: id}
+		if err := f.limiter.wait(f.ctx, int(readLen)); err != nil {
+			return err
+		}
+		bufChan <- &DlBuf{buf: buf, off: f.BlockList[id].Begin, len: readLen, replyc: replyc, idx: id}
 		var reply bool
 		select {
 		case reply = <-replyc:
 		}
 		if !reply {
-			return nil
+			return errors.New("Error writing file")
 		}
 		f.BlockList[id].Begin += readLen
 	}
+	if end != -1 && f.BlockList[id].Begin <= end {
+		// body ended before the block, the rest is downloaded on retry
+		return io.ErrUnexpectedEOF
+	}
 
 	return nil
 }
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,7 +22,7 @@ func Test_DownloadFile(t *testing.T) {
 	//defer os.Remove(filename)
 	defer file.Close()
 
-	fileDl, err := NewFileDl("http://vss2.waqu.com/2gpq0lb12wtmnbcu/normal.mp4", file, 0)
+	fileDl, err := NewFileDl("http://vss2.waqu.com/2gpq0lb12wtmnbcu/normal.mp4", file, 0, 4)
 	if err != nil {
 		t.Error("Error new file downloader!")
 		return
@@ -30,3 +35,166 @@ func Test_DownloadFile(t *testing.T) {
 	fmt.Println("Downloaded Bytes:", bytesDone, "spend time:", time.Now().Sub(start).Seconds())
 }
 
+// memFile is an io.WriterAt in memory
+type memFile struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], p)
+	return len(p), nil
+}
+
+// rangeServer serves data with ETag etag, and records Range and If-Range of
+// GET requests. Range is ignored if ignoreRange is set.
+type rangeServer struct {
+	lock        sync.Mutex
+	data        []byte
+	etag        string
+	ignoreRange bool
+	ranges      []string
+	ifRanges    []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	etag, ignoreRange := s.etag, s.ignoreRange
+	if r.Method == "GET" && r.Header.Get("Range") != "" {
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+	}
+	s.lock.Unlock()
+	w.Header().Set("ETag", etag)
+	if ignoreRange {
+		w.Header().Set("Accept-Ranges", "bytes")
+		r.Header.Del("Range")
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.data))
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func Test_SplitBlocks(t *testing.T) {
+	cases := []struct {
+		size    int64
+		threads int
+		blocks  []Block
+	}{
+		{10, 1, []Block{{0, 9}}},
+		{10, 3, []Block{{0, 3}, {4, 6}, {7, 9}}},
+		{-1, 4, []Block{{0, -1}}},
+	}
+	for _, c := range cases {
+		f := &FileDl{Size: c.size}
+		f.splitBlocks(c.threads)
+		if !reflect.DeepEqual(f.BlockList, c.blocks) {
+			t.Error("Blocks of", c.size, "bytes in", c.threads, "threads:", f.BlockList,
+				"expected:", c.blocks)
+		}
+	}
+}
+
+func Test_DownloadRanges(t *testing.T) {
+	origin := &rangeServer{data: testData(100000), etag: "\"v1\""}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	file := &memFile{}
+	fileDl, _ := NewFileDl(server.URL, file, 0, 4)
+	if fileDl.Threads != 4 {
+		t.Fatal("Threads of download:", fileDl.Threads)
+	}
+	n, err := fileDl.Download()
+	if err != nil || n != int64(len(origin.data)) {
+		t.Fatal("Error downloading file:", n, err)
+	}
+	if !bytes.Equal(file.data, origin.data) {
+		t.Error("Downloaded data doesn't match")
+	}
+	if len(origin.ranges) != 4 {
+		t.Error("Range requests:", origin.ranges)
+	}
+}
+
+func Test_DownloadRangeIgnored(t *testing.T) {
+	origin := &rangeServer{data: testData(100000), etag: "\"v1\"", ignoreRange: true}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	file := &memFile{}
+	fileDl, _ := NewFileDl(server.URL, file, 0, 4)
+	n, err := fileDl.Download()
+	if err != nil || n != int64(len(origin.data)) {
+		t.Fatal("Error downloading file:", n, err)
+	}
+	if fileDl.Threads != 1 {
+		t.Error("Download should fall back to single stream, threads:", fileDl.Threads)
+	}
+	if !bytes.Equal(file.data, origin.data) {
+		t.Error("Downloaded data doesn't match")
+	}
+}
+
+func Test_DownloadResume(t *testing.T) {
+	origin := &rangeServer{data: testData(100000), etag: "\"v1\""}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	// first halves of both blocks are downloaded by a previous try
+	file := &memFile{}
+	file.WriteAt(origin.data[:25000], 0)
+	file.WriteAt(origin.data[50000:75000], 50000)
+	blocks := []Block{{25000, 49999}, {75000, 99999}}
+
+	fileDl, _ := NewFileDl(server.URL, file, 0, 2)
+	if fileDl.Resume(blocks, "\"v0\"") {
+		t.Error("Download of another version should not be resumed")
+	}
+	if !fileDl.Resume(blocks, fileDl.Validator()) {
+		t.Fatal("Download is not resumed")
+	}
+	n, err := fileDl.Download()
+	if err != nil || n != int64(len(origin.data)) {
+		t.Fatal("Error downloading file:", n, err)
+	}
+	if !bytes.Equal(file.data, origin.data) {
+		t.Error("Downloaded data doesn't match")
+	}
+	for i, r := range origin.ranges {
+		if r != "bytes=25000-49999" && r != "bytes=75000-99999" {
+			t.Error("Range of resumed download:", r)
+		}
+		if origin.ifRanges[i] != "\"v1\"" {
+			t.Error("If-Range of resumed download:", origin.ifRanges[i])
+		}
+	}
+}
+
+func Test_DownloadOriginChanged(t *testing.T) {
+	origin := &rangeServer{data: testData(100000), etag: "\"v1\""}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	fileDl, _ := NewFileDl(server.URL, &memFile{}, 0, 1)
+	if !fileDl.Resume([]Block{{50000, 99999}}, "\"v1\"") {
+		t.Fatal("Download is not resumed")
+	}
+	origin.lock.Lock()
+	origin.etag = "\"v2\""
+	origin.lock.Unlock()
+	if _, err := fileDl.Download(); err != errOriginChanged {
+		t.Error("Change of origin is not detected:", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	goamzs3 "github.com/goamz/goamz/s3"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// S3 error codes which mean the keys have no access
+var s3AuthCodes = map[string]bool{
+	"AccessDenied":                 true,
+	"InvalidAccessKeyId":           true,
+	"SignatureDoesNotMatch":        true,
+	"AuthorizationHeaderMalformed": true,
+}
+
+// classifyError tells why a file failed, in one of common.Error* classes,
+// and the HTTP status returned by origin or S3 if there's one
+func classifyError(err error) (class string, httpStatus int) {
+	// unwrap errors from net/http and net, errors of system calls on
+	// connections are network errors
+	var network bool
+	for {
+		switch e := err.(type) {
+		case *url.Error:
+			err = e.Err
+			continue
+		case *net.OpError:
+			if e.Timeout() {
+				return common.ErrorTimeout, 0
+			}
+			network = true
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			if e.Timeout() {
+				return common.ErrorTimeout, 0
+			}
+			network = true
+			err = e.Err
+			continue
+		}
+		break
+	}
+	switch e := err.(type) {
+	case nil:
+		return common.ErrorUnknown, 0
+	case *originStatusError:
+		if e.StatusCode >= 500 {
+			return common.ErrorOrigin5xx, e.StatusCode
+		}
+		return common.ErrorOrigin4xx, e.StatusCode
+	case *originError:
+		if e.permanent {
+			return common.ErrorOrigin4xx, 0
+		}
+		return common.ErrorOrigin5xx, 0
+	case *net.DNSError:
+		return common.ErrorDNS, 0
+	case *goamzs3.Error:
+		if e.Code == "QuotaExceeded" {
+			return common.ErrorS3Quota, e.StatusCode
+		}
+		if s3AuthCodes[e.Code] || e.StatusCode == 401 || e.StatusCode == 403 {
+			return common.ErrorS3Auth, e.StatusCode
+		}
+		return common.ErrorUnknown, e.StatusCode
+	case *os.PathError:
+		return common.ErrorDisk, 0
+	case net.Error:
+		if e.Timeout() {
+			return common.ErrorTimeout, 0
+		}
+	}
+	switch err {
+	case errChecksumMismatch:
+		return common.ErrorChecksum, 0
+	case context.DeadlineExceeded:
+		return common.ErrorTimeout, 0
+	case syscall.ENOSPC, syscall.EDQUOT, syscall.EIO:
+		return common.ErrorDisk, 0
+	}
+	if network {
+		return common.ErrorNetwork, 0
+	}
+	return common.ErrorUnknown, 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+func Test_ClassifyError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{&url.Error{Op: "Get", URL: "http://a.com/1.mp4", Err: &net.OpError{Op: "dial", Net: "tcp",
+			Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, common.ErrorNetwork},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			common.ErrorNetwork},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "a.com"}},
+			common.ErrorDNS},
+		{&os.PathError{Op: "write", Path: "/tmp/1.mp4", Err: syscall.ENOSPC}, common.ErrorDisk},
+		{syscall.EIO, common.ErrorDisk},
+		{errChecksumMismatch, common.ErrorChecksum},
+	}
+	for _, c := range cases {
+		if class, _ := classifyError(c.err); class != c.class {
+			t.Error("Class of", c.err, "is", class, "expected:", c.class)
+		}
+	}
+}
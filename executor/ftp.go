@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// ftpOrigin downloads files from FTP servers in binary and passive mode, a
+// new connection is used for each Stat and Open
+type ftpOrigin struct {
+	addr       string
+	path       string
+	credential *common.Credential
+}
+
+func newFtpOrigin(u *url.URL, credential *common.Credential) (Origin, error) {
+	if err := checkOriginPath(u.Path); err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	if credential == nil {
+		credential = &common.Credential{User: "anonymous", Password: "anonymous@"}
+	}
+	return &ftpOrigin{addr: addr, path: u.Path, credential: credential}, nil
+}
+
+type ftpConn struct {
+	*textproto.Conn
+	raw net.Conn
+}
+
+func ftpReplyError(err error) error {
+	if e, ok := err.(*textproto.Error); ok {
+		// 4xx replies are transient, 5xx are permanent
+		return &originError{permanent: e.Code >= 500, message: "FTP error " + e.Error()}
+	}
+	return err
+}
+
+// cmd sends a command and reads its reply, which should be in expectCode
+// as in textproto.Reader.ReadResponse
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	c.raw.SetDeadline(time.Now().Add(ORIGIN_TIMEOUT))
+	_, err := c.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	code, message, err := c.ReadResponse(expectCode)
+	return code, message, ftpReplyError(err)
+}
+
+func (o *ftpOrigin) dial(ctx context.Context) (*ftpConn, error) {
+	dialer := net.Dialer{Timeout: ORIGIN_TIMEOUT}
+	raw, err := dialer.DialContext(ctx, "tcp", o.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{Conn: textproto.NewConn(raw), raw: raw}
+	raw.SetDeadline(time.Now().Add(ORIGIN_TIMEOUT))
+	if _, _, err = c.ReadResponse(2); err != nil {
+		c.Close()
+		return nil, ftpReplyError(err)
+	}
+	code, _, err := c.cmd(0, "USER %s", o.credential.User)
+	if err == nil {
+		switch code {
+		case 230:
+		case 331:
+			_, _, err = c.cmd(2, "PASS %s", o.credential.Password)
+		default:
+			err = &originError{permanent: true, message: "FTP login failed with reply " + strconv.Itoa(code)}
+		}
+	}
+	if err == nil {
+		_, _, err = c.cmd(2, "TYPE I")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ftpConn) quit() {
+	c.cmd(2, "QUIT")
+	c.Close()
+}
+
+// openData opens a passive data connection, with EPSV or PASV if the server
+// doesn't know EPSV. Data connections go to the host of the control
+// connection, addresses in PASV replies are often wrong behind NAT.
+func (c *ftpConn) openData(ctx context.Context) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.raw.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	var port int
+	_, message, err := c.cmd(229, "EPSV")
+	if err == nil {
+		// Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(message, "(|||"), strings.LastIndex(message, "|)")
+		if start < 0 || end < start+4 {
+			return nil, &originError{message: "Bad EPSV reply " + message}
+		}
+		port, err = strconv.Atoi(message[start+4 : end])
+	} else {
+		// Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		_, message, err = c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		start, end := strings.Index(message, "("), strings.LastIndex(message, ")")
+		if start < 0 || end < start {
+			return nil, &originError{message: "Bad PASV reply " + message}
+		}
+		fields := strings.Split(message[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, &originError{message: "Bad PASV reply " + message}
+		}
+		var p1, p2 int
+		p1, err = strconv.Atoi(strings.TrimSpace(fields[4]))
+		if err == nil {
+			p2, err = strconv.Atoi(strings.TrimSpace(fields[5]))
+		}
+		port = p1<<8 + p2
+	}
+	if err != nil {
+		return nil, &originError{message: "Bad passive reply " + message}
+	}
+	dialer := net.Dialer{Timeout: ORIGIN_TIMEOUT}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Stat gets size with SIZE and validator with MDTM, both are optional
+// commands of FTP
+func (o *ftpOrigin) Stat(ctx context.Context) (size int64, validator string, err error) {
+	c, err := o.dial(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer c.quit()
+	size = -1
+	_, message, err := c.cmd(2, "SIZE %s", o.path)
+	if e, ok := err.(*originError); ok && e.permanent {
+		// 550 means the file doesn't exist, or SIZE is not supported
+		if !strings.HasPrefix(e.message, "FTP error 550") {
+			err = nil
+		}
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if message != "" {
+		if n, e := strconv.ParseInt(strings.TrimSpace(message), 10, 64); e == nil {
+			size = n
+		}
+	}
+	_, message, err = c.cmd(2, "MDTM %s", o.path)
+	if err == nil {
+		validator = strings.TrimSpace(message)
+	}
+	return size, validator, nil
+}
+
+// ftpReader reads a RETR data connection, and closes the control connection
+// along with it
+type ftpReader struct {
+	ctx  context.Context
+	conn *ftpConn
+	data net.Conn
+	eof  bool
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.eof {
+		return 0, io.EOF
+	}
+	r.data.SetReadDeadline(time.Now().Add(ORIGIN_TIMEOUT))
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		// data connection is also closed when the server aborts the
+		// transfer, which is only told by the reply on control connection
+		r.conn.raw.SetDeadline(time.Now().Add(ORIGIN_TIMEOUT))
+		if _, _, e := r.conn.ReadResponse(2); e != nil {
+			return n, ftpReplyError(e)
+		}
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *ftpReader) Close() error {
+	err := r.data.Close()
+	r.conn.Close()
+	return err
+}
+
+func (o *ftpOrigin) Open(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	c, err := o.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.openData(ctx)
+	if err != nil {
+		c.quit()
+		return nil, err
+	}
+	if offset > 0 {
+		_, _, err = c.cmd(3, "REST %d", offset)
+	}
+	if err == nil {
+		_, _, err = c.cmd(1, "RETR %s", o.path)
+	}
+	if err != nil {
+		data.Close()
+		c.quit()
+		return nil, err
+	}
+	return &ftpReader{ctx: ctx, conn: c, data: data}, nil
+}
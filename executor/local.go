@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	exec "github.com/mesos/mesos-go/executor"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// localDriver drives the executor when it's started by the local backend of
+// scheduler instead of a Mesos slave. Messages from scheduler are read from
+// fd 3 and messages to scheduler are written to fd 4, see common.LocalMessage
+type localDriver struct {
+	executor exec.Executor
+	in       *os.File
+	out      *os.File
+
+	lock    sync.Mutex // guards encoder
+	encoder *json.Encoder
+
+	stopped  chan bool
+	stopOnce sync.Once
+}
+
+func newLocalDriver(executor exec.Executor) *localDriver {
+	out := os.NewFile(4, "scheduler-out")
+	return &localDriver{
+		executor: executor,
+		in:       os.NewFile(3, "scheduler-in"),
+		out:      out,
+		encoder:  json.NewEncoder(out),
+		stopped:  make(chan bool),
+	}
+}
+
+func (d *localDriver) Start() (mesos.Status, error) {
+	hostname, _ := os.Hostname()
+	d.executor.Registered(d, nil, nil, &mesos.SlaveInfo{Hostname: &hostname})
+	go d.serve()
+	return mesos.Status_DRIVER_RUNNING, nil
+}
+
+func (d *localDriver) serve() {
+	decoder := json.NewDecoder(d.in)
+	for {
+		var msg common.LocalMessage
+		err := decoder.Decode(&msg)
+		if err != nil {
+			fmt.Println("Lost connection to scheduler:", err)
+			d.executor.Shutdown(d)
+			return
+		}
+		switch msg.Type {
+		case common.LocalMsgLaunch:
+			taskId, name := msg.TaskId, msg.Name
+			taskInfo := &mesos.TaskInfo{
+				Name:   &name,
+				TaskId: &mesos.TaskID{Value: &taskId},
+				Data:   msg.Data,
+			}
+			go d.executor.LaunchTask(d, taskInfo)
+		case common.LocalMsgKill:
+			taskId := msg.TaskId
+			go d.executor.KillTask(d, &mesos.TaskID{Value: &taskId})
+		case common.LocalMsgFramework:
+			go d.executor.FrameworkMessage(d, msg.Message)
+		case common.LocalMsgShutdown:
+			d.executor.Shutdown(d)
+			return
+		default:
+			fmt.Println("Unknown message from scheduler:", msg.Type)
+		}
+	}
+}
+
+func (d *localDriver) Stop() (mesos.Status, error) {
+	d.stopOnce.Do(func() {
+		close(d.stopped)
+	})
+	return mesos.Status_DRIVER_STOPPED, nil
+}
+
+func (d *localDriver) Abort() (mesos.Status, error) {
+	return d.Stop()
+}
+
+func (d *localDriver) Join() (mesos.Status, error) {
+	<-d.stopped
+	return mesos.Status_DRIVER_STOPPED, nil
+}
+
+func (d *localDriver) Run() (mesos.Status, error) {
+	status, err := d.Start()
+	if err != nil {
+		return status, err
+	}
+	return d.Join()
+}
+
+func (d *localDriver) send(msg *common.LocalMessage) (mesos.Status, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	err := d.encoder.Encode(msg)
+	if err != nil {
+		return mesos.Status_DRIVER_ABORTED, err
+	}
+	return mesos.Status_DRIVER_RUNNING, nil
+}
+
+func (d *localDriver) SendStatusUpdate(status *mesos.TaskStatus) (mesos.Status, error) {
+	return d.send(&common.LocalMessage{
+		Type:    common.LocalMsgStatus,
+		TaskId:  status.GetTaskId().GetValue(),
+		State:   mesos.TaskState_name[int32(status.GetState())],
+		Message: status.GetMessage(),
+	})
+}
+
+func (d *localDriver) SendFrameworkMessage(message string) (mesos.Status, error) {
+	return d.send(&common.LocalMessage{Type: common.LocalMsgFramework, Message: message})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 
@@ -9,16 +10,12 @@ import (
 
 	"encoding/json"
 	"legitlab.letv.cn/optimus/optimus/common"
-	"legitlab.letv.cn/optimus/optimus/executor/s3"
-	"github.com/garyburd/redigo/redis"
-	"github.com/FZambia/go-sentinel"
 	"io"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"time"
-	"errors"
+	"sync"
 )
 
 type ReaderAtSeeker interface {
@@ -30,126 +27,57 @@ var (
 	MAX_RETRY_TIMES = 3
 	CHUNK_SIZE      = 8 << 20 // 8 MB
 
-	results = make(chan *FileTask)
-    pool    *redis.Pool
+	// default number of parallel connections per file, could be overridden by job
+	downloadThreads = 1
 )
 
-/*https://godoc.org/github.com/garyburd/redigo/redis#Pool*/
-func newRedisPool(server, password string) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle: 3,
-		IdleTimeout: 60 * time.Second,
-		Dial: func () (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-}
+// FileProgress is the progress of transferring a file, which is sent to
+// scheduler in batches by progressBatcher
+type FileProgress struct {
+	urlInfo common.UrlInfo
 
-func newSentinelPool(addrs []string, master string) *redis.Pool {
-	sntnl := &sentinel.Sentinel{
-		Addrs:      addrs,
-		MasterName: master,
-		Dial: func(addr string) (redis.Conn, error) {
-			timeout := 500 * time.Millisecond
-			c, err := redis.DialTimeout("tcp", addr, timeout, timeout, timeout)
-			if err != nil {
-				return nil, err
-			}
-			return c, nil
-		},
-	}
-	return &redis.Pool{
-		MaxIdle:     3,
-		MaxActive:   64,
-		Wait:        true,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			masterAddr, err := sntnl.MasterAddr()
-			if err != nil {
-				return nil, err
-			}
-			c, err := redis.Dial("tcp", masterAddr)
-			if err != nil {
-				return nil, err
-			}
-			return c, nil
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if !sentinel.TestRole(c, "master") {
-				return errors.New("Role check failed")
-			} else {
-				return nil
-			}
-		},
-	}
+	// called with every progress sample
+	onProgress func(info common.UrlInfo)
 }
 
-type RedisKeyValue struct {
-	key      string
-	urlInfo  common.UrlInfo
-	conn     *redis.Conn
+func (prog *FileProgress) setSize(size int64) {
+	prog.urlInfo.Size = size
 }
 
-func (rkv *RedisKeyValue) setConn(conn *redis.Conn) {
-	rkv.conn = conn
+func (prog *FileProgress) getSize() int64{
+	return prog.urlInfo.Size
 }
 
-func (rkv *RedisKeyValue) setKey(key string) {
-	rkv.key = key
+func (prog *FileProgress) setSpeed(speed int) {
+	prog.urlInfo.Speed = speed
 }
 
-func (rkv *RedisKeyValue) setSize(size int64) {
-	rkv.urlInfo.Size = size
-}
-
-func (rkv *RedisKeyValue) getSize() int64{
-	return rkv.urlInfo.Size
-}
-
-func (rkv *RedisKeyValue) setSpeed(speed int) {
-	rkv.urlInfo.Speed = speed
-}
-
-func (rkv *RedisKeyValue) setPercentage(finishedSize int64, ulFlag bool) {
+func (prog *FileProgress) setPercentage(finishedSize int64, ulFlag bool) {
 	var startPercent int
 	if ulFlag {
 		startPercent = 50
 	}
-	if rkv.urlInfo.Size == 0 {
-		rkv.urlInfo.Percentage = startPercent + 50
+	if prog.urlInfo.Size == 0 {
+		prog.urlInfo.Percentage = startPercent + 50
 		return
-	} else if rkv.urlInfo.Size == -1 {
-		rkv.urlInfo.Percentage = -1
+	} else if prog.urlInfo.Size == -1 {
+		prog.urlInfo.Percentage = -1
 		return
 	}
-	rkv.urlInfo.Percentage = startPercent + int(finishedSize * 50 / rkv.urlInfo.Size)
+	prog.urlInfo.Percentage = startPercent + int(finishedSize * 50 / prog.urlInfo.Size)
 }
 
-func (rkv *RedisKeyValue) send() error {
-	if rkv.conn == nil {
-		return nil
-	}
-	value, err := json.Marshal(rkv.urlInfo)
-	if err != nil {
-		fmt.Println("Json marshal failed:", err)
-		return err
+func (prog *FileProgress) send() {
+	if prog.onProgress != nil {
+		prog.onProgress(prog.urlInfo)
 	}
-	fmt.Println("url", rkv.key, "speed", rkv.urlInfo.Speed, "percentage", rkv.urlInfo.Percentage, "size", rkv.urlInfo.Size)
-	(*rkv.conn).Do("SET", rkv.key, value)
-	return nil
 }
 
 type FileTask struct {
 	name          string
 	originUrl     string
+	fetchUrl      string    // url data is downloaded from, originUrl if empty
+	fetchInfo     *FileInfo // info of fetchUrl if it can't be HEAD
 	targetUrl     string
 	targetType    string
 	targetBucket  string
@@ -159,186 +87,245 @@ type FileTask struct {
 	accessKey     string
 	secretKey     string
 	targetCluster string
-	size          int64
+	// S3 cluster and keys which s3:// origin is read from
+	sourceCluster   string
+	sourceAccessKey string
+	sourceSecretKey string
+	// credential of ftp:// and sftp:// origin
+	credential   *common.Credential
+	transferMode string // in spool/stream
+	threads      int
+	size         int64
+
+	// states kept between retries, so the file doesn't need to be
+	// downloaded from scratch
+	filename    string
+	blocks      []Block
+	validator   string // ETag or Last-Modified of origin file
+	contentType string
+	downloaded  bool
+	upload      *common.Upload   // unfinished multipart upload
+	expected    *common.Checksum // checksum given by origin and user
+	digest      *streamDigest    // checksum of downloaded data
+	checksum    *common.Checksum // checksum of transferred data
+	err         error            // error of the last try
+
+	userChecksum *common.Checksum
+
+	// called when a part of the file is uploaded
+	onUpload func(task *FileTask, part common.Part)
+	// called when the file starts Downloading or Uploading
+	onState func(task *FileTask, status string)
+	// called with progress samples
+	onProgress func(task *FileTask, info common.UrlInfo)
+	// canceled when the task is killed
+	ctx context.Context
+	// rate limit shared by all files of the task
+	limiter *tokenBucket
 }
 
-func s3SimpleUpload(file io.Reader, task *FileTask, contentType string) (targetUrl string, err error) {
-	d := s3.NewDriver(task.accessKey, task.secretKey, task.targetCluster, task.targetBucket, contentType)
-	uploader, err := d.NewSimpleMultiPartWriter(task.name, CHUNK_SIZE, task.targetAcl)
-	if err != nil {
-		return
-	}
-	defer uploader.Close()
-
-	n, err := io.Copy(uploader, file)
-	if err != nil {
-		return
+func (task *FileTask) downloadUrl() string {
+	if task.fetchUrl != "" {
+		return task.fetchUrl
 	}
-	fmt.Println("File", task.name, "uploaded with", n, "bytes")
-	targetUrl = task.targetCluster + "/" + task.targetBucket + task.name // task.name has a prefix "/"
-	return
+	return task.originUrl
 }
 
-func s3Upload(file ReaderAtSeeker, task *FileTask, contentType string, rkv *RedisKeyValue) (targetUrl string, err error) {
-	d := s3.NewDriver(task.accessKey, task.secretKey, task.targetCluster, task.targetBucket, contentType)
-	uploader, err := d.NewMultiPartWriter(task.name, int64(CHUNK_SIZE), task.targetAcl)
-	if err != nil {
-		fmt.Println("NewMultiPartWriter failed!")
-		return
+func (task *FileTask) setState(status string) {
+	if task.onState != nil {
+		task.onState(task, status)
 	}
-	size, err := file.Seek(0, 2)
-	if err != nil {
-		fmt.Println("File seek error! ", err)
-		return
-	}
-	file.Seek(0, 0)
-	rkv.setSize(size)
-	rkv.setSpeed(0)
-	rkv.setPercentage(0, true)
-	rkv.send()
-
-	var ulErr error
-	var finish = make(chan bool)
-	uploader.OnFinish(func(err error) {
-		ulErr = err
-		finish <- true
-	})
-
-	var exit bool
-	var ulSize, prev int64
-	uploader.Start(file)
-	for !exit {
-		prev = ulSize
-		ulSize = uploader.GetUploadedSize()
-
-		rkv.setSpeed(int(ulSize - prev))
-		rkv.setPercentage(ulSize, true)
-		rkv.send()
-
-		select {
-		case exit = <-finish:
-		default:
-			time.Sleep(time.Second * 1)
-		}
-	}
-
-	rkv.setSpeed(0)
-	rkv.setPercentage(ulSize, true)
-	rkv.send()
-
-	err = ulErr
-	fmt.Println("File", task.name, "uploaded with", ulSize, "bytes")
-	targetUrl = task.targetCluster + "/" + task.targetBucket + task.name // task.name has a prefix "/"
-	return
 }
 
-func progress(speed int, dlSize int64, rkv *RedisKeyValue) {
-	rkv.setSpeed(speed)
-	rkv.setPercentage(dlSize, false)
-	rkv.send()
+func progress(speed int, dlSize int64, prog *FileProgress) {
+	prog.setSpeed(speed)
+	prog.setPercentage(dlSize, false)
+	prog.send()
 }
 
-func fileDownload(fileDl *FileDl, rkv *RedisKeyValue) (size int64, err error) {
+func fileDownload(fileDl *FileDl, prog *FileProgress) (size int64, err error) {
 	size = fileDl.Size
-	rkv.setSize(size)
-	rkv.setSpeed(0)
-	rkv.setPercentage(0, false)
-	rkv.send()
+	prog.setSize(size)
+	prog.setSpeed(0)
+	prog.setPercentage(0, false)
+	prog.send()
 
-	fileDl.SetCB(rkv, progress)
+	fileDl.SetCB(prog, progress)
 	dlSize, dlErr := fileDl.Download()
 
-	rkv.setSpeed(0)
-	rkv.setPercentage(dlSize, false)
-	rkv.send()
+	prog.setSpeed(0)
+	prog.setPercentage(dlSize, false)
+	prog.send()
 
 	return dlSize, dlErr
 }
 
-func transfer(task *FileTask) {
+// download file into working directory, a partially downloaded file of a
+// previous try is continued if possible
+func spoolDownload(task *FileTask, file *os.File, prog *FileProgress) error {
+	fileDl, err := newDownloader(task, task.digest.writer(file), task.threads)
+	if err != nil {
+		fmt.Println("Cannot new file downloader!", "with error", err)
+		return err
+	}
+	fileDl.SetContext(task.ctx)
+	fileDl.SetLimiter(task.limiter)
+	if task.blocks != nil && !fileDl.Resume(task.blocks, task.validator) {
+		fmt.Println("Cannot resume downloading, start over: ", task.originUrl)
+		file.Truncate(0)
+		task.digest.reset()
+	}
+	n, err := fileDownload(fileDl, prog)
+	if err == errOriginChanged {
+		fmt.Println("Origin file changed, start over: ", task.originUrl)
+		file.Truncate(0)
+		task.blocks = nil
+		task.digest.reset()
+		return spoolDownload(task, file, prog)
+	}
+	if err != nil {
+		fmt.Println("Error downloading file: ", task.name, "with error", err)
+		// keep downloaded blocks for next try
+		task.blocks = append([]Block(nil), fileDl.BlockList...)
+		task.validator = fileDl.Validator()
+		return err
+	}
+	fmt.Println("File", task.name, "downloaded with", n, "bytes")
+	task.contentType = fileDl.GetContentType()
+	task.expected = expectedChecksum(fileDl.Checksum, task.userChecksum)
+	task.downloaded = true
+	return nil
+}
+
+// download the whole file into working directory first, then upload it
+func spoolTransfer(task *FileTask, prog *FileProgress) error {
+	var file *os.File
 	var err error
-	filename := strings.Replace(strings.Replace(task.originUrl, "/", "", -1),
-		":", "", -1) // escape "/" and ":" in url so it could be used as filename
-	file, err := os.Create(filename)
+	if task.filename == "" {
+		task.filename = strings.Replace(strings.Replace(task.originUrl, "/", "", -1),
+			":", "", -1) // escape "/" and ":" in url so it could be used as filename
+		file, err = os.Create(task.filename)
+	} else {
+		// retrying, keep what's downloaded
+		file, err = os.OpenFile(task.filename, os.O_RDWR|os.O_CREATE, 0644)
+	}
 	if err != nil {
 		fmt.Println("Error creating file: ", task.name)
-		task.status = "Failed"
-		results <- task
-		return
+		return err
 	}
-	defer os.Remove(filename)
 	defer file.Close()
 
-	var rkv RedisKeyValue
-	if pool != nil {
-		conn := pool.Get()
-		defer conn.Close()
-		rkv.setConn(&conn)
-		rkv.setKey(task.originUrl)
-	} else {
-		rkv.setConn(nil)
+	if task.digest == nil {
+		task.digest = newStreamDigest()
 	}
-	rkv.urlInfo.Size = 0
-	rkv.urlInfo.Speed = 0
-	rkv.urlInfo.Percentage = 0
-
-	fileDl, err := NewFileDl(task.originUrl, file, 0)
+	if !task.downloaded {
+		task.setState("Downloading")
+		err = spoolDownload(task, file, prog)
+		if err != nil {
+			return err
+		}
+	}
+	sum, size, err := task.digest.finish(file)
 	if err != nil {
-		fmt.Println("Cannot new file downloader!", "with error", err)
-		task.status = "Failed"
-		results <- task
-		return
+		fmt.Println("Error reading file: ", task.name, "with error", err)
+		return err
 	}
-	n, err := fileDownload(fileDl, &rkv)
+	task.checksum = sum
+	err = verifyChecksum(task.expected, sum)
 	if err != nil {
-		fmt.Println("Error downloading file: ", task.name, "with error", err)
-		task.status = "Failed"
-		results <- task
-		return
+		fmt.Println("Downloaded file is corrupted: ", task.name)
+		// download again in next try
+		file.Truncate(0)
+		task.downloaded = false
+		task.blocks = nil
+		task.digest = nil
+		return err
+	}
+	target, err := newTarget(task, task.contentType)
+	if err != nil {
+		fmt.Println("Cannot new upload target for file: ", task.name, "with error", err)
+		return err
 	}
-	contentType := fileDl.GetContentType()
-	fmt.Println("File", task.name, "downloaded with", n, "bytes")
 	file.Seek(0, 0)
-	var targetUrl string
-	switch task.targetType {
-	case "s3":
-		targetUrl, err = s3Upload(file, task, contentType, &rkv)
-		if err != nil {
-			fmt.Println("Error uploading file: ", task.name, "with error", err)
-			task.status = "Failed"
-			results <- task
-			return
+	task.setState("Uploading")
+	err = target.Upload(file, prog)
+	if err != nil {
+		fmt.Println("Error uploading file: ", task.name, "with error", err)
+		return err
+	}
+	err = target.Verify(sum, size)
+	if err != nil {
+		fmt.Println("Error verifying uploaded file: ", task.name, "with error", err)
+		// upload again from scratch in next try
+		task.upload = nil
+		return err
+	}
+
+	task.targetUrl = target.Url()
+	task.size = prog.getSize()
+	os.Remove(task.filename)
+	return nil
+}
+
+func transfer(task *FileTask, results chan *FileTask) {
+	var prog FileProgress
+	prog.urlInfo.Url = task.originUrl
+	prog.urlInfo.Size = 0
+	prog.urlInfo.Speed = 0
+	prog.urlInfo.Percentage = 0
+	if task.onProgress != nil {
+		prog.onProgress = func(info common.UrlInfo) {
+			task.onProgress(task, info)
 		}
-	case "Vaas":
-		fmt.Println("Vaas upload has not been implemented")
-		task.status = "Failed"
+	}
+
+	var err error
+	if isS3Origin(task.originUrl) {
+		err = s3Transfer(task, &prog)
+	} else if task.transferMode == common.TransferModeStream {
+		err = streamTransfer(task, &prog)
+	} else {
+		err = spoolTransfer(task, &prog)
+	}
+	task.err = err
+	if task.ctx.Err() != nil {
+		task.status = "Cancelled"
 		results <- task
 		return
-	default:
-		fmt.Println("Unknown target type")
-		task.status = "Failed"
+	}
+	if err == errChecksumMismatch {
+		task.status = "ChecksumFailed"
 		results <- task
 		return
 	}
 	if err != nil {
-		fmt.Println("Uploading error: ", err)
 		task.status = "Failed"
 		results <- task
 		return
 	}
-
 	task.status = "Finished"
-	task.targetUrl = targetUrl
-	task.size = rkv.getSize()
 	results <- task
 }
 
 type megatronExecutor struct {
 	tasksLaunched int
+
+	lock     sync.Mutex
+	cancels  map[string]context.CancelFunc // cancel running tasks, keyed by task id
+	limiters map[string]*tokenBucket       // rate limits of running tasks, keyed by task id
+
+	progress *progressBatcher
 }
 
 func newExampleExecutor() *megatronExecutor {
-	return &megatronExecutor{tasksLaunched: 0}
+	progress := newProgressBatcher()
+	go progress.run()
+	return &megatronExecutor{
+		tasksLaunched: 0,
+		cancels:       make(map[string]context.CancelFunc),
+		limiters:      make(map[string]*tokenBucket),
+		progress:      progress,
+	}
 }
 
 func (exec *megatronExecutor) Registered(driver exec.ExecutorDriver,
@@ -377,13 +364,46 @@ func updateFileStatus(driver exec.ExecutorDriver, taskId string, fileTask *FileT
 		TaskId:    id,
 		Status:    fileTask.status,
 		Size:      fileTask.size,
+		Checksum:  fileTask.checksum,
 	}
-	jsonUpdate, err := json.Marshal(update)
+	if fileTask.status == "Failed" || fileTask.status == "ChecksumFailed" {
+		update.ErrorClass, update.HttpStatus = classifyError(fileTask.err)
+		if fileTask.err != nil {
+			update.Message = fileTask.err.Error()
+		}
+	}
+	sendUrlUpdate(driver, &update)
+}
+
+func sendUrlUpdate(driver exec.ExecutorDriver, update *common.UrlUpdate) {
+	jsonUpdate, err := json.Marshal(common.ExecutorMessage{Type: common.MsgUrlUpdate, Update: update})
 	if err != nil {
 		fmt.Println("Error marshal json: ", err)
 		return
 	}
-	driver.SendFrameworkMessage(string(jsonUpdate))
+	_, err = driver.SendFrameworkMessage(string(jsonUpdate))
+	if err != nil {
+		fmt.Println("Error sending url update: ", err)
+	}
+}
+
+// checkpoint multipart upload state of a file to scheduler
+func updateUploadState(driver exec.ExecutorDriver, taskId int64, fileTask *FileTask, part common.Part) {
+	sendUrlUpdate(driver, &common.UrlUpdate{
+		OriginUrl: fileTask.originUrl,
+		TaskId:    taskId,
+		Status:    "Uploading",
+		Upload:    &common.Upload{UploadId: fileTask.upload.UploadId, Parts: []common.Part{part}},
+	})
+}
+
+// tell scheduler the file starts Downloading or Uploading
+func updateFileState(driver exec.ExecutorDriver, taskId int64, fileTask *FileTask, status string) {
+	sendUrlUpdate(driver, &common.UrlUpdate{
+		OriginUrl: fileTask.originUrl,
+		TaskId:    taskId,
+		Status:    status,
+	})
 }
 
 func (exec *megatronExecutor) LaunchTask(driver exec.ExecutorDriver, taskInfo *mesos.TaskInfo) {
@@ -402,6 +422,38 @@ func (exec *megatronExecutor) LaunchTask(driver exec.ExecutorDriver, taskInfo *m
 	}
 	fmt.Println("Task info data: ", task)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	taskId := taskInfo.GetTaskId().GetValue()
+	// the bucket is created even without limit, scheduler may set one later
+	limiter := newTokenBucket(task.MaxSpeed)
+	exec.lock.Lock()
+	exec.cancels[taskId] = cancel
+	exec.limiters[taskId] = limiter
+	exec.lock.Unlock()
+	// the Mesos driver delivers no other callback, e.g. KillTask or
+	// FrameworkMessage, until LaunchTask returns
+	go exec.runTask(driver, taskInfo, &task, ctx, cancel, limiter)
+}
+
+// runTask transfers all files of the task and reports the task status once
+// they're done
+func (exec *megatronExecutor) runTask(driver exec.ExecutorDriver, taskInfo *mesos.TaskInfo,
+	task *common.TransferTask, ctx context.Context, cancel context.CancelFunc, limiter *tokenBucket) {
+	taskId := taskInfo.GetTaskId().GetValue()
+	defer func() {
+		exec.lock.Lock()
+		delete(exec.cancels, taskId)
+		delete(exec.limiters, taskId)
+		exec.lock.Unlock()
+		cancel()
+	}()
+
+	results := make(chan *FileTask)
+	threads := downloadThreads
+	if task.Threads > 0 {
+		threads = task.Threads
+	}
+
 	for _, sourceUrl := range task.OriginUrls {
 		urlParsed, err := url.Parse(sourceUrl)
 		if err != nil {
@@ -409,22 +461,51 @@ func (exec *megatronExecutor) LaunchTask(driver exec.ExecutorDriver, taskInfo *m
 			updateTaskStatus(driver, taskInfo.GetTaskId(), mesos.TaskState_TASK_ERROR)
 			return
 		}
+		name := urlParsed.Path
+		if key, ok := task.TargetKeys[sourceUrl]; ok {
+			name = "/" + strings.TrimLeft(key, "/")
+		}
 		t := &FileTask{
-			name:          urlParsed.Path,
-			originUrl:     sourceUrl,
-			targetType:    task.TargetType,
-			targetBucket:  task.TargetBucket,
-			targetAcl:     task.TargetAcl,
-			retriedTimes:  0,
-			accessKey:     task.AccessKey,
-			secretKey:     task.SecretKey,
-			targetCluster: task.TargetCluster,
-			size:          0,
+			name:            name,
+			originUrl:       sourceUrl,
+			targetType:      task.TargetType,
+			targetBucket:    task.TargetBucket,
+			targetAcl:       task.TargetAcl,
+			retriedTimes:    0,
+			accessKey:       task.AccessKey,
+			secretKey:       task.SecretKey,
+			targetCluster:   task.TargetCluster,
+			sourceCluster:   task.SourceCluster,
+			sourceAccessKey: task.SourceAccessKey,
+			sourceSecretKey: task.SourceSecretKey,
+			credential:      task.Credentials[common.CredentialKey(urlParsed)],
+			transferMode:    task.TransferMode,
+			threads:         threads,
+			size:            0,
+			upload:          task.Uploads[sourceUrl],
+			userChecksum:    task.Checksums[sourceUrl],
+			onUpload: func(t *FileTask, part common.Part) {
+				updateUploadState(driver, task.Id, t, part)
+			},
+			onState: func(t *FileTask, status string) {
+				updateFileState(driver, task.Id, t, status)
+			},
+			onProgress: func(t *FileTask, info common.UrlInfo) {
+				exec.progress.add(driver, &common.ProgressReport{
+					TaskId:  task.Id,
+					JobUuid: task.JobUuid,
+					UId:     task.UId,
+					Info:    info,
+				})
+			},
+			ctx:     ctx,
+			limiter: limiter,
 		}
-		go transfer(t)
+		go transfer(t, results)
 	}
 	finished := 0
 	failed := 0
+	cancelled := 0
 FOR:
 	for {
 		result := <-results
@@ -432,26 +513,42 @@ FOR:
 		case "Finished":
 			finished++
 			updateFileStatus(driver, taskInfo.TaskId.GetValue(), result)
-			if finished+failed == len(task.OriginUrls) {
+			if finished+failed+cancelled == len(task.OriginUrls) {
 				break FOR
 			}
-		case "Failed":
+		case "Cancelled":
+			cancelled++
+			fmt.Println("URL cancelled for ", result.originUrl)
+			if result.filename != "" {
+				os.Remove(result.filename)
+			}
+			updateFileStatus(driver, taskInfo.TaskId.GetValue(), result)
+			if finished+failed+cancelled == len(task.OriginUrls) {
+				break FOR
+			}
+		case "Failed", "ChecksumFailed":
 			if result.retriedTimes < MAX_RETRY_TIMES {
 				result.retriedTimes++
-				go transfer(result)
+				go transfer(result, results)
 			} else {
 				failed++
 				fmt.Println("URL failed for ", result.originUrl, "after retries")
+				if result.filename != "" {
+					os.Remove(result.filename)
+				}
 				updateFileStatus(driver, taskInfo.TaskId.GetValue(), result)
 			}
-			if finished+failed == len(task.OriginUrls) {
+			if finished+failed+cancelled == len(task.OriginUrls) {
 				break FOR
 			}
 		default:
 			fmt.Println("Should NEVER hit here")
 		}
 	}
-	if failed == 0 {
+	if ctx.Err() != nil {
+		updateTaskStatus(driver, taskInfo.GetTaskId(), mesos.TaskState_TASK_KILLED)
+		fmt.Println("Task killed", taskInfo.GetName())
+	} else if failed == 0 {
 		updateTaskStatus(driver, taskInfo.GetTaskId(), mesos.TaskState_TASK_FINISHED)
 		fmt.Println("Task finished", taskInfo.GetName())
 	} else {
@@ -460,13 +557,42 @@ FOR:
 	}
 }
 
+// KillTask aborts downloads and uploads of the task, other tasks running on
+// the executor are not affected
 func (exec *megatronExecutor) KillTask(driver exec.ExecutorDriver, taskId *mesos.TaskID) {
-	fmt.Println("Kill task")
-	driver.Stop()
+	fmt.Println("Kill task", taskId.GetValue())
+	exec.lock.Lock()
+	cancel, ok := exec.cancels[taskId.GetValue()]
+	exec.lock.Unlock()
+	if !ok {
+		fmt.Println("Task", taskId.GetValue(), "is not running")
+		return
+	}
+	cancel()
 }
 
 func (exec *megatronExecutor) FrameworkMessage(driver exec.ExecutorDriver, msg string) {
 	fmt.Println("Got framework message: ", msg)
+	var message common.SchedulerMessage
+	err := json.Unmarshal([]byte(msg), &message)
+	if err != nil {
+		fmt.Println("Malformed framework message:", err)
+		return
+	}
+	switch message.Type {
+	case common.MsgRate:
+		taskId := strconv.FormatInt(message.TaskId, 10)
+		exec.lock.Lock()
+		limiter, ok := exec.limiters[taskId]
+		exec.lock.Unlock()
+		if !ok {
+			fmt.Println("Task", taskId, "is not running")
+			return
+		}
+		limiter.setRate(message.MaxSpeed)
+	default:
+		fmt.Println("Unknown framework message type:", message.Type)
+	}
 }
 
 func (exec *megatronExecutor) Shutdown(driver exec.ExecutorDriver) {
@@ -486,45 +612,38 @@ func init() {
 func main() {
 	fmt.Println("Starting Megatron...")
 	
-	var redisMaterName  string
-	var redisAddrsStr   string
+	var local bool // started by local backend of scheduler
 	num := len(os.Args) / 2
 	for i := 0; i < num; i++ {
 		index := 2 * i
 		fmt.Println("key:", os.Args[index], "value:", os.Args[index + 1])
-		if os.Args[index] == "--redis-master-name" {
-			redisMaterName = os.Args[index + 1]
+		if os.Args[index] == "--download-threads" {
+			threads, err := strconv.Atoi(os.Args[index + 1])
+			if err != nil || threads < 1 {
+				fmt.Println("Malformed download threads arg:", os.Args[index + 1])
+				continue
+			}
+			downloadThreads = threads
 			continue
-		} else if os.Args[index] == "--redis-addr" {
-			redisAddrsStr = os.Args[index + 1]
+		} else if os.Args[index] == "--local" {
+			local = os.Args[index + 1] == "true"
 			continue
 		}
 	}
 
-	var redisAddrs []string
-	err := json.Unmarshal([]byte(redisAddrsStr), &redisAddrs)
-	if err != nil {
-		fmt.Println("Malformed redis addr arg:", err)
-		redisAddrs = nil
-	}
-
-	if redisAddrs != nil && redisMaterName != "" {
-		/* connect to redis  */
-		pool = newSentinelPool(redisAddrs, redisMaterName)
-		defer pool.Close()
-		fmt.Println("Connected to redis!")
+	var err error
+	var driver exec.ExecutorDriver
+	if local {
+		driver = newLocalDriver(newExampleExecutor())
 	} else {
-		pool = nil
-		fmt.Println("There is no Redis to Connect!")
-	}
-
-	config := exec.DriverConfig{
-		Executor: newExampleExecutor(),
-	}
-	driver, err := exec.NewMesosExecutorDriver(config)
+		config := exec.DriverConfig{
+			Executor: newExampleExecutor(),
+		}
+		driver, err = exec.NewMesosExecutorDriver(config)
 
-	if err != nil {
-		fmt.Println("Unable to create a ExecutorDriver ", err.Error())
+		if err != nil {
+			fmt.Println("Unable to create a ExecutorDriver ", err.Error())
+		}
 	}
 
 	_, err = driver.Start()
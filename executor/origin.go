@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// Origin is a server files are downloaded from with a protocol other than
+// HTTP. FileDl downloads from an Origin in a single stream, reporting
+// progress and resuming from offsets the same way as HTTP. New protocols are
+// added by implementing Origin and registering a constructor in
+// originBuilders.
+type Origin interface {
+	// Stat returns size of the file, and a validator which changes when the
+	// file is modified, "" if the server cannot tell
+	Stat(ctx context.Context) (size int64, validator string, err error)
+	// Open returns the content of the file from offset to the end
+	Open(ctx context.Context, offset int64) (io.ReadCloser, error)
+}
+
+// originBuilder returns the Origin of url, credential is nil if it's not
+// given with the job
+type originBuilder func(u *url.URL, credential *common.Credential) (Origin, error)
+
+var originBuilders = map[string]originBuilder{
+	"ftp":  newFtpOrigin,
+	"sftp": newSftpOrigin,
+}
+
+// connecting to or reading from origin servers times out after it
+const ORIGIN_TIMEOUT = 20 * time.Second
+
+// returned when origin sends nothing for ORIGIN_TIMEOUT
+var errOriginTimeout error = originTimeoutError{}
+
+type originTimeoutError struct{}
+
+func (originTimeoutError) Error() string   { return "Reading from origin timed out" }
+func (originTimeoutError) Timeout() bool   { return true }
+func (originTimeoutError) Temporary() bool { return true }
+
+var errNoCredential = &originError{permanent: true, message: "No credential is given for origin"}
+
+// originError is an error answered by an origin server. Permanent errors,
+// like a missing file or a bad credential, are classified like HTTP 4xx,
+// others like HTTP 5xx.
+type originError struct {
+	permanent bool
+	message   string
+}
+
+func (e *originError) Error() string {
+	return e.message
+}
+
+// newOrigin returns the Origin of the url, nil if it's downloaded by HTTP
+func newOrigin(originUrl string, credential *common.Credential) (Origin, error) {
+	u, err := url.Parse(originUrl)
+	if err != nil {
+		return nil, err
+	}
+	builder, ok := originBuilders[u.Scheme]
+	if !ok {
+		return nil, nil
+	}
+	return builder(u, credential)
+}
+
+// NewOriginDl returns a downloader of the file on origin, it's always
+// downloaded in a single stream so servers are not flooded with connections
+func NewOriginDl(origin Origin, url string, file io.WriterAt) (*FileDl, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ORIGIN_TIMEOUT)
+	defer cancel()
+	size, validator, err := origin.Stat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDl{
+		Url:          url,
+		Size:         size,
+		File:         file,
+		Threads:      1,
+		AcceptRanges: true,
+		LastModified: validator,
+		Checksum:     &common.Checksum{},
+		ctx:          context.Background(),
+		origin:       origin,
+	}, nil
+}
+
+// newDownloader returns a downloader of the file of task, threads is only
+// used by HTTP origins
+func newDownloader(task *FileTask, file io.WriterAt, threads int) (*FileDl, error) {
+	origin, err := newOrigin(task.downloadUrl(), task.credential)
+	if err != nil {
+		return nil, err
+	}
+	if origin != nil {
+		return NewOriginDl(origin, task.downloadUrl(), file)
+	}
+	if task.fetchInfo != nil {
+		return NewFileDlWithInfo(task.downloadUrl(), file, 0, threads, task.fetchInfo), nil
+	}
+	return NewFileDl(task.downloadUrl(), file, 0, threads)
+}
+
+// downloadOriginBlock downloads a block from origin, like downloadBlock
+func (f *FileDl) downloadOriginBlock(id int, bufChan chan *DlBuf) error {
+	begin := f.BlockList[id].Begin
+	end := f.BlockList[id].End
+	if end != -1 && begin > end {
+		return nil // already done
+	}
+	if f.IfRange != "" {
+		// resuming, make sure the file is still the same
+		_, validator, err := f.origin.Stat(f.ctx)
+		if err != nil {
+			return err
+		}
+		if validator != f.IfRange {
+			return errOriginChanged
+		}
+	}
+	body, err := f.origin.Open(f.ctx, begin)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return f.readBlock(id, body, bufChan)
+}
+
+var errBadOriginPath = &originError{permanent: true, message: "Bad path of origin file"}
+
+// checkOriginPath rejects paths which could inject commands
+func checkOriginPath(path string) error {
+	for _, c := range path {
+		if c == '\r' || c == '\n' || c == 0 {
+			return errBadOriginPath
+		}
+	}
+	if path == "" || path == "/" {
+		return errBadOriginPath
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	exec "github.com/mesos/mesos-go/executor"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// how often progress of files is sent to scheduler
+const progressInterval = time.Second
+
+type progressKey struct {
+	taskId int64
+	url    string
+}
+
+// progressBatcher keeps the latest progress of every file being transferred
+// and sends them to scheduler in one framework message per progressInterval
+type progressBatcher struct {
+	lock    sync.Mutex
+	driver  exec.ExecutorDriver
+	reports map[progressKey]*common.ProgressReport
+}
+
+func newProgressBatcher() *progressBatcher {
+	return &progressBatcher{reports: make(map[progressKey]*common.ProgressReport)}
+}
+
+func (b *progressBatcher) add(driver exec.ExecutorDriver, report *common.ProgressReport) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.driver = driver
+	b.reports[progressKey{taskId: report.TaskId, url: report.Info.Url}] = report
+}
+
+func (b *progressBatcher) run() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.flush()
+	}
+}
+
+func (b *progressBatcher) flush() {
+	b.lock.Lock()
+	if len(b.reports) == 0 {
+		b.lock.Unlock()
+		return
+	}
+	message := common.ExecutorMessage{Type: common.MsgProgress}
+	for _, report := range b.reports {
+		message.Progress = append(message.Progress, report)
+	}
+	b.reports = make(map[progressKey]*common.ProgressReport)
+	driver := b.driver
+	b.lock.Unlock()
+
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		fmt.Println("Error marshal json: ", err)
+		return
+	}
+	_, err = driver.SendFrameworkMessage(string(jsonMessage))
+	if err != nil {
+		fmt.Println("Error sending progress: ", err)
+	}
+}
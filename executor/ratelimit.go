@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of bytes transferred, it's shared by all files
+// of a task so the limit applies to the task as a whole. Reading more than
+// the bucket holds puts it into debt, which is paid by waiting, so large
+// reads like S3 parts are smoothed over time.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64 // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rate = rate
+	b.tokens = 0
+	b.last = time.Now()
+}
+
+// wait takes n tokens, and blocks until the bucket is out of debt or ctx is
+// done. A nil bucket is unlimited.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate) // burst of at most one second
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.lock.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader limits reading of data being uploaded
+type limitedReader struct {
+	reader  io.Reader
+	limiter *tokenBucket
+	ctx     context.Context
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
@@ -1,6 +1,7 @@
 package s3
 
 import (
+  "context"
   "github.com/goamz/goamz/s3"
   "github.com/goamz/goamz/aws"
   "io"
@@ -12,11 +13,15 @@ import (
   "fmt"
   "crypto/md5"
   "encoding/hex"
+  "sync/atomic"
+  "time"
 )
 
 
 var (
 	BAD_PATH = errors.New("bad path")
+	BAD_CHECKSUM = errors.New("stored object does not match uploaded data")
+	ABORTED = errors.New("upload aborted")
 )
 
 type Driver struct {
@@ -81,19 +86,143 @@ func (d *Driver) Reader(xpath string, offset int64) (io.ReadCloser, error) {
 	}
 
 	headers := make(http.Header)
-	headers.Add("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	if offset > 0 {
+		headers.Add("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
 
-	resp, err := d.Bucket.GetResponse(path)
+	resp, err := d.Bucket.GetResponseWithHeaders(path, headers)
 	if err != nil {
 		return nil, err
 	}
 	return resp.Body, nil
 }
 
+// ETagIsMD5 tells if ETag in response headers of an object is MD5 of its
+// content, which is not for objects uploaded in parts, or encrypted with
+// SSE-KMS or SSE-C
+func ETagIsMD5(header http.Header) bool {
+	etag := strings.Trim(header.Get("ETag"), "\"")
+	if len(etag) != 32 || strings.HasPrefix(header.Get("ETag"), "W/") {
+		return false
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return false
+	}
+	if header.Get("x-amz-server-side-encryption") == "aws:kms" ||
+		header.Get("x-amz-server-side-encryption-customer-algorithm") != "" {
+		return false
+	}
+	return true
+}
+
+// Stat returns size, ETag, MD5 and content type of an object, md5hex is
+// empty if ETag is not MD5 of the object
+func (d *Driver) Stat(xpath string) (size int64, etag string, md5hex string, contentType string, err error) {
+	resp, err := d.Bucket.Head(d.s3Path(xpath), nil)
+	if err != nil {
+		return 0, "", "", "", err
+	}
+	resp.Body.Close()
+	etag = strings.Trim(resp.Header.Get("ETag"), "\"")
+	if ETagIsMD5(resp.Header) {
+		md5hex = strings.ToLower(etag)
+	}
+	return resp.ContentLength, etag, md5hex, resp.Header.Get("Content-Type"), nil
+}
+
+// SignedURL returns an url to GET the object without keys until expires
+func (d *Driver) SignedURL(xpath string, expires time.Time) string {
+	return d.Bucket.SignedURL(d.s3Path(xpath), expires)
+}
+
+// Copy copies the object source, in form of "bucket/key" on the same cluster,
+// of size bytes to xkey without moving data out of S3. Objects larger than
+// partSize are copied part by part, and the parts are returned. onCopied is
+// called with bytes copied so far after each part.
+func (d *Driver) Copy(ctx context.Context, xkey string, source string, size int64, partSize int64,
+	acl string, onCopied func(int64)) ([]s3.Part, error) {
+	key := d.s3Path(xkey)
+	if size <= partSize {
+		_, err := d.Bucket.PutCopy(key, s3.ACL(acl), s3.CopyOptions{}, source)
+		if err == nil {
+			onCopied(size)
+		}
+		return nil, err
+	}
+	multi, err := d.Bucket.InitMulti(key, d.getContentType(), s3.ACL(acl))
+	if err != nil {
+		return nil, err
+	}
+	var parts []s3.Part
+	for offset := int64(0); offset < size; offset += partSize {
+		if ctx.Err() != nil {
+			multi.Abort()
+			return nil, ABORTED
+		}
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+		options := s3.CopyOptions{CopySourceOptions: "bytes=" + strconv.FormatInt(offset, 10) + "-" +
+			strconv.FormatInt(end-1, 10)}
+		_, part, err := multi.PutPartCopy(len(parts)+1, options, source)
+		if err != nil {
+			multi.Abort()
+			return nil, err
+		}
+		part.Size = end - offset
+		parts = append(parts, part)
+		onCopied(end)
+	}
+	err = multi.Complete(parts)
+	if err != nil {
+		multi.Abort()
+		return nil, err
+	}
+	return parts, nil
+}
+
 func (d *Driver) getContentType() string {
 	return d.ContentType
 }
 
+// Verify checks the stored object against size and md5 of the uploaded data,
+// a negative size or empty md5hex is not checked. ETag of an object uploaded
+// in multiple parts is the md5 of its parts' md5 followed by "-N", so it's
+// checked against parts instead.
+func (d *Driver) Verify(xkey string, size int64, md5hex string, parts []s3.Part) error {
+	resp, err := d.Bucket.Head(xkey, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if size >= 0 && resp.ContentLength != size {
+		fmt.Println("Object", xkey, "has", resp.ContentLength, "bytes, expect", size)
+		return BAD_CHECKSUM
+	}
+	etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+	expected := md5hex
+	if resp.Header.Get("x-amz-server-side-encryption") == "aws:kms" {
+		// ETag of objects encrypted with SSE-KMS is not their md5
+		expected = ""
+	} else if strings.Contains(etag, "-") {
+		digest := md5.New()
+		for _, part := range parts {
+			sum, err := hex.DecodeString(strings.Trim(part.ETag, "\""))
+			if err != nil {
+				return err
+			}
+			digest.Write(sum)
+		}
+		expected = hex.EncodeToString(digest.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+	}
+	if expected != "" && etag != expected {
+		fmt.Println("Object", xkey, "has ETag", etag, "expect", expected)
+		return BAD_CHECKSUM
+	}
+	return nil
+}
+
 
 
 type SimpleMultiPartWriter struct {
@@ -124,6 +253,10 @@ func (w *SimpleMultiPartWriter) Size() int64 {
 	return w.totalSize
 }
 
+func (w *SimpleMultiPartWriter) Parts() []s3.Part {
+	return w.parts
+}
+
 func (w *SimpleMultiPartWriter) Write(b []byte) (n int, err error) {
        w.data = append(w.data, b...)
        w.totalSize += int64(len(b))
@@ -135,7 +268,7 @@ func (w *SimpleMultiPartWriter) Write(b []byte) (n int, err error) {
 			return 0, err
 		}
 		w.parts = append(w.parts, part)
-		w.data = nil
+		w.data = w.data[:0]
        }
        return len(b), nil
 }
@@ -162,7 +295,13 @@ func (w *SimpleMultiPartWriter) Close() error {
 		fmt.Println(err)
 		w.multi.Abort()
 	}
-	return nil
+	return err
+}
+
+// Abort gives up the upload and frees parts already stored
+func (w *SimpleMultiPartWriter) Abort() error {
+	w.data = nil
+	return w.multi.Abort()
 }
 
 
@@ -174,8 +313,12 @@ type MultiPartWriter struct {
 	uploaded     int64
 	parts        []s3.Part
 	multi        *s3.Multi
+	knownParts   []s3.Part // parts recorded by a previous run of the upload
+	aborted      int32
 
 	onFinish     func(error)
+	onPart       func(uploadId string, part s3.Part)
+	limit        func(n int) error
 }
 
 func (d *Driver) NewMultiPartWriter(xkey string, chunkSize int64, acl string) (*MultiPartWriter, error) {
@@ -190,19 +333,33 @@ func (d *Driver) NewMultiPartWriter(xkey string, chunkSize int64, acl string) (*
 	return &w, nil
 }
 
+// ResumeMultiPartWriter continues an existing multipart upload, parts already
+// stored are reused if they match the data. A new upload is started if the
+// old one no longer exists.
+func (d *Driver) ResumeMultiPartWriter(xkey string, uploadId string, parts []s3.Part,
+	chunkSize int64, acl string) (*MultiPartWriter, error) {
+
+	xmulti := &s3.Multi{Bucket: d.Bucket, Key: xkey, UploadId: uploadId}
+	_, err := xmulti.ListParts()
+	if hasCode(err, "NoSuchUpload") {
+		fmt.Println("Upload", uploadId, "no longer exists, start a new one")
+		return d.NewMultiPartWriter(xkey, chunkSize, acl)
+	}
+
+	w := MultiPartWriter{driver: d, key: xkey, chunkSize: chunkSize, totalSize: 0,
+		multi: xmulti, knownParts: parts}
+
+	return &w, nil
+}
+
 func (w *MultiPartWriter) Start(r s3.ReaderAtSeeker) error {
 	go func() {
-		var err error
-		for {
-			parts, err := w.putAll(r)
-			if err != nil {
-				break
-			}
+		parts, err := w.putAll(r)
+		if err == nil {
 			_, err = w.complete(parts)
-			if err != nil {
-				break
-			}
-			break
+		}
+		if err == ABORTED {
+			w.multi.Abort()
 		}
 		w.triggerFinish(err)
 	}()
@@ -210,6 +367,28 @@ func (w *MultiPartWriter) Start(r s3.ReaderAtSeeker) error {
 	return nil
 }
 
+func (w *MultiPartWriter) UploadId() string {
+	return w.multi.UploadId
+}
+
+// OnPart registers fn which is called every time a part is stored, with the
+// part just stored
+func (w *MultiPartWriter) OnPart(fn func(uploadId string, part s3.Part)) {
+	w.onPart = fn
+}
+
+// Abort stops the upload after the part being sent, and frees parts stored
+func (w *MultiPartWriter) Abort() {
+	atomic.StoreInt32(&w.aborted, 1)
+}
+
+// Limit registers fn which is called with the number of bytes of parts sent,
+// so the upload could be slowed down by blocking in fn. Data read only to
+// checksum parts is not counted.
+func (w *MultiPartWriter) Limit(fn func(n int) error) {
+	w.limit = fn
+}
+
 func (w *MultiPartWriter) OnFinish(fn func(error)) {
 	w.onFinish = fn
 }
@@ -243,7 +422,11 @@ func seekerInfo(r io.ReadSeeker) (md5hex string, err error) {
 func (w *MultiPartWriter) putAll(r s3.ReaderAtSeeker) ([]s3.Part, error) {
 	old, err := w.multi.ListParts()
 	if err != nil && !hasCode(err, "NoSuchUpload") {
-		return nil, err
+		if w.knownParts == nil {
+			return nil, err
+		}
+		// fall back to parts recorded last time
+		old = w.knownParts
 	}
 
 	reuse := 0   // Index of next old part to consider reusing.
@@ -258,6 +441,9 @@ func (w *MultiPartWriter) putAll(r s3.ReaderAtSeeker) ([]s3.Part, error) {
 NextSection:
 	for offset := int64(0); offset < totalSize || first; offset += w.chunkSize {
 		first = false
+		if atomic.LoadInt32(&w.aborted) == 1 {
+			return nil, ABORTED
+		}
 		var partSize int64
 		if offset + w.chunkSize > totalSize {
 			partSize = totalSize - offset
@@ -274,7 +460,7 @@ NextSection:
 
 			part := &old[reuse]
 			etag := md5hex
-			if part.N == current && part.Size == partSize && part.ETag == etag {
+			if part.N == current && part.Size == partSize && strings.Trim(part.ETag, "\"") == etag {
 				fmt.Println("part:", part.N, " is reused!")
 				// Checksum matches. Reuse the old part.
 				result = append(result, *part)
@@ -288,17 +474,50 @@ NextSection:
 		fmt.Println("Now put part ", current)
 
 		// Part wasn't found or doesn't match. Send it.
-		part, err := w.multi.PutPart(current, section)
+		var body io.ReadSeeker = section
+		if w.limit != nil {
+			body = &sendLimiter{section: section, limit: w.limit}
+		}
+		part, err := w.multi.PutPart(current, body)
 		if err != nil {
 			return nil, err
 		}
 		result = append(result, part)
 		w.uploaded += partSize
 		current++
+		if w.onPart != nil {
+			w.onPart(w.multi.UploadId, part)
+		}
 	}
 	return result, nil
 }
 
+// sendLimiter limits sending of a part. PutPart reads the part to its end
+// once for its MD5 before sending, so reads are limited only after the
+// first EOF, which covers the send and its retries.
+type sendLimiter struct {
+	section *io.SectionReader
+	limit   func(n int) error
+	sending bool
+}
+
+func (r *sendLimiter) Read(p []byte) (int, error) {
+	n, err := r.section.Read(p)
+	if r.sending {
+		if limitErr := r.limit(n); limitErr != nil && err == nil {
+			err = limitErr
+		}
+	}
+	if err == io.EOF {
+		r.sending = true
+	}
+	return n, err
+}
+
+func (r *sendLimiter) Seek(offset int64, whence int) (int64, error) {
+	return r.section.Seek(offset, whence)
+}
+
 func (w *MultiPartWriter) complete(parts []s3.Part) (int64, error) {
 	err := w.multi.Complete(parts)
 	if err != nil {
@@ -318,3 +537,7 @@ func (w *MultiPartWriter) GetUploadedSize() int64 {
 func (w *MultiPartWriter) Size() int64 {
 	return w.totalSize
 }
+
+func (w *MultiPartWriter) Parts() []s3.Part {
+	return w.parts
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	goamzs3 "github.com/goamz/goamz/s3"
+	"legitlab.letv.cn/optimus/optimus/common"
+	"legitlab.letv.cn/optimus/optimus/executor/s3"
+)
+
+const (
+	// objects larger than it are copied part by part
+	COPY_PART_SIZE = 512 << 20 // 512 MB
+	// how long a signed url of source object is valid
+	SIGNED_URL_EXPIRY = 24 * time.Hour
+)
+
+var errNoSourceCluster = errors.New("No S3 cluster is given for s3:// origin")
+
+func isS3Origin(originUrl string) bool {
+	u, err := url.Parse(originUrl)
+	return err == nil && u.Scheme == "s3"
+}
+
+// s3Transfer transfers an object of s3://bucket/key origin. Objects are
+// copied inside S3 when the target is in the same cluster, and streamed
+// through the executor otherwise. Checksums given by user need the data, so
+// the object is streamed in that case too.
+func s3Transfer(task *FileTask, prog *FileProgress) error {
+	if task.sourceCluster == "" {
+		return errNoSourceCluster
+	}
+	u, err := url.Parse(task.originUrl)
+	if err != nil {
+		return err
+	}
+	source := s3.NewDriver(task.sourceAccessKey, task.sourceSecretKey, task.sourceCluster, u.Host, "")
+	size, etag, md5hex, contentType, err := source.Stat(u.Path)
+	if err != nil {
+		fmt.Println("Error HEAD source object: ", task.originUrl, "with error", err)
+		return err
+	}
+	if task.targetType == "s3" && task.targetCluster == task.sourceCluster && task.userChecksum == nil {
+		return copyTransfer(task, u.Host+u.Path, size, md5hex, contentType, prog)
+	}
+	// the url is signed for GET only, so HEAD is done with keys above
+	task.fetchUrl = source.SignedURL(u.Path, time.Now().Add(SIGNED_URL_EXPIRY))
+	task.fetchInfo = &FileInfo{
+		Size:         size,
+		ContentType:  contentType,
+		AcceptRanges: true,
+		ETag:         "\"" + etag + "\"",
+		Checksum:     &common.Checksum{MD5: md5hex},
+	}
+	return streamTransfer(task, prog)
+}
+
+// copyTransfer copies the object source, in form of bucket/key, of size
+// bytes inside the cluster, with PUT Object - Copy or UploadPartCopy for
+// large objects. sourceMd5 is empty if it's unknown.
+func copyTransfer(task *FileTask, source string, size int64, sourceMd5 string, contentType string,
+	prog *FileProgress) error {
+	var err error
+	target := s3.NewDriver(task.accessKey, task.secretKey, task.targetCluster, task.targetBucket, contentType)
+
+	task.setState("Uploading")
+	var copied int64
+	var parts []goamzs3.Part
+	finish := make(chan bool)
+	go func() {
+		parts, err = target.Copy(task.ctx, task.name, source, size, COPY_PART_SIZE, task.targetAcl,
+			func(n int64) {
+				atomic.StoreInt64(&copied, n)
+			})
+		finish <- true
+	}()
+	reportUpload(prog, size, func() int64 {
+		return atomic.LoadInt64(&copied)
+	}, finish)
+	if err != nil {
+		fmt.Println("Error copying file: ", task.name, "with error", err)
+		return err
+	}
+
+	var sum *common.Checksum
+	if sourceMd5 != "" {
+		sum = &common.Checksum{MD5: sourceMd5}
+	}
+	var md5hex string
+	if sum != nil && parts == nil {
+		md5hex = sum.MD5
+	}
+	err = target.Verify(task.name, size, md5hex, parts)
+	if err == s3.BAD_CHECKSUM {
+		err = errChecksumMismatch
+	}
+	if err != nil {
+		fmt.Println("Error verifying copied file: ", task.name, "with error", err)
+		return err
+	}
+	fmt.Println("File", task.name, "copied with", size, "bytes")
+
+	task.checksum = sum
+	task.targetUrl = task.targetCluster + "/" + task.targetBucket + task.name // task.name has a prefix "/"
+	task.size = size
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	goamzs3 "github.com/goamz/goamz/s3"
+	"legitlab.letv.cn/optimus/optimus/common"
+	"legitlab.letv.cn/optimus/optimus/executor/s3"
+)
+
+type s3Target struct {
+	task   *FileTask
+	driver *s3.Driver
+	parts  []goamzs3.Part // parts of last upload
+}
+
+func newS3Target(task *FileTask, contentType string) (Target, error) {
+	return &s3Target{
+		task:   task,
+		driver: s3.NewDriver(task.accessKey, task.secretKey, task.targetCluster, task.targetBucket, contentType),
+	}, nil
+}
+
+func (t *s3Target) Url() string {
+	return t.task.targetCluster + "/" + t.task.targetBucket + t.task.name // task.name has a prefix "/"
+}
+
+func (t *s3Target) newUploader() (*s3.MultiPartWriter, error) {
+	task := t.task
+	if task.upload == nil {
+		return t.driver.NewMultiPartWriter(task.name, int64(CHUNK_SIZE), task.targetAcl)
+	}
+	fmt.Println("Resume upload", task.upload.UploadId, "of file", task.name)
+	var parts []goamzs3.Part
+	for _, p := range task.upload.Parts {
+		parts = append(parts, goamzs3.Part{N: p.N, ETag: p.ETag, Size: p.Size})
+	}
+	return t.driver.ResumeMultiPartWriter(task.name, task.upload.UploadId, parts,
+		int64(CHUNK_SIZE), task.targetAcl)
+}
+
+func (t *s3Target) Upload(file ReaderAtSeeker, prog *FileProgress) error {
+	task := t.task
+	uploader, err := t.newUploader()
+	if err != nil {
+		fmt.Println("NewMultiPartWriter failed!")
+		return err
+	}
+	// record stored parts, so the upload could be continued after executor lost
+	uploader.OnPart(func(uploadId string, p goamzs3.Part) {
+		if task.upload == nil || task.upload.UploadId != uploadId {
+			task.upload = &common.Upload{UploadId: uploadId}
+		}
+		part := common.Part{N: p.N, ETag: p.ETag, Size: p.Size}
+		task.upload.Parts = append(task.upload.Parts, part)
+		if task.onUpload != nil {
+			task.onUpload(task, part)
+		}
+	})
+	uploader.Limit(func(n int) error {
+		return task.limiter.wait(task.ctx, n)
+	})
+	size, err := file.Seek(0, 2)
+	if err != nil {
+		fmt.Println("File seek error! ", err)
+		return err
+	}
+	file.Seek(0, 0)
+
+	var ulErr error
+	var finish = make(chan bool)
+	var done = make(chan bool)
+	uploader.OnFinish(func(err error) {
+		ulErr = err
+		close(done)
+		finish <- true
+	})
+	// stop uploading and free stored parts when the task is killed
+	go func() {
+		select {
+		case <-task.ctx.Done():
+			uploader.Abort()
+		case <-done:
+		}
+	}()
+	uploader.Start(file)
+	ulSize := reportUpload(prog, size, uploader.GetUploadedSize, finish)
+	t.parts = uploader.Parts()
+
+	fmt.Println("File", task.name, "uploaded with", ulSize, "bytes")
+	return ulErr
+}
+
+func (t *s3Target) Stream(r io.Reader) error {
+	task := t.task
+	uploader, err := t.driver.NewSimpleMultiPartWriter(task.name, CHUNK_SIZE, task.targetAcl)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(uploader, r)
+	if err != nil {
+		uploader.Abort()
+		return err
+	}
+	err = uploader.Close()
+	if err != nil {
+		return err
+	}
+	t.parts = uploader.Parts()
+	fmt.Println("File", task.name, "uploaded with", n, "bytes")
+	return nil
+}
+
+func (t *s3Target) Verify(sum *common.Checksum, size int64) error {
+	var md5hex string
+	if sum != nil {
+		md5hex = sum.MD5
+	}
+	err := t.driver.Verify(t.task.name, size, md5hex, t.parts)
+	if err == s3.BAD_CHECKSUM {
+		return errChecksumMismatch
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+var errNoHostKey = &originError{permanent: true, message: "Host key of SFTP server is required"}
+
+var errHostKeyMismatch = &originError{permanent: true, message: "Host key of SFTP server doesn't match"}
+
+// sftpOrigin downloads files from SFTP servers, a new SSH connection is used
+// for each Stat and Open
+type sftpOrigin struct {
+	addr   string
+	path   string
+	config *ssh.ClientConfig
+}
+
+func newSftpOrigin(u *url.URL, credential *common.Credential) (Origin, error) {
+	if err := checkOriginPath(u.Path); err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if credential == nil {
+		return nil, errNoCredential
+	}
+	if credential.HostKey == "" {
+		return nil, errNoHostKey
+	}
+	var auth []ssh.AuthMethod
+	if credential.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(credential.PrivateKey))
+		if err != nil {
+			return nil, &originError{permanent: true, message: "Bad private key: " + err.Error()}
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if credential.Password != "" {
+		auth = append(auth, ssh.Password(credential.Password))
+	}
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if ssh.FingerprintSHA256(key) != credential.HostKey {
+			return errHostKeyMismatch
+		}
+		return nil
+	}
+	return &sftpOrigin{
+		addr: addr,
+		path: u.Path,
+		config: &ssh.ClientConfig{
+			User:            credential.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         ORIGIN_TIMEOUT,
+		},
+	}, nil
+}
+
+// sftpConn is an SFTP session along with its SSH connection, which is
+// closed when ctx is done
+type sftpConn struct {
+	*sftp.Client
+	ssh    *ssh.Client
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *sftpConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Client.Close()
+		c.ssh.Close()
+	})
+	return err
+}
+
+// timed runs op, and closes the connection if op takes longer than
+// ORIGIN_TIMEOUT. SSH reads connection in background, so deadlines of the
+// connection can't tell a stalled server from an idle one.
+func (c *sftpConn) timed(op func() error) error {
+	timer := time.AfterFunc(ORIGIN_TIMEOUT, func() { c.Close() })
+	err := op()
+	if !timer.Stop() && err != nil {
+		return errOriginTimeout
+	}
+	return err
+}
+
+func sftpError(err error) error {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return &originError{permanent: true, message: "SFTP error " + err.Error()}
+	}
+	return err
+}
+
+func (o *sftpOrigin) dial(ctx context.Context) (*sftpConn, error) {
+	dialer := net.Dialer{Timeout: ORIGIN_TIMEOUT}
+	raw, err := dialer.DialContext(ctx, "tcp", o.addr)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(ORIGIN_TIMEOUT))
+	conn, chans, reqs, err := ssh.NewClientConn(raw, o.addr, o.config)
+	if err != nil {
+		raw.Close()
+		if err, ok := err.(*originError); ok {
+			return nil, err
+		}
+		// most likely the credential is refused
+		return nil, &originError{permanent: true, message: "SSH handshake failed: " + err.Error()}
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	c := &sftpConn{Client: sc, ssh: client, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.closed:
+		}
+	}()
+	return c, nil
+}
+
+// Stat gets size and modification time of the file, the latter is used as
+// validator
+func (o *sftpOrigin) Stat(ctx context.Context) (size int64, validator string, err error) {
+	c, err := o.dial(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer c.Close()
+	var info os.FileInfo
+	err = c.timed(func() (err error) {
+		info, err = c.Stat(o.path)
+		return
+	})
+	if err != nil {
+		return 0, "", sftpError(err)
+	}
+	return info.Size(), info.ModTime().UTC().Format(time.RFC3339), nil
+}
+
+// sftpReader reads a remote file, and closes the connection along with it
+type sftpReader struct {
+	*sftp.File
+	conn *sftpConn
+}
+
+func (r *sftpReader) Read(p []byte) (n int, err error) {
+	err = r.conn.timed(func() (err error) {
+		n, err = r.File.Read(p)
+		return
+	})
+	return
+}
+
+func (r *sftpReader) Close() error {
+	err := r.File.Close()
+	r.conn.Close()
+	return err
+}
+
+func (o *sftpOrigin) Open(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	c, err := o.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var file *sftp.File
+	err = c.timed(func() (err error) {
+		file, err = c.Open(o.path)
+		return
+	})
+	if err != nil {
+		c.Close()
+		return nil, sftpError(err)
+	}
+	if offset > 0 {
+		// seeking only moves offset of the file handle
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			c.Close()
+			return nil, err
+		}
+	}
+	return &sftpReader{File: file, conn: c}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamWriter passes downloaded data to a pipe, so it only accepts
+// sequential writes, i.e. the file must be downloaded in a single block.
+type streamWriter struct {
+	pipe   *io.PipeWriter
+	offset int64
+	digest *digester
+}
+
+func (w *streamWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if off != w.offset {
+		return 0, errors.New("Non-sequential write to stream")
+	}
+	n, err = w.pipe.Write(p)
+	w.offset += int64(n)
+	w.digest.Write(p[:n])
+	return
+}
+
+// download and upload a file at the same time, data never touches local disk
+// and at most one upload part is held in memory
+func streamTransfer(task *FileTask, prog *FileProgress) error {
+	reader, writer := io.Pipe()
+	digest := newDigester()
+	// data must arrive in order, so only one connection is used
+	fileDl, err := newDownloader(task, &streamWriter{pipe: writer, digest: digest}, 1)
+	if err != nil {
+		fmt.Println("Cannot new file downloader!", "with error", err)
+		return err
+	}
+	fileDl.SetContext(task.ctx)
+	// upload runs at the speed of download, so only download is limited
+	fileDl.SetLimiter(task.limiter)
+	target, err := newTarget(task, fileDl.GetContentType())
+	if err != nil {
+		fmt.Println("Cannot new upload target for file: ", task.name, "with error", err)
+		return err
+	}
+
+	// downloading and uploading at the same time
+	task.setState("Downloading")
+	ulErr := make(chan error, 1)
+	go func() {
+		err := target.Stream(reader)
+		// unblock the downloader if upload stopped halfway
+		reader.CloseWithError(err)
+		ulErr <- err
+	}()
+	n, dlErr := fileDownload(fileDl, prog)
+	if dlErr == nil && fileDl.Size > 0 && n != fileDl.Size {
+		dlErr = io.ErrUnexpectedEOF
+	}
+	if dlErr == nil {
+		// verify before the upload is completed, so a corrupted file is
+		// never stored
+		task.checksum = digest.checksum()
+		task.expected = expectedChecksum(fileDl.Checksum, task.userChecksum)
+		dlErr = verifyChecksum(task.expected, task.checksum)
+	}
+	// a nil error makes the uploader see EOF and complete the upload
+	writer.CloseWithError(dlErr)
+	err = <-ulErr
+	if dlErr != nil {
+		fmt.Println("Error downloading file: ", task.name, "with error", dlErr)
+		return dlErr
+	}
+	if err != nil {
+		fmt.Println("Error uploading file: ", task.name, "with error", err)
+		return err
+	}
+	err = target.Verify(task.checksum, n)
+	if err != nil {
+		fmt.Println("Error verifying uploaded file: ", task.name, "with error", err)
+		return err
+	}
+	fmt.Println("File", task.name, "streamed with", n, "bytes")
+
+	prog.setSize(n)
+	prog.setSpeed(0)
+	prog.setPercentage(n, true)
+	prog.send()
+
+	task.targetUrl = target.Url()
+	task.size = n
+	return nil
+}
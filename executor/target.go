@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// Target is a destination which downloaded files are uploaded to.
+// New destinations are added by implementing Target and registering a
+// constructor in targetBuilders, transfer() does not need to be touched.
+type Target interface {
+	// Upload sends the whole content of file to the destination and reports
+	// upload progress through prog. Bytes sent are limited by the limiter
+	// of the task, reads which send nothing are not.
+	Upload(file ReaderAtSeeker, prog *FileProgress) error
+	// Stream uploads data read from r until EOF, size of data is unknown
+	// beforehand and r could not be re-read
+	Stream(r io.Reader) error
+	// Verify checks the uploaded object against checksum and size of the
+	// data sent by last Upload or Stream, errChecksumMismatch is returned if
+	// they don't match
+	Verify(sum *common.Checksum, size int64) error
+	// Url returns the address of the uploaded file
+	Url() string
+}
+
+type targetBuilder func(task *FileTask, contentType string) (Target, error)
+
+var targetBuilders = map[string]targetBuilder{
+	"s3":   newS3Target,
+	"Vaas": newVaasTarget,
+}
+
+func newTarget(task *FileTask, contentType string) (Target, error) {
+	builder, ok := targetBuilders[task.targetType]
+	if !ok {
+		return nil, errors.New("Unknown target type " + task.targetType)
+	}
+	return builder(task, contentType)
+}
+
+// reportUpload sends upload progress of a file every second until finish
+// is signaled, uploaded() should return the number of bytes sent so far.
+func reportUpload(prog *FileProgress, size int64, uploaded func() int64,
+	finish chan bool) (ulSize int64) {
+	prog.setSize(size)
+	prog.setSpeed(0)
+	prog.setPercentage(0, true)
+	prog.send()
+
+	var exit bool
+	var prev int64
+	for !exit {
+		prev = ulSize
+		ulSize = uploaded()
+
+		prog.setSpeed(int(ulSize - prev))
+		prog.setPercentage(ulSize, true)
+		prog.send()
+
+		select {
+		case exit = <-finish:
+		default:
+			time.Sleep(time.Second * 1)
+		}
+	}
+	ulSize = uploaded()
+
+	prog.setSpeed(0)
+	prog.setPercentage(ulSize, true)
+	prog.send()
+	return
+}
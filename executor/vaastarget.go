@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// vaasTarget stores files in Vaas at <cluster><file path>, the same address
+// returned by Url(): PUT uploads a file and HEAD reads back its size and
+// Content-MD5. Requests are signed with Vaas keys of the user in the same way
+// as Optimus API requests:
+//
+//	Authorization: AK:base64(hmac-sha1(SK, Method + "\n" + x-date + "\n" + MD5(Body) + "\n" + path))
+//
+// MD5(Body) is in hex, and empty for streamed uploads whose MD5 is unknown
+// before the body is sent.
+type vaasTarget struct {
+	task        *FileTask
+	contentType string
+}
+
+func newVaasTarget(task *FileTask, contentType string) (Target, error) {
+	if task.targetCluster == "" {
+		return nil, errors.New("Vaas address is not configured")
+	}
+	if task.accessKey == "" || task.secretKey == "" {
+		return nil, errors.New("Vaas keys are not set for user")
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &vaasTarget{task: task, contentType: contentType}, nil
+}
+
+func (t *vaasTarget) Url() string {
+	return strings.TrimRight(t.task.targetCluster, "/") + t.task.name // task.name has a prefix "/"
+}
+
+func (t *vaasTarget) sign(request *http.Request, md5hex string) {
+	date := time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	mac := hmac.New(sha1.New, []byte(t.task.secretKey))
+	mac.Write([]byte(request.Method + "\n" + date + "\n" + md5hex + "\n" + request.URL.Path))
+	request.Header.Set("x-date", date)
+	request.Header.Set("Authorization",
+		t.task.accessKey+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (t *vaasTarget) do(method string, body io.Reader, size int64, md5hex string) (*http.Response, error) {
+	request, err := http.NewRequest(method, t.Url(), body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(t.task.ctx)
+	if body != nil {
+		request.ContentLength = size
+		request.Header.Set("Content-Type", t.contentType)
+		if md5hex != "" {
+			request.Header.Set("Content-MD5", hexToBase64(md5hex))
+		}
+	}
+	t.sign(request, md5hex)
+	return http.DefaultClient.Do(request)
+}
+
+// put uploads body of size bytes, size is -1 if it's unknown
+func (t *vaasTarget) put(body io.Reader, size int64, md5hex string) error {
+	resp, err := t.do("PUT", body, size, md5hex)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Println("Error PUT file to Vaas: ", t.task.name, "with status", resp.StatusCode)
+		return errors.New("Error PUT Request to Vaas")
+	}
+	return nil
+}
+
+func (t *vaasTarget) Upload(file ReaderAtSeeker, prog *FileProgress) error {
+	size, err := file.Seek(0, 2)
+	if err != nil {
+		fmt.Println("File seek error! ", err)
+		return err
+	}
+	file.Seek(0, 0)
+	// the file is digested before uploading in spool mode
+	var md5hex string
+	if t.task.checksum != nil {
+		md5hex = t.task.checksum.MD5
+	}
+
+	counter := &countingReader{reader: &limitedReader{reader: file, limiter: t.task.limiter, ctx: t.task.ctx}}
+	var ulErr error
+	var finish = make(chan bool)
+	go func() {
+		ulErr = t.put(counter, size, md5hex)
+		finish <- true
+	}()
+	ulSize := reportUpload(prog, size, counter.Count, finish)
+
+	fmt.Println("File", t.task.name, "uploaded with", ulSize, "bytes")
+	return ulErr
+}
+
+func (t *vaasTarget) Stream(r io.Reader) error {
+	return t.put(r, -1, "")
+}
+
+// Verify compares size and Content-MD5 of the stored file with the data
+// sent, Content-MD5 is optional in HEAD response of Vaas
+func (t *vaasTarget) Verify(sum *common.Checksum, size int64) error {
+	resp, err := t.do("HEAD", nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Println("Error HEAD file in Vaas: ", t.task.name, "with status", resp.StatusCode)
+		return errors.New("Error HEAD Request to Vaas")
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength != size {
+		fmt.Println("Size of file in Vaas: ", t.task.name, resp.ContentLength, "expected:", size)
+		return errChecksumMismatch
+	}
+	stored := base64ToHex(resp.Header.Get("Content-MD5"))
+	if sum != nil && sum.MD5 != "" && isMD5Hex(stored) && stored != sum.MD5 {
+		fmt.Println("MD5 of file in Vaas: ", t.task.name, stored, "expected:", sum.MD5)
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// countingReader counts bytes read through it, it's safe to call Count()
+// while another goroutine is reading.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+func (r *countingReader) Count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
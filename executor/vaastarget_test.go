@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// vaasServer keeps files PUT to it, and checks signatures of requests
+func vaasServer(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var md5hex string
+		if r.Method == "PUT" {
+			md5hex = base64ToHex(r.Header.Get("Content-MD5"))
+		}
+		mac := hmac.New(sha1.New, []byte("sk"))
+		mac.Write([]byte(r.Method + "\n" + r.Header.Get("x-date") + "\n" + md5hex + "\n" + r.URL.Path))
+		if r.Header.Get("Authorization") != "ak:"+base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			files[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case "HEAD":
+			data, ok := files[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			sum := md5.Sum(data)
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+	}))
+}
+
+func Test_VaasTarget(t *testing.T) {
+	files := make(map[string][]byte)
+	server := vaasServer(files)
+	defer server.Close()
+
+	task := &FileTask{
+		name:          "/dir/file",
+		targetCluster: server.URL + "/",
+		accessKey:     "ak",
+		secretKey:     "sk",
+		ctx:           context.Background(),
+	}
+	target, err := newVaasTarget(task, "")
+	if err != nil {
+		t.Fatal("Error creating target:", err)
+	}
+	if target.Url() != server.URL+"/dir/file" {
+		t.Error("Url of file:", target.Url())
+	}
+	data := []byte("0123456789")
+	if err = target.Stream(bytes.NewReader(data)); err != nil {
+		t.Fatal("Error uploading file:", err)
+	}
+	if !bytes.Equal(files["/dir/file"], data) {
+		t.Error("File stored:", string(files["/dir/file"]))
+	}
+	sum := md5.Sum(data)
+	checksum := &common.Checksum{MD5: hex.EncodeToString(sum[:])}
+	if err = target.Verify(checksum, int64(len(data))); err != nil {
+		t.Error("Error verifying file:", err)
+	}
+	if err = target.Verify(checksum, 5); err != errChecksumMismatch {
+		t.Error("Size mismatch not detected:", err)
+	}
+	checksum.MD5 = strings.Repeat("0", 32)
+	if err = target.Verify(checksum, int64(len(data))); err != errChecksumMismatch {
+		t.Error("MD5 mismatch not detected:", err)
+	}
+}
@@ -15,10 +15,24 @@ CREATE TABLE user (
   vass_sk VARCHAR(50) DEFAULT NULL,
   description VARCHAR(50) DEFAULT NULL,
   priority INT DEFAULT 9,
+  weight INT DEFAULT 1,
+  max_speed BIGINT DEFAULT 0,
+  max_running_tasks INT DEFAULT 0,
+  max_queued_urls INT DEFAULT 0,
+  daily_bytes BIGINT DEFAULT 0,
+  monthly_bytes BIGINT DEFAULT 0,
   PRIMARY KEY (id),
   INDEX (access_key)
 );
 
+DROP TABLE IF EXISTS user_usage;
+CREATE TABLE user_usage (
+  access_key VARCHAR(50) NOT NULL,
+  day DATE NOT NULL,
+  bytes BIGINT DEFAULT 0,
+  PRIMARY KEY (access_key, day)
+);
+
 DROP TABLE IF EXISTS job;
 CREATE TABLE job (
   id BIGINT NOT NULL AUTO_INCREMENT,
@@ -29,9 +43,99 @@ CREATE TABLE job (
   callback_token VARCHAR(100),
   callback_url TEXT,
   status VARCHAR(20) NOT NULL,
+  finished_size BIGINT DEFAULT 0,
+  max_speed BIGINT DEFAULT 0,
+  parent_uuid CHAR(60),
+  cancel_on_parent_failure BOOL DEFAULT FALSE,
+  manifest MEDIUMTEXT,
+  expanding BOOL DEFAULT FALSE,
+  manifest_files BIGINT DEFAULT 0,
+  manifest_position VARCHAR(1024) DEFAULT '',
+  manifest_error TEXT,
+  credentials TEXT,
   PRIMARY KEY (id),
   INDEX (uuid),
-  INDEX (access_key, status)
+  INDEX (access_key, status),
+  INDEX (expanding)
+);
+
+DROP TABLE IF EXISTS job_dependency;
+CREATE TABLE job_dependency (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  job_uuid CHAR(60) NOT NULL,
+  parent_uuid CHAR(60) NOT NULL,
+  PRIMARY KEY (id),
+  INDEX (job_uuid),
+  INDEX (parent_uuid)
+);
+
+DROP TABLE IF EXISTS manifest;
+CREATE TABLE manifest (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  uuid CHAR(60) NOT NULL UNIQUE,
+  access_key VARCHAR(50) NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  create_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (access_key)
+);
+
+DROP TABLE IF EXISTS manifest_part;
+CREATE TABLE manifest_part (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  manifest_uuid CHAR(60) NOT NULL,
+  part INT NOT NULL,
+  data MEDIUMBLOB NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE (manifest_uuid, part)
+);
+
+DROP TABLE IF EXISTS recurring;
+CREATE TABLE recurring (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  uuid CHAR(60) NOT NULL UNIQUE,
+  access_key VARCHAR(50) NOT NULL,
+  request MEDIUMTEXT NOT NULL,
+  credentials TEXT,
+  callback_url TEXT,
+  callback_token VARCHAR(100),
+  cron VARCHAR(100) NOT NULL DEFAULT '',
+  timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+  next_time DATETIME,
+  runs INT DEFAULT 0,
+  last_job_uuid CHAR(60),
+  status VARCHAR(20) NOT NULL,
+  create_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (access_key),
+  INDEX (status, next_time)
+);
+
+DROP TABLE IF EXISTS callback;
+CREATE TABLE callback (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  job_uuid CHAR(60) NOT NULL,
+  url TEXT NOT NULL,
+  body MEDIUMTEXT,
+  status VARCHAR(20) NOT NULL,
+  attempts INT DEFAULT 0,
+  create_time DATETIME,
+  next_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (job_uuid),
+  INDEX (status, next_time)
+);
+
+DROP TABLE IF EXISTS callback_attempt;
+CREATE TABLE callback_attempt (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  callback_id BIGINT NOT NULL,
+  attempt_time DATETIME,
+  status_code INT,
+  error TEXT,
+  duration INT,
+  PRIMARY KEY (id),
+  INDEX (callback_id)
 );
 
 DROP TABLE IF EXISTS slave;
@@ -65,6 +169,9 @@ CREATE TABLE task (
   target_type VARCHAR(20) NOT NULL,
   target_bucket VARCHAR(100),
   target_acl VARCHAR(20),
+  source_type VARCHAR(10),
+  transfer_mode VARCHAR(10) NOT NULL DEFAULT 'spool',
+  threads INT DEFAULT 0,
   status VARCHAR(20) NOT NULL,
   access_key VARCHAR(50),
   secret_key VARCHAR(50),
@@ -80,8 +187,20 @@ CREATE TABLE url (
   id BIGINT NOT NULL AUTO_INCREMENT,
   task_id BIGINT NOT NULL,
   origin_url TEXT NOT NULL,
+  target_key TEXT,
   target_url TEXT,
   status VARCHAR(20) NOT NULL,
+  attempts INT DEFAULT 1,
+  size BIGINT DEFAULT 0,
+  upload_id VARCHAR(255),
+  upload_parts MEDIUMTEXT,
+  expected_md5 CHAR(32),
+  expected_sha256 CHAR(64),
+  md5 CHAR(32),
+  sha256 CHAR(64),
+  error_class VARCHAR(20),
+  http_status INT,
+  error_message TEXT,
   PRIMARY KEY (id),
   INDEX (task_id)
 );
@@ -92,10 +211,23 @@ CREATE TABLE schedule (
   access_key VARCHAR(50),
   start INT DEFAULT 0,
   end INT DEFAULT 0,
+  timezone VARCHAR(64) NOT NULL DEFAULT '',
+  action VARCHAR(10) NOT NULL DEFAULT '',
+  days VARCHAR(20) DEFAULT '',
+  start_minute INT DEFAULT 0,
+  end_minute INT DEFAULT 0,
   PRIMARY KEY (id),
   INDEX (access_key)
 );
 
+DROP TABLE IF EXISTS framework;
+CREATE TABLE framework (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(50) NOT NULL UNIQUE,
+  framework_id VARCHAR(100),
+  PRIMARY KEY (id)
+);
+
 DROP TABLE IF EXISTS cluster;
 CREATE TABLE cluster (
   id BIGINT NOT NULL AUTO_INCREMENT,
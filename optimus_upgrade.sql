@@ -0,0 +1,143 @@
+-- Upgrades tables created by the original optimus.sql, before any of the
+-- columns and tables below existed, to the current optimus.sql in place.
+-- Databases created by the current optimus.sql need no upgrade.
+
+ALTER TABLE user
+  ADD COLUMN weight INT DEFAULT 1,
+  ADD COLUMN max_speed BIGINT DEFAULT 0,
+  ADD COLUMN max_running_tasks INT DEFAULT 0,
+  ADD COLUMN max_queued_urls INT DEFAULT 0,
+  ADD COLUMN daily_bytes BIGINT DEFAULT 0,
+  ADD COLUMN monthly_bytes BIGINT DEFAULT 0;
+
+CREATE TABLE user_usage (
+  access_key VARCHAR(50) NOT NULL,
+  day DATE NOT NULL,
+  bytes BIGINT DEFAULT 0,
+  PRIMARY KEY (access_key, day)
+);
+
+ALTER TABLE job
+  ADD COLUMN finished_size BIGINT DEFAULT 0,
+  ADD COLUMN max_speed BIGINT DEFAULT 0,
+  ADD COLUMN parent_uuid CHAR(60),
+  ADD COLUMN cancel_on_parent_failure BOOL DEFAULT FALSE,
+  ADD COLUMN credentials TEXT;
+
+-- Manifest-driven jobs keep their manifest and how far it's expanded.
+ALTER TABLE job
+  ADD COLUMN manifest MEDIUMTEXT,
+  ADD COLUMN expanding BOOL DEFAULT FALSE,
+  ADD COLUMN manifest_files BIGINT DEFAULT 0,
+  ADD COLUMN manifest_position VARCHAR(1024) DEFAULT '',
+  ADD COLUMN manifest_error TEXT,
+  ADD INDEX (expanding);
+
+CREATE TABLE job_dependency (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  job_uuid CHAR(60) NOT NULL,
+  parent_uuid CHAR(60) NOT NULL,
+  PRIMARY KEY (id),
+  INDEX (job_uuid),
+  INDEX (parent_uuid)
+);
+
+CREATE TABLE manifest (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  uuid CHAR(60) NOT NULL UNIQUE,
+  access_key VARCHAR(50) NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  create_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (access_key)
+);
+
+CREATE TABLE manifest_part (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  manifest_uuid CHAR(60) NOT NULL,
+  part INT NOT NULL,
+  data MEDIUMBLOB NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE (manifest_uuid, part)
+);
+
+CREATE TABLE recurring (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  uuid CHAR(60) NOT NULL UNIQUE,
+  access_key VARCHAR(50) NOT NULL,
+  request MEDIUMTEXT NOT NULL,
+  credentials TEXT,
+  callback_url TEXT,
+  callback_token VARCHAR(100),
+  cron VARCHAR(100) NOT NULL DEFAULT '',
+  timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+  next_time DATETIME,
+  runs INT DEFAULT 0,
+  last_job_uuid CHAR(60),
+  status VARCHAR(20) NOT NULL,
+  create_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (access_key),
+  INDEX (status, next_time)
+);
+
+CREATE TABLE callback (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  job_uuid CHAR(60) NOT NULL,
+  url TEXT NOT NULL,
+  body MEDIUMTEXT,
+  status VARCHAR(20) NOT NULL,
+  attempts INT DEFAULT 0,
+  create_time DATETIME,
+  next_time DATETIME,
+  PRIMARY KEY (id),
+  INDEX (job_uuid),
+  INDEX (status, next_time)
+);
+
+CREATE TABLE callback_attempt (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  callback_id BIGINT NOT NULL,
+  attempt_time DATETIME,
+  status_code INT,
+  error TEXT,
+  duration INT,
+  PRIMARY KEY (id),
+  INDEX (callback_id)
+);
+
+ALTER TABLE task
+  ADD COLUMN source_type VARCHAR(10) AFTER target_acl,
+  ADD COLUMN transfer_mode VARCHAR(10) NOT NULL DEFAULT 'spool' AFTER source_type,
+  ADD COLUMN threads INT DEFAULT 0 AFTER transfer_mode;
+
+ALTER TABLE url
+  ADD COLUMN target_key TEXT AFTER origin_url,
+  ADD COLUMN attempts INT DEFAULT 1,
+  ADD COLUMN size BIGINT DEFAULT 0,
+  ADD COLUMN upload_id VARCHAR(255),
+  ADD COLUMN upload_parts MEDIUMTEXT,
+  ADD COLUMN expected_md5 CHAR(32),
+  ADD COLUMN expected_sha256 CHAR(64),
+  ADD COLUMN md5 CHAR(32),
+  ADD COLUMN sha256 CHAR(64),
+  ADD COLUMN error_class VARCHAR(20),
+  ADD COLUMN http_status INT,
+  ADD COLUMN error_message TEXT;
+
+-- Rows of the old /schedule API keep start and end in hours with an empty
+-- action, and are read as deny windows in local time of the scheduler host,
+-- until the user sets the schedule again.
+ALTER TABLE schedule
+  ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT '',
+  ADD COLUMN action VARCHAR(10) NOT NULL DEFAULT '',
+  ADD COLUMN days VARCHAR(20) DEFAULT '',
+  ADD COLUMN start_minute INT DEFAULT 0,
+  ADD COLUMN end_minute INT DEFAULT 0;
+
+CREATE TABLE framework (
+  id BIGINT NOT NULL AUTO_INCREMENT,
+  name VARCHAR(50) NOT NULL UNIQUE,
+  framework_id VARCHAR(100),
+  PRIMARY KEY (id)
+);
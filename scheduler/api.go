@@ -14,7 +14,6 @@ import (
 	"strings"
 	"time"
 	"strconv"
-	"github.com/garyburd/redigo/redis"
 	"legitlab.letv.cn/optimus/optimus/common"
 )
 
@@ -73,17 +72,80 @@ type TransferRequest struct {
 	TargetType    string   `json:"target-type"` // in s3s/Vaas
 	TargetBucket  string   `json:"target-bucket"`
 	TargetAcl     string   `json:"target-acl"`
+	TransferMode  string   `json:"transfer-mode"` // in spool/stream, default is spool
+	Threads       int      `json:"threads"`       // parallel connections per file
+	MaxSpeed      int64    `json:"max-speed"`     // bytes per second of each task, 0 for unlimited
+	// checksums of origin files given by user, keyed by url
+	Checksums     map[string]*common.Checksum `json:"checksums"`
+	// run the job not before the unix time, or by the cron expression in
+	// Timezone(UTC by default), see recurring.go
+	NotBefore     int64    `json:"not-before,omitempty"`
+	Cron          string   `json:"cron,omitempty"`
+	Timezone      string   `json:"timezone,omitempty"`
+	// the job is Blocked until all these jobs are Finished, and cancelled
+	// if one of them fails when CancelOnParentFailure
+	DependsOn             []string `json:"depends-on,omitempty"`
+	CancelOnParentFailure bool     `json:"cancel-on-parent-failure,omitempty"`
+	// files are listed in the manifest instead of origin-files, see manifest.go
+	Manifest      *Manifest `json:"manifest,omitempty"`
+	// objects under s3://bucket/prefix are copied, s3:// origins are read
+	// from cluster SourceType, which is TargetType by default if it's S3
+	Source        string `json:"source,omitempty"`
+	SourceType    string `json:"source-type,omitempty"`
+	// credentials of ftp:// and sftp:// origins keyed by scheme://host[:port],
+	// they're only kept sealed in sealedCredentials, see credential.go
+	Credentials   map[string]*common.Credential `json:"credentials,omitempty"`
+	sealedCredentials string
+	manifestTask  *common.TransferTask // template of tasks expanded from manifest
 	uuid          string
 	callbackToken string
 	callbackUrl   string
+	parentUuid    string // recurring definition the job is run of
+	inserted      chan error // told when the job is saved, if not nil
+	reservedUrls  int        // queued urls reserved by reserveSubmitQuota
 }
 
 type TransferResponse struct {
 	JobId string `json:"jobid"`
 }
 
+// putRecurringJob saves the job as a recurring definition to run later
+func putRecurringJob(w http.ResponseWriter, req *TransferRequest, now time.Time) {
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	next, err := nextRunTime(req, now)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Bad cron or timezone: "+err.Error())
+		return
+	}
+	if next.IsZero() {
+		response(w, http.StatusBadRequest, "Cron expression never matches")
+		return
+	}
+	req.uuid = newUuid()
+	err = insertRecurringJob(req, next)
+	if err == errManifestNotFound || err == errManifestIncomplete {
+		response(w, http.StatusConflict, "Manifest "+req.Manifest.Id+" is changed: "+err.Error())
+		return
+	}
+	if err != nil {
+		logger.Println("Error inserting recurring job with error", err)
+		response(w, http.StatusInternalServerError, "Cannot save recurring job")
+		return
+	}
+	respJson, err := json.Marshal(RecurringResponse{Id: req.uuid, NextTime: next.Unix()})
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusAccepted, string(respJson))
+}
+
 type UrlReq struct {
 	Url   string `json:"url"`
+	JobId string `json:"jobid"` // optional, the latest progress of url in any job if empty
 }
 
 func putTransferJobHandler(w http.ResponseWriter, r *http.Request) {
@@ -109,7 +171,7 @@ func putTransferJobHandler(w http.ResponseWriter, r *http.Request) {
 		response(w, http.StatusBadRequest, "Bad JSON body")
 		return
 	}
-	if len(req.OriginUrls) == 0 || req.TargetType == "" {
+	if (len(req.OriginUrls) == 0 && req.Manifest == nil && req.Source == "") || req.TargetType == "" {
 		response(w, http.StatusBadRequest, "Missing required field")
 		return
 	}
@@ -119,16 +181,148 @@ func putTransferJobHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	switch req.TransferMode {
+	case "":
+		req.TransferMode = common.TransferModeSpool
+	case common.TransferModeSpool, common.TransferModeStream:
+	default:
+		response(w, http.StatusBadRequest, "Unknown transfer mode "+req.TransferMode)
+		return
+	}
+	if req.Threads < 0 {
+		response(w, http.StatusBadRequest, "Bad threads number")
+		return
+	}
+	if req.MaxSpeed < 0 {
+		response(w, http.StatusBadRequest, "Bad max speed")
+		return
+	}
+	for url, sum := range req.Checksums {
+		// either digest is enough
+		if sum == nil || (sum.MD5 == "" && sum.SHA256 == "") ||
+			!isHex(sum.MD5, 32) || !isHex(sum.SHA256, 64) {
+			response(w, http.StatusBadRequest, "Bad checksum for "+url)
+			return
+		}
+		sum.MD5 = strings.ToLower(sum.MD5)
+		sum.SHA256 = strings.ToLower(sum.SHA256)
+	}
+	err = sealRequestCredentials(&req)
+	if err != nil {
+		response(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	length := len(req.OriginUrls)
 	if (length > 10000) {
 		response(w, http.StatusBadRequest, "Too many urls! The maximum number of urls are 10000")
 		return
 	}
-
+	if req.SourceType == "" {
+		if _, ok := cluster[req.TargetType]; ok {
+			req.SourceType = req.TargetType
+		}
+	} else if _, ok := cluster[req.SourceType]; !ok {
+		response(w, http.StatusBadRequest, "Unknown source type "+req.SourceType)
+		return
+	}
+	if req.Source != "" {
+		if req.Manifest != nil {
+			response(w, http.StatusBadRequest, "Source can't be given with manifest")
+			return
+		}
+		// objects are listed like entries of a manifest
+		req.Manifest = &Manifest{Url: req.Source, Format: ManifestFormatListing}
+	}
+	if req.Manifest != nil {
+		if length > 0 || len(req.Checksums) > 0 {
+			response(w, http.StatusBadRequest, "Origin files or checksums can't be given with manifest")
+			return
+		}
+		err = req.Manifest.validate(req.SourceType)
+		if err != nil {
+			response(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Manifest.Id != "" {
+			// marked Used when the job is saved
+			req.Manifest.Parts, err = checkManifestUpload(accessKey, req.Manifest.Id)
+			switch err {
+			case nil:
+			case errManifestNotFound:
+				response(w, http.StatusNotFound, "Manifest "+req.Manifest.Id+" not found")
+				return
+			case errManifestIncomplete:
+				response(w, http.StatusBadRequest, err.Error())
+				return
+			default:
+				logger.Println("Error using manifest", req.Manifest.Id, "with error", err)
+				response(w, http.StatusInternalServerError, "Cannot use manifest")
+				return
+			}
+		}
+	}
+	if len(req.DependsOn) > 0 {
+		if req.Cron != "" {
+			response(w, http.StatusBadRequest, "Recurring jobs can't depend on other jobs")
+			return
+		}
+		if len(req.DependsOn) > 100 {
+			response(w, http.StatusBadRequest, "Too many parent jobs! The maximum number of parents are 100")
+			return
+		}
+		for _, parent := range req.DependsOn {
+			if !userOwnsJob(accessKey, parent) {
+				response(w, http.StatusForbidden, "Your key has no access to job "+parent)
+				return
+			}
+			if !req.CancelOnParentFailure {
+				continue
+			}
+			status, err := getJobStatus(parent)
+			if err != nil {
+				logger.Println("Error querying status of job", parent, "with error", err)
+				response(w, http.StatusInternalServerError, "Cannot query parent job")
+				return
+			}
+			if status == "Failed" || status == "Cancelled" {
+				response(w, http.StatusConflict, "Parent job "+parent+" is "+status)
+				return
+			}
+		}
+	}
 	query := r.URL.Query()
 	req.callbackUrl = query.Get("callback")
 	req.callbackToken = query.Get("token")
 
+	now := time.Now()
+	if req.Cron != "" || req.NotBefore > now.Unix() {
+		exceeded, err := checkSubmitQuota(accessKey, length)
+		if err != nil {
+			logger.Println("Error checking quota of user", accessKey, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot check quota")
+			return
+		}
+		if exceeded != "" {
+			response(w, http.StatusTooManyRequests, exceeded)
+			return
+		}
+		putRecurringJob(w, &req, now)
+		return
+	}
+	exceeded, err := reserveSubmitQuota(accessKey, length)
+	if err != nil {
+		logger.Println("Error checking quota of user", accessKey, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot check quota")
+		return
+	}
+	if exceeded != "" {
+		response(w, http.StatusTooManyRequests, exceeded)
+		return
+	}
+	req.reservedUrls = length
+	req.NotBefore = 0
+	req.Timezone = ""
+
 	req.uuid = newUuid()
 
 	resp := TransferResponse{
@@ -136,6 +330,7 @@ func putTransferJobHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	respJson, err := json.Marshal(resp)
 	if err != nil {
+		releaseSubmitQuota(accessKey, length)
 		response(w, http.StatusInternalServerError, "Server error")
 		return
 	}
@@ -144,15 +339,33 @@ func putTransferJobHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		response(w, http.StatusAccepted, string(respJson))
 	default:
+		releaseSubmitQuota(accessKey, length)
 		response(w, http.StatusInternalServerError, "Server too busy")
 	}
 }
 
 type JobResult struct {
 	JobUuid       string   `json:"jobid"`
+	Status        string   `json:"status"`
 	SuccessUrls   []string `json:"success-files"`
 	FailedUrls    []string `json:"failed-files"`
 	PendingUrls   []string `json:"queued-files"`
+	CancelledUrls []string `json:"cancelled-files"`
+	Files         []FileResult `json:"files"`
+	Manifest      *ManifestProgress `json:"manifest,omitempty"`
+}
+
+type FileResult struct {
+	Url           string   `json:"url"`
+	Status        string   `json:"status"`
+	Attempts      int64    `json:"attempts"`
+	Size          int64    `json:"size"`
+	MD5           string   `json:"md5,omitempty"`
+	SHA256        string   `json:"sha256,omitempty"`
+	// why the file failed, see common.Error* for classes
+	ErrorClass    string   `json:"error-class,omitempty"`
+	HttpStatus    int64    `json:"http-status,omitempty"`
+	Message       string   `json:"message,omitempty"`
 }
 
 type JobUrlResult struct {
@@ -168,6 +381,7 @@ type JobList struct {
 	CreateTime    int64     `json:"create-time"`
 	CompleteTime  int64     `json:"complete-time"`
 	Status        string    `json:"satus"`
+	Parent        string    `json:"parent,omitempty"` // recurring definition the job is run of
 }
 
 type FinishedSize struct {
@@ -179,25 +393,189 @@ type CurrentSpeed struct {
 	DownloadSpeed int64     `json:"download-speed"`
 }
 
-func putJobCallback(url string, summary *JobResult) {
-	jsonSummary, err := json.Marshal(summary)
+// interval of comment lines sent to keep idle event streams open
+const eventKeepAlive = 15 * time.Second
+
+func writeEvent(w http.ResponseWriter, event *Event) error {
+	data, err := json.Marshal(event)
 	if err != nil {
-		logger.Println("Error marshalling json: ", err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// eventsHandler streams events of a job as Server-Sent Events. Current
+// states of all files are sent first, the stream ends after the job event
+// telling the job is completed.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.ToUpper(r.Method) != "GET" {
+		w.Header().Set("Allow", "GET")
+		response(w, http.StatusMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
-	request, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonSummary))
+	requestBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logger.Println("Error creating request: ", err)
+		response(w, http.StatusBadRequest, "Failed to read request body")
 		return
 	}
-	request.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	response, err := client.Do(request)
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	jobUuid := r.URL.Query().Get("jobid")
+	if jobUuid == "" {
+		response(w, http.StatusBadRequest, "Missing parameter jobid")
+		return
+	}
+	if !userOwnsJob(accessKey, jobUuid) {
+		response(w, http.StatusForbidden, "Your key has no access to job "+jobUuid)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	// subscribe before reading current states, so no change is missed
+	ch := events.subscribe(jobUuid)
+	defer events.unsubscribe(jobUuid, ch)
+	summary, err := getJobSummary(jobUuid)
 	if err != nil {
-		logger.Println("Error sending PUT request: ", err)
+		response(w, http.StatusInternalServerError, "Cannot query job status")
 		return
 	}
-	logger.Println("Callback has been sent to ", url, "with response code ", response.Status)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	now := time.Now().Unix()
+	for _, file := range summary.Files {
+		status := file.Status
+		if status == "Pending" {
+			status = "Queued"
+		}
+		writeEvent(w, &Event{Type: "file", JobUuid: jobUuid, Url: file.Url, Status: status,
+			Size: file.Size, ErrorClass: file.ErrorClass, Message: file.Message, Time: now})
+	}
+	writeEvent(w, &Event{Type: "job", JobUuid: jobUuid, Status: summary.Status, Time: now})
+	flusher.Flush()
+	if isJobCompleted(summary.Status) {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			if writeEvent(w, event) != nil {
+				return
+			}
+			flusher.Flush()
+			if event.Type == "job" && isJobCompleted(event.Status) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func isJobCompleted(status string) bool {
+	return status == "Finished" || status == "Failed" || status == "Cancelled"
+}
+
+type CallbackResult struct {
+	Id         int64             `json:"id"`
+	Url        string            `json:"url"`
+	Status     string            `json:"status"` // in Pending/Delivered/Failed
+	Attempts   int               `json:"attempts"`
+	CreateTime int64             `json:"create-time"`
+	NextTime   int64             `json:"next-time,omitempty"`
+	History    []CallbackAttempt `json:"history"`
+}
+
+type CallbackAttempt struct {
+	Time       int64  `json:"time"`
+	StatusCode int    `json:"status-code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Duration   int64  `json:"duration"` // in milliseconds
+}
+
+type RetriggerResponse struct {
+	Retriggered int64 `json:"retriggered"`
+}
+
+// GET lists callbacks of a job with their delivery attempts, POST delivers
+// them again
+func callbacksHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "GET" && method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		response(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	jobUuid := r.URL.Query().Get("jobid")
+	if jobUuid == "" {
+		response(w, http.StatusBadRequest, "Missing parameter jobid")
+		return
+	}
+	if !userOwnsJob(accessKey, jobUuid) {
+		response(w, http.StatusForbidden, "Your key has no access to job "+jobUuid)
+		return
+	}
+
+	var result interface{}
+	if method == "GET" {
+		callbacks, err := getCallbacks(jobUuid)
+		if err != nil {
+			logger.Println("Error querying callbacks for job", jobUuid, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot query callbacks")
+			return
+		}
+		result = callbacks
+	} else {
+		var callbackId int64
+		if id := r.URL.Query().Get("id"); id != "" {
+			callbackId, err = strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				response(w, http.StatusBadRequest, "Invalid parameter id")
+				return
+			}
+		}
+		retriggered, err := retriggerCallbacks(jobUuid, callbackId)
+		if err != nil {
+			logger.Println("Error retriggering callbacks for job", jobUuid, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot retrigger callbacks")
+			return
+		}
+		wakeCallbackDeliverer()
+		result = RetriggerResponse{Retriggered: retriggered}
+	}
+	respJson, err := json.Marshal(result)
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
 }
 
 func getJobStatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -273,7 +651,52 @@ func postSuspendJobHandler(w http.ResponseWriter, r *http.Request) {
 	response(w, http.StatusOK, string(""))
 }
 
-func postResumeJobHandler(w http.ResponseWriter, r *http.Request) {
+// handles both POST /canceljob and DELETE /transferjob
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "POST" && method != "DELETE" {
+		w.Header().Set("Allow", "POST, DELETE")
+		response(w, http.StatusMethodNotAllowed, "Only POST and DELETE methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	jobUuid := r.URL.Query().Get("jobid")
+	if jobUuid == "" {
+		response(w, http.StatusBadRequest, "Missing parameter jobid")
+		return
+	}
+	if !userOwnsJob(accessKey, jobUuid) {
+		response(w, http.StatusForbidden, "Your key has no access to job "+jobUuid)
+		return
+	}
+
+	err = sched.cancelJob(jobUuid)
+	if err == errJobCompleted {
+		response(w, http.StatusConflict, "Job is already completed")
+		return
+	}
+	if err != nil {
+		logger.Println("Error cancelling job", jobUuid, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot cancel job")
+		return
+	}
+	response(w, http.StatusOK, string(""))
+}
+
+type RetryResponse struct {
+	Retried int `json:"retried"`
+}
+
+func postRetryJobHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.ToUpper(r.Method) != "POST" {
 		w.Header().Set("Allow", "POST")
 		response(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
@@ -299,23 +722,65 @@ func postResumeJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = resumeJob(jobUuid)
+	// retried files are queued again
+	failed, err := countFailedUrls(jobUuid)
 	if err != nil {
-		response(w, http.StatusInternalServerError, "Cannot resume job")
+		logger.Println("Error counting failed files of job", jobUuid, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot retry job")
+		return
+	}
+	exceeded, err := reserveSubmitQuota(accessKey, failed)
+	if err != nil {
+		logger.Println("Error checking quota of user", accessKey, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot check quota")
+		return
+	}
+	if exceeded != "" {
+		response(w, http.StatusTooManyRequests, exceeded)
+		return
+	}
+	retried, err := retryJob(jobUuid)
+	// urls are counted in database from now on
+	releaseSubmitQuota(accessKey, failed)
+	if err == errJobNotFailed {
+		response(w, http.StatusConflict, "Only failed jobs could be retried")
 		return
 	}
+	if err != nil {
+		logger.Println("Error retrying job", jobUuid, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot retry job")
+		return
+	}
+	publishJobEvent(jobUuid, "Pending")
+	if progress, err := getManifestProgress(jobUuid); err == nil && progress != nil && progress.Expanding {
+		go expandManifest(jobUuid)
+	}
 	err = chkAndAddSchedUser(accessKey)
 	if err != nil {
 		response(w, http.StatusInternalServerError, "Failed to Check User and resched user")
 		return
 	}
-	response(w, http.StatusOK, string(""))
+	respJson, err := json.Marshal(RetryResponse{Retried: retried})
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
 }
 
-func putUserSchedule(w http.ResponseWriter, r *http.Request) {
-	if strings.ToUpper(r.Method) != "PUT" {
-		w.Header().Set("Allow", "PUT")
-		response(w, http.StatusMethodNotAllowed, "Only PUT method is allowed")
+func transferJobHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.ToUpper(r.Method) == "DELETE" {
+		cancelJobHandler(w, r)
+		return
+	}
+	putTransferJobHandler(w, r)
+}
+
+func postResumeJobHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.ToUpper(r.Method) != "POST" {
+		w.Header().Set("Allow", "POST")
+		response(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
 		return
 	}
 	requestBody, err := ioutil.ReadAll(r.Body)
@@ -328,48 +793,99 @@ func putUserSchedule(w http.ResponseWriter, r *http.Request) {
 		response(w, http.StatusUnauthorized, "Failed to authenticate request")
 		return
 	}
-	var spans []Span
-	err = json.NewDecoder(bytes.NewReader(requestBody)).Decode(&spans)
+	jobUuid := r.URL.Query().Get("jobid")
+	if jobUuid == "" {
+		response(w, http.StatusBadRequest, "Missing parameter jobid")
+		return
+	}
+	if !userOwnsJob(accessKey, jobUuid) {
+		response(w, http.StatusForbidden, "Your key has no access to job "+jobUuid)
+		return
+	}
+
+	err = resumeJob(jobUuid)
 	if err != nil {
-		response(w, http.StatusBadRequest, "Bad JSON body")
+		response(w, http.StatusInternalServerError, "Cannot resume job")
+		return
+	}
+	err = chkAndAddSchedUser(accessKey)
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Failed to Check User and resched user")
 		return
 	}
-	length := len(spans)
-	if length > 5 {
-		response(w, http.StatusBadRequest, "Maximum number of entries are 5")
+	response(w, http.StatusOK, string(""))
+}
+
+// userScheduleHandler reads or sets the schedule of the user. Besides a
+// Schedule, PUT also takes a list of Span, see scheduleFromSpans.
+func userScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "GET" && method != "PUT" {
+		w.Header().Set("Allow", "GET, PUT")
+		response(w, http.StatusMethodNotAllowed, "Only GET and PUT methods are allowed")
 		return
 	}
-	if length == 0 {
-		response(w, http.StatusBadRequest, "There is no time span entries")
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
 		return
 	}
-	if spans[0].Start == 0 && spans[0].End == 0 {
-		var tmp []Span
-		err = updateScheduleEntry(accessKey, tmp)
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+
+	if method == "GET" {
+		schedule, err := getUserSchedule(accessKey)
 		if err != nil {
-			response(w, http.StatusBadRequest, "Cannot set schedule table")
+			response(w, http.StatusInternalServerError, "Cannot query schedule")
 			return
 		}
-
-		response(w, http.StatusOK, "")
+		if schedule.Windows == nil {
+			schedule.Windows = []*Window{}
+		}
+		respJson, err := json.Marshal(schedule)
+		if err != nil {
+			response(w, http.StatusInternalServerError, "Server error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		response(w, http.StatusOK, string(respJson))
 		return
 	}
 
-	for i := 0; i < length; i++ {
-		if spans[i].Start >= spans[i].End {
-			response(w, http.StatusBadRequest, "The start time is greater than end time")
+	var schedule *Schedule
+	if body := bytes.TrimSpace(requestBody); len(body) > 0 && body[0] == '[' {
+		var spans []Span
+		err = json.Unmarshal(body, &spans)
+		if err != nil {
+			response(w, http.StatusBadRequest, "Bad JSON body")
 			return
 		}
-	}
-	for i := 0; i < length; i++ {
-		for j := i + 1; j < length; j++ {
-			if spans[i].Start <= spans[j].End && spans[i].End >= spans[j].Start {
-				response(w, http.StatusBadRequest, "There are overlaps in the entries")
-				return
-			}
+		if len(spans) > 5 {
+			response(w, http.StatusBadRequest, "Maximum number of entries are 5")
+			return
 		}
+		if len(spans) == 0 {
+			response(w, http.StatusBadRequest, "There is no time span entries")
+			return
+		}
+		schedule, err = scheduleFromSpans(spans)
+	} else {
+		schedule = &Schedule{}
+		err = json.Unmarshal(body, schedule)
+		if err != nil {
+			response(w, http.StatusBadRequest, "Bad JSON body")
+			return
+		}
+		err = schedule.validate()
+	}
+	if err != nil {
+		response(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	err = updateScheduleEntry(accessKey, spans)
+	err = updateScheduleEntry(accessKey, schedule)
 	if err != nil {
 		response(w, http.StatusBadRequest, "Cannot set schedule table")
 		return
@@ -389,7 +905,7 @@ func getUrlsInfo(w http.ResponseWriter, r *http.Request) {
 		response(w, http.StatusBadRequest, "Failed to read request body")
 		return
 	}
-	_, verified := verifyRequest(r, requestBody)
+	accessKey, verified := verifyRequest(r, requestBody)
 	if !verified {
 		response(w, http.StatusUnauthorized, "Failed to authenticate request")
 		return
@@ -401,29 +917,9 @@ func getUrlsInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if CONFIG.RedisAddress == nil || CONFIG.RedisMasterName == "" {
-		response(w, http.StatusBadRequest, "There is no Redis to Connect!")
-		return
-	}
-	pool := newSentinelPool(CONFIG.RedisAddress, CONFIG.RedisMasterName)
-	defer pool.Close()
-
-	conn := pool.Get()
-	defer conn.Close()
-	var result []common.UrlInfo
-	for _, url := range urls {
-		var urlInfo common.UrlInfo
-		value, err := redis.Bytes(conn.Do("GET", url.Url))
-		if err != nil {
-			logger.Println("Error getting value from redis! key", url)
-		} else {
-			err = json.Unmarshal(value, &urlInfo)
-			if err != nil {
-				logger.Println("Error Unmarshal json value! key", url)
-			}
-			urlInfo.Url = url.Url
-		}
-		result = append(result, urlInfo)
+	result := progress().Lookup(accessKey, urls)
+	for i := range result {
+		result[i].Url = urls[i].Url
 	}
 
 	jsonResult, err := json.Marshal(result)
@@ -529,15 +1025,6 @@ func getCurrSpeed(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if CONFIG.RedisAddress == nil || CONFIG.RedisMasterName == "" {
-		response(w, http.StatusBadRequest, "There is no Redis to Connect!")
-		return
-	}
-	pool := newSentinelPool(CONFIG.RedisAddress, CONFIG.RedisMasterName)
-	defer pool.Close()
-	conn := pool.Get()
-	defer conn.Close()
-
 	var jobUuids []string
 	err = queryScheduledJobUuids(accessKey, &jobUuids)
 	if err != nil {
@@ -547,24 +1034,7 @@ func getCurrSpeed(w http.ResponseWriter, r *http.Request) {
 
 	var uSpeed, dSpeed, finishedSize int64
 	for _, uuid := range jobUuids {
-		var urls []string
-		err = queryRunningUrls(uuid, &urls)
-		if err != nil {
-			response(w, http.StatusInternalServerError, "Cannot get running urls")
-			return
-		}
-
-		for _, url := range urls {
-			var urlInfo common.UrlInfo
-			value, err := redis.Bytes(conn.Do("GET", url))
-			if err != nil {
-				logger.Println("Error getting value from redis! key", url)
-			} else {
-				err = json.Unmarshal(value, &urlInfo)
-				if err != nil {
-					logger.Println("Error Unmarshal json value! key", url)
-				}
-			}
+		for _, urlInfo := range progress().JobProgress(uuid) {
 			if urlInfo.Percentage == 100 {
 				finishedSize += int64(urlInfo.Size)
 			} else if urlInfo.Percentage > 50 {
@@ -606,22 +1076,342 @@ func setMaxSpeed(w http.ResponseWriter, r *http.Request) {
 		response(w, http.StatusBadRequest, "Missing parameter maxspeed")
 		return
 	}
-	maxSpeed, _ := strconv.ParseInt(maxSpeedStr, 10, 64)
-	userMaxSpeed[accessKey] = maxSpeed
+	maxSpeed, err := strconv.ParseInt(maxSpeedStr, 10, 64)
+	if err != nil || maxSpeed < 0 {
+		response(w, http.StatusBadRequest, "Bad parameter maxspeed")
+		return
+	}
+	jobUuid := r.URL.Query().Get("jobid")
+	if jobUuid != "" {
+		if !userOwnsJob(accessKey, jobUuid) {
+			response(w, http.StatusForbidden, "Your key has no access to job "+jobUuid)
+			return
+		}
+		err = setJobMaxSpeed(jobUuid, maxSpeed)
+	} else {
+		err = setUserMaxSpeed(accessKey, maxSpeed)
+	}
+	if err != nil {
+		logger.Println("Error setting max speed with error", err)
+		response(w, http.StatusInternalServerError, "Cannot set max speed")
+		return
+	}
 	response(w, http.StatusOK, string(""))
 }
 
+func isAdmin(accessKey string) bool {
+	for _, admin := range CONFIG.AdminUsers {
+		if admin == accessKey {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesHandler shows shares of users, or sets weight of a user with POST
+func sharesHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "GET" && method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		response(w, http.StatusMethodNotAllowed, "Only GET and POST methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	if !isAdmin(accessKey) {
+		response(w, http.StatusForbidden, "Your key is not an admin")
+		return
+	}
+
+	if method == "POST" {
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			response(w, http.StatusBadRequest, "Missing parameter user")
+			return
+		}
+		weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+		if err != nil || weight < 1 {
+			response(w, http.StatusBadRequest, "Bad parameter weight")
+			return
+		}
+		err = setUserWeight(user, weight)
+		if err == errUserNotFound {
+			response(w, http.StatusNotFound, "User "+user+" not found")
+			return
+		}
+		if err != nil {
+			logger.Println("Error setting weight of user", user, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot set weight")
+			return
+		}
+		response(w, http.StatusOK, string(""))
+		return
+	}
+
+	shares, err := getShares()
+	if err != nil {
+		logger.Println("Error querying shares with error", err)
+		response(w, http.StatusInternalServerError, "Cannot query shares")
+		return
+	}
+	respJson, err := json.Marshal(shares)
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
+}
+
+// usageHandler shows quota and usage of the user, admins could see other
+// users with parameter user, and set quota of them with PUT
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "GET" && method != "PUT" {
+		w.Header().Set("Allow", "GET, PUT")
+		response(w, http.StatusMethodNotAllowed, "Only GET and PUT methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user != "" && user != accessKey && !isAdmin(accessKey) {
+		response(w, http.StatusForbidden, "Your key has no access to user "+user)
+		return
+	}
+	if user == "" {
+		user = accessKey
+	}
+
+	if method == "PUT" {
+		if !isAdmin(accessKey) {
+			response(w, http.StatusForbidden, "Your key is not an admin")
+			return
+		}
+		var quota Quota
+		err = json.NewDecoder(bytes.NewReader(requestBody)).Decode(&quota)
+		if err != nil {
+			response(w, http.StatusBadRequest, "Bad JSON body")
+			return
+		}
+		if quota.MaxRunningTasks < 0 || quota.MaxQueuedUrls < 0 ||
+			quota.DailyBytes < 0 || quota.MonthlyBytes < 0 {
+			response(w, http.StatusBadRequest, "Bad quota")
+			return
+		}
+		err = setUserQuota(user, &quota)
+		if err == errUserNotFound {
+			response(w, http.StatusNotFound, "User "+user+" not found")
+			return
+		}
+		if err != nil {
+			logger.Println("Error setting quota of user", user, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot set quota")
+			return
+		}
+		response(w, http.StatusOK, string(""))
+		return
+	}
+
+	quota, err := getUserQuota(user)
+	if err == errUserNotFound {
+		response(w, http.StatusNotFound, "User "+user+" not found")
+		return
+	}
+	if err != nil {
+		logger.Println("Error querying quota of user", user, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot query quota")
+		return
+	}
+	usage, err := getUserUsage(user)
+	if err != nil {
+		logger.Println("Error querying usage of user", user, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot query usage")
+		return
+	}
+	respJson, err := json.Marshal(UsageResponse{Quota: quota, Usage: usage})
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
+}
+
+// recurringHandler lists recurring definitions of the user, or deletes one
+// with DELETE
+func recurringHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "GET" && method != "DELETE" {
+		w.Header().Set("Allow", "GET, DELETE")
+		response(w, http.StatusMethodNotAllowed, "Only GET and DELETE methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		response(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+
+	if method == "DELETE" {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			response(w, http.StatusBadRequest, "Missing parameter id")
+			return
+		}
+		deleted, err := deleteRecurringJob(accessKey, id)
+		if err != nil {
+			logger.Println("Error deleting recurring job", id, "with error", err)
+			response(w, http.StatusInternalServerError, "Cannot delete recurring job")
+			return
+		}
+		if !deleted {
+			response(w, http.StatusNotFound, "Recurring job "+id+" not found")
+			return
+		}
+		response(w, http.StatusOK, string(""))
+		return
+	}
+
+	jobs, err := getRecurringJobs(accessKey)
+	if err != nil {
+		logger.Println("Error querying recurring jobs with error", err)
+		response(w, http.StatusInternalServerError, "Cannot query recurring jobs")
+		return
+	}
+	respJson, err := json.Marshal(jobs)
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
+}
+
+// manifestHandler creates a manifest with POST, uploads its parts with PUT
+// ?id=&part=, shows it with GET ?id= and deletes it with DELETE ?id=
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.ToUpper(r.Method)
+	if method != "POST" && method != "PUT" && method != "GET" && method != "DELETE" {
+		w.Header().Set("Allow", "POST, PUT, GET, DELETE")
+		response(w, http.StatusMethodNotAllowed, "Only POST, PUT, GET and DELETE methods are allowed")
+		return
+	}
+	requestBody, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestPartSize))
+	if err != nil {
+		response(w, http.StatusRequestEntityTooLarge, "Manifest part should be no larger than "+
+			strconv.Itoa(maxManifestPartSize)+" bytes")
+		return
+	}
+	accessKey, verified := verifyRequest(r, requestBody)
+	if !verified {
+		response(w, http.StatusUnauthorized, "Failed to authenticate request")
+		return
+	}
+	query := r.URL.Query()
+	id := query.Get("id")
+	if method == "POST" {
+		id = newUuid()
+		err = createManifestUpload(accessKey, id)
+		if err != nil {
+			logger.Println("Error creating manifest with error", err)
+			response(w, http.StatusInternalServerError, "Cannot create manifest")
+			return
+		}
+	}
+	if id == "" {
+		response(w, http.StatusBadRequest, "Missing parameter id")
+		return
+	}
+
+	switch method {
+	case "PUT":
+		part, err := strconv.Atoi(query.Get("part"))
+		if err != nil || part < 1 || part > maxManifestParts {
+			response(w, http.StatusBadRequest, "Bad parameter part, should be in 1 to "+
+				strconv.Itoa(maxManifestParts))
+			return
+		}
+		err = putManifestPart(accessKey, id, part, requestBody)
+	case "DELETE":
+		err = deleteManifestUpload(accessKey, id)
+		if err == nil {
+			response(w, http.StatusOK, "")
+			return
+		}
+	}
+	switch err {
+	case nil:
+	case errManifestNotFound:
+		response(w, http.StatusNotFound, "Manifest "+id+" not found")
+		return
+	case errManifestUsed:
+		response(w, http.StatusConflict, "Manifest "+id+" is used by jobs and cannot be changed")
+		return
+	default:
+		logger.Println("Error handling manifest", id, "with error", err)
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	upload, err := getManifestUpload(accessKey, id)
+	if err == errManifestNotFound {
+		response(w, http.StatusNotFound, "Manifest "+id+" not found")
+		return
+	}
+	if err != nil {
+		logger.Println("Error querying manifest", id, "with error", err)
+		response(w, http.StatusInternalServerError, "Cannot query manifest")
+		return
+	}
+	respJson, err := json.Marshal(upload)
+	if err != nil {
+		response(w, http.StatusInternalServerError, "Server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response(w, http.StatusOK, string(respJson))
+}
+
 func startApiServer() {
-	http.HandleFunc("/transferjob", putTransferJobHandler)
+	http.HandleFunc("/transferjob", transferJobHandler)
+	http.HandleFunc("/canceljob", cancelJobHandler)
+	http.HandleFunc("/retryjob", postRetryJobHandler)
+	http.HandleFunc("/callbacks", callbacksHandler)
+	http.HandleFunc("/events", eventsHandler)
 	http.HandleFunc("/status", getJobStatusHandler)
 	http.HandleFunc("/suspendjob", postSuspendJobHandler)
 	http.HandleFunc("/resumejob", postResumeJobHandler)
-	http.HandleFunc("/schedule", putUserSchedule)
+	http.HandleFunc("/schedule", userScheduleHandler)
 	http.HandleFunc("/joburlsinfo", getUrlsInfo)
 	http.HandleFunc("/joblist", getJobList)
 	http.HandleFunc("/finishedsize", getFinishedSize)
 	http.HandleFunc("/currentspeed", getCurrSpeed)
 	http.HandleFunc("/setmaxspeed", setMaxSpeed)
+	http.HandleFunc("/shares", sharesHandler)
+	http.HandleFunc("/usage", usageHandler)
+	http.HandleFunc("/recurring", recurringHandler)
+	http.HandleFunc("/manifest", manifestHandler)
 	http.Handle("/", http.FileServer(http.Dir(CONFIG.WebRoot)))
 	logger.Println("Starting API server...")
 	err := http.ListenAndServe(CONFIG.ApiBindAddress, nil)
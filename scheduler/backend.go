@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/mesos/mesos-go/mesosproto"
+)
+
+// ClusterBackend runs tasks on a cluster for Scheduler. A backend offers
+// resources of its slaves through Scheduler.resourceOffers, and reports
+// task states, framework messages and lost slaves/executors back through
+// the other Scheduler callbacks. Calls into Scheduler must not be made
+// concurrently.
+//
+// Tasks are described with mesos TaskInfo whatever the backend is, since
+// the task and executor bookkeeping in database is built around them.
+type ClusterBackend interface {
+	// Run starts the backend and blocks until it's stopped
+	Run() error
+	Stop()
+	LaunchTasks(offerId string, tasks []*mesosproto.TaskInfo) error
+	DeclineOffer(offerId string)
+	KillTask(taskId string) error
+	SendFrameworkMessage(executorId string, slaveId string, message string) error
+}
+
+// Offer is a set of resources on a slave which tasks could be launched with
+type Offer struct {
+	Id       string
+	SlaveId  string
+	Hostname string
+	Cpus     float64
+	Mem      float64
+	Disk     float64
+}
+
+func newBackend(scheduler *Scheduler) (ClusterBackend, error) {
+	switch CONFIG.Backend {
+	case "local":
+		return newLocalBackend(scheduler)
+	default:
+		return newMesosBackend(scheduler)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Callbacks are queued in database and delivered by callbackDeliverer, a
+// failed delivery is retried with exponential backoff until
+// CONFIG.CallbackMaxAttempts is reached. Every attempt is recorded, see
+// GET /callbacks.
+
+const (
+	callbackBatchSize    = 100
+	callbackPollInterval = 5 * time.Second
+	maxCallbackBackoff   = time.Hour
+
+	defaultCallbackTimeout       = 10 * time.Second
+	defaultCallbackRetryInterval = 30 * time.Second
+	defaultCallbackMaxAttempts   = 8
+)
+
+// wakes up callbackDeliverer when a callback is queued
+var callbackWakeup = make(chan bool, 1)
+
+type callbackDelivery struct {
+	id        int64
+	jobUuid   string
+	url       string
+	body      []byte
+	attempts  int
+	secretKey string
+}
+
+// callbackUrlWithToken appends token to url as its query, callback_url?Token,
+// which callback consumers expect
+func callbackUrlWithToken(url string, token string) string {
+	if token == "" {
+		return url
+	}
+	return url + "?" + token
+}
+
+// queueCallback stores the callback and wakes up the deliverer
+func queueCallback(jobUuid string, url string, body []byte) {
+	err := insertCallback(jobUuid, url, body)
+	if err != nil {
+		logger.Println("Error queueing callback for job", jobUuid, "with error", err)
+		return
+	}
+	wakeCallbackDeliverer()
+}
+
+func wakeCallbackDeliverer() {
+	select {
+	case callbackWakeup <- true:
+	default:
+	}
+}
+
+func callbackDeliverer() {
+	for {
+		callbacks := getDueCallbacks(callbackBatchSize)
+		var wg sync.WaitGroup
+		for _, callback := range callbacks {
+			wg.Add(1)
+			go func(callback *callbackDelivery) {
+				defer wg.Done()
+				deliverCallback(callback)
+			}(callback)
+		}
+		wg.Wait()
+		if len(callbacks) == callbackBatchSize {
+			continue
+		}
+		select {
+		case <-callbackWakeup:
+		case <-time.After(callbackPollInterval):
+		}
+	}
+}
+
+// signCallback signs the request the same way API requests are signed, with
+// secret key of the job owner, see "Callback请求" in api.markdown
+func signCallback(request *http.Request, body []byte, secretKey string) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	hasher := md5.New()
+	hasher.Write(body)
+	bodyMd5 := hex.EncodeToString(hasher.Sum(nil))
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(request.Method + "\n" + date + "\n" + bodyMd5 + "\n" + request.URL.Path))
+	request.Header.Set("x-date", date)
+	request.Header.Set("X-Optimus-Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func deliverCallback(callback *callbackDelivery) {
+	timeout := CONFIG.CallbackTimeout
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+	attempt := CallbackAttempt{Time: time.Now().Unix()}
+	start := time.Now()
+	request, err := http.NewRequest("PUT", callback.url, bytes.NewReader(callback.body))
+	if err == nil {
+		request.Header.Set("Content-Type", "application/json")
+		signCallback(request, callback.body, callback.secretKey)
+		client := &http.Client{Timeout: timeout}
+		var resp *http.Response
+		resp, err = client.Do(request)
+		if err == nil {
+			attempt.StatusCode = resp.StatusCode
+			resp.Body.Close()
+		}
+	}
+	attempt.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	callback.attempts++
+	status := "Delivered"
+	var nextTime time.Time
+	if err != nil || attempt.StatusCode < 200 || attempt.StatusCode > 299 {
+		maxAttempts := CONFIG.CallbackMaxAttempts
+		if maxAttempts <= 0 {
+			maxAttempts = defaultCallbackMaxAttempts
+		}
+		if callback.attempts >= maxAttempts {
+			status = "Failed"
+		} else {
+			status = "Pending"
+			nextTime = time.Now().Add(callbackBackoff(callback.attempts))
+		}
+		logger.Println("Callback for job", callback.jobUuid, "to", callback.url,
+			"failed with status", attempt.StatusCode, "error", attempt.Error)
+	} else {
+		logger.Println("Callback has been sent to ", callback.url, "with response code ", attempt.StatusCode)
+	}
+	err = saveCallbackAttempt(callback.id, &attempt, status, callback.attempts, nextTime)
+	if err != nil {
+		logger.Println("Error saving callback attempt for job", callback.jobUuid, "with error", err)
+	}
+}
+
+// callbackBackoff returns how long to wait before the next attempt, after
+// attempts failed ones
+func callbackBackoff(attempts int) time.Duration {
+	interval := CONFIG.CallbackRetryInterval
+	if interval <= 0 {
+		interval = defaultCallbackRetryInterval
+	}
+	for i := 1; i < attempts && interval < maxCallbackBackoff; i++ {
+		interval *= 2
+	}
+	if interval > maxCallbackBackoff {
+		interval = maxCallbackBackoff
+	}
+	return interval
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// schemes of origins which take credentials. Credentials are sealed with the
+// key in CONFIG.CredentialKeyFile before stored, and opened only when tasks
+// are sent to executors.
+var credentialSchemes = map[string]bool{
+	"ftp":  true,
+	"sftp": true,
+}
+
+var errNoCredentialKey = errors.New("Credentials are not accepted, no credential key is configured")
+
+// AES-256 key sealing credentials, nil if not configured
+var credentialKey []byte
+
+// loadCredentialKey reads the base64 encoded 32 bytes key from file
+func loadCredentialKey(file string) error {
+	if file == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return err
+	}
+	if len(key) != 32 {
+		return errors.New("Credential key should be 32 bytes")
+	}
+	credentialKey = key
+	return nil
+}
+
+// sealCredentials encrypts credentials with AES-GCM, in form of
+// base64(nonce || ciphertext)
+func sealCredentials(credentials map[string]*common.Credential) (string, error) {
+	if credentialKey == nil {
+		return "", errNoCredentialKey
+	}
+	plain, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(credentialKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func openCredentials(sealed string) (map[string]*common.Credential, error) {
+	if credentialKey == nil {
+		return nil, errNoCredentialKey
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(credentialKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Sealed credentials are too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var credentials map[string]*common.Credential
+	err = json.Unmarshal(plain, &credentials)
+	return credentials, err
+}
+
+// sealRequestCredentials collects credentials of the request, including the
+// ones in user info of origin urls, which are removed from urls so they're
+// never stored in plain text. Credentials are sealed into
+// req.sealedCredentials and cleared from the request.
+func sealRequestCredentials(req *TransferRequest) error {
+	credentials := make(map[string]*common.Credential)
+	for origin, credential := range req.Credentials {
+		u, err := url.Parse(origin)
+		if err != nil || !credentialSchemes[strings.ToLower(u.Scheme)] || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") {
+			return errors.New("Bad credential origin " + origin + ", should be ftp://host or sftp://host")
+		}
+		if credential == nil || credential.User == "" {
+			return errors.New("Missing user of credential for " + origin)
+		}
+		credentials[common.CredentialKey(u)] = credential
+	}
+	for i, origin := range req.OriginUrls {
+		u, err := url.Parse(origin)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if !credentialSchemes[strings.ToLower(u.Scheme)] {
+			return errors.New("User info is only allowed in ftp:// or sftp:// url: " + origin)
+		}
+		key := common.CredentialKey(u)
+		password, _ := u.User.Password()
+		credential := &common.Credential{User: u.User.Username(), Password: password}
+		if c, ok := credentials[key]; !ok {
+			credentials[key] = credential
+		} else if c.User != credential.User || c.Password != credential.Password {
+			return errors.New("Conflicting credentials for " + key)
+		}
+		u.User = nil
+		req.OriginUrls[i] = u.String()
+		if sum, ok := req.Checksums[origin]; ok {
+			delete(req.Checksums, origin)
+			req.Checksums[req.OriginUrls[i]] = sum
+		}
+	}
+	for key, credential := range credentials {
+		// an unverified server could steal the password or serve forged files
+		if strings.HasPrefix(key, "sftp://") && credential.HostKey == "" {
+			return errors.New("Host key is required for " + key)
+		}
+	}
+	req.Credentials = nil
+	if len(credentials) == 0 {
+		return nil
+	}
+	sealed, err := sealCredentials(credentials)
+	if err != nil {
+		return err
+	}
+	req.sealedCredentials = sealed
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression of 5 fields: minute, hour, day of month,
+// month and day of week. Fields take "*", numbers, ranges "a-b", steps "*/n"
+// or "a-b/n", and lists of them separated by ",". Day of week is 0 to 7,
+// both 0 and 7 are Sunday. Like cron, if both day of month and day of week
+// are restricted, a day matching either of them matches.
+type Cron struct {
+	minute []bool
+	hour   []bool
+	dom    []bool
+	month  []bool
+	dow    []bool
+	anyDom bool
+	anyDow bool
+}
+
+// how far next looks for a matching time, expressions like "0 0 30 2 *"
+// never match
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	matches := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, errors.New("Bad step in " + field)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("Bad value in " + field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, errors.New("Bad value in " + field)
+				}
+			} else if step != 1 {
+				// "a/n" means from a to the maximum
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, errors.New("Value out of range in " + field)
+		}
+		for i := start; i <= end; i += step {
+			matches[i] = true
+		}
+	}
+	return matches, nil
+}
+
+func parseCron(expression string) (*Cron, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron expression should have 5 fields")
+	}
+	var cron Cron
+	var err error
+	if cron.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if cron.dow[7] {
+		cron.dow[0] = true
+	}
+	cron.anyDom = fields[2] == "*"
+	cron.anyDow = fields[4] == "*"
+	return &cron, nil
+}
+
+func (cron *Cron) matchDay(t time.Time) bool {
+	dom := cron.dom[t.Day()]
+	dow := cron.dow[int(t.Weekday())]
+	switch {
+	case cron.anyDom && cron.anyDow:
+		return true
+	case cron.anyDom:
+		return dow
+	case cron.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first time matching the expression after t, in location
+// of t. Zero time is returned if nothing matches in years.
+func (cron *Cron) next(t time.Time) time.Time {
+	location := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxCronSearch)
+	for t.Before(limit) {
+		if !cron.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !cron.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !cron.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+			continue
+		}
+		if !cron.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
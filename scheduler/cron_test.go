@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_CronNext(t *testing.T) {
+	location, _ := time.LoadLocation("Asia/Shanghai")
+	// 2016-10-17 is Monday
+	from := time.Date(2016, 10, 17, 10, 20, 30, 0, location)
+	cases := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2016, 10, 17, 10, 21, 0, 0, location)},
+		{"30 2 * * *", time.Date(2016, 10, 18, 2, 30, 0, 0, location)},
+		{"*/15 * * * *", time.Date(2016, 10, 17, 10, 30, 0, 0, location)},
+		{"0 9-17/4 * * *", time.Date(2016, 10, 17, 13, 0, 0, 0, location)},
+		{"0 0 1 * *", time.Date(2016, 11, 1, 0, 0, 0, 0, location)},
+		{"0 0 * * 0", time.Date(2016, 10, 23, 0, 0, 0, 0, location)},
+		{"0 0 * * 7", time.Date(2016, 10, 23, 0, 0, 0, 0, location)},
+		{"0 12 * * 1,3,5", time.Date(2016, 10, 17, 12, 0, 0, 0, location)},
+		// either day of month or day of week matches
+		{"0 0 20 * 6", time.Date(2016, 10, 20, 0, 0, 0, 0, location)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, location)},
+		{"5/20 * * * *", time.Date(2016, 10, 17, 10, 25, 0, 0, location)},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expression)
+		if err != nil {
+			t.Error("Error parsing", c.expression, ":", err)
+			continue
+		}
+		if next := cron.next(from); !next.Equal(c.next) {
+			t.Error("Next of", c.expression, "is", next, "expected:", c.next)
+		}
+	}
+
+	cron, _ := parseCron("0 0 30 2 *")
+	if next := cron.next(from); !next.IsZero() {
+		t.Error("Feb 30 should never match, got", next)
+	}
+}
+
+func Test_CronParseErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, expression := range bad {
+		if _, err := parseCron(expression); err == nil {
+			t.Error("Cron expression", expression, "should be invalid")
+		}
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/gogo/protobuf/proto"
 	"github.com/mesos/mesos-go/mesosproto"
+	"sort"
 	"strconv"
+	"strings"
 
 	"legitlab.letv.cn/optimus/optimus/common"
 	"time"
@@ -22,44 +26,590 @@ func createDbConnection() *sql.DB {
 }
 
 func insertJob(req *TransferRequest) (err error) {
-	_, err = db.Exec("insert job set id = 0, uuid = ?, create_time = NOW(), "+
-		"callback_url = ?, callback_token = ?, access_key = ?, status = ?",
-		req.uuid, req.callbackUrl, req.callbackToken, req.accessKey, "Pending")
-	return err
+	var parentUuid interface{}
+	if req.parentUuid != "" {
+		parentUuid = req.parentUuid
+	}
+	status := "Pending"
+	if len(req.DependsOn) > 0 {
+		status = "Blocked"
+	}
+	var credentials interface{}
+	if req.sealedCredentials != "" {
+		credentials = req.sealedCredentials
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var manifest interface{}
+	if req.Manifest != nil {
+		if req.Manifest.Id != "" {
+			req.Manifest.Parts, err = useManifestUpload(tx, req.accessKey, req.Manifest.Id)
+			if err != nil {
+				return err
+			}
+		}
+		state, err := json.Marshal(&manifestState{Manifest: req.Manifest, Task: req.manifestTask})
+		if err != nil {
+			return err
+		}
+		manifest = string(state)
+	}
+	_, err = tx.Exec("insert job set id = 0, uuid = ?, create_time = NOW(), "+
+		"callback_url = ?, callback_token = ?, access_key = ?, status = ?, max_speed = ?, "+
+		"parent_uuid = ?, cancel_on_parent_failure = ?, manifest = ?, expanding = ?, credentials = ?",
+		req.uuid, req.callbackUrl, req.callbackToken, req.accessKey, status, req.MaxSpeed,
+		parentUuid, req.CancelOnParentFailure, manifest, req.Manifest != nil, credentials)
+	if err != nil {
+		return err
+	}
+	for _, parent := range req.DependsOn {
+		_, err = tx.Exec("insert into job_dependency(job_uuid, parent_uuid) values(?, ?)",
+			req.uuid, parent)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
+func getJobStatus(jobUuid string) (status string, err error) {
+	err = db.QueryRow("select status from job where uuid = ?", jobUuid).Scan(&status)
+	return
+}
+
+// getJobParents returns statuses of jobs the job depends on, keyed by job
+// uuid, and if the job should be cancelled when a parent fails
+func getJobParents(jobUuid string) (parents map[string]string, cancelOnFailure bool, err error) {
+	err = db.QueryRow("select cancel_on_parent_failure from job where uuid = ?",
+		jobUuid).Scan(&cancelOnFailure)
+	if err != nil {
+		return
+	}
+	rows, err := db.Query("select d.parent_uuid, j.status from job_dependency d "+
+		"left join job j on d.parent_uuid = j.uuid where d.job_uuid = ?", jobUuid)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	parents = make(map[string]string)
+	for rows.Next() {
+		var parent string
+		var status sql.NullString
+		if err := rows.Scan(&parent, &status); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		parents[parent] = status.String
+	}
+	err = rows.Err()
+	return
+}
+
+// getBlockedChildren returns jobs blocked by the job
+func getBlockedChildren(jobUuid string) (children []string, err error) {
+	rows, err := db.Query("select d.job_uuid from job_dependency d "+
+		"join job j on d.job_uuid = j.uuid where d.parent_uuid = ? and j.status = ?",
+		jobUuid, "Blocked")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var child string
+		if err := rows.Scan(&child); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		children = append(children, child)
+	}
+	err = rows.Err()
+	return
+}
+
+// unblockJob moves a Blocked job and its tasks to Pending, and returns the
+// owner of the job, or "" if the job is not Blocked
+func unblockJob(jobUuid string) (accessKey string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRow("select access_key, status from job where uuid = ? for update",
+		jobUuid).Scan(&accessKey, &status)
+	if err != nil {
+		return "", err
+	}
+	if status != "Blocked" {
+		return "", nil
+	}
+	_, err = tx.Exec("update task set status = ? where job_uuid = ? and status = ?",
+		"Pending", jobUuid, "Blocked")
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("update job set status = ? where uuid = ?", "Pending", jobUuid)
+	if err != nil {
+		return "", err
+	}
+	return accessKey, tx.Commit()
+}
+
+func insertRecurringJob(req *TransferRequest, next time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if req.Manifest != nil && req.Manifest.Id != "" {
+		req.Manifest.Parts, err = useManifestUpload(tx, req.accessKey, req.Manifest.Id)
+		if err != nil {
+			return err
+		}
+	}
+	request, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var credentials interface{}
+	if req.sealedCredentials != "" {
+		credentials = req.sealedCredentials
+	}
+	_, err = tx.Exec("insert into recurring(uuid, access_key, request, credentials, callback_url, "+
+		"callback_token, cron, timezone, next_time, status, create_time) "+
+		"values(?, ?, ?, ?, ?, ?, ?, ?, FROM_UNIXTIME(?), ?, NOW())", req.uuid, req.accessKey,
+		string(request), credentials, req.callbackUrl, req.callbackToken, req.Cron, req.Timezone,
+		next.Unix(), RecurringActive)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func scanRecurringJobs(rows *sql.Rows) (jobs []*RecurringJob) {
+	for rows.Next() {
+		job := &RecurringJob{Request: &TransferRequest{}}
+		var accessKey, request string
+		var nextTime, createTime sql.NullInt64
+		var credentials, lastJob, callbackUrl, callbackToken sql.NullString
+		if err := rows.Scan(&job.Id, &accessKey, &request, &credentials, &callbackUrl, &callbackToken,
+			&job.Cron, &job.Timezone, &nextTime, &job.Runs, &lastJob, &job.Status,
+			&createTime); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(request), job.Request); err != nil {
+			logger.Println("Bad request of recurring job", job.Id, "with error", err)
+			continue
+		}
+		job.Request.accessKey = accessKey
+		job.Request.sealedCredentials = credentials.String
+		job.Request.callbackUrl = callbackUrl.String
+		job.Request.callbackToken = callbackToken.String
+		job.NextTime = nextTime.Int64
+		job.LastJobId = lastJob.String
+		job.CreateTime = createTime.Int64
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+const recurringColumns = "uuid, access_key, request, credentials, callback_url, callback_token, cron, timezone, " +
+	"UNIX_TIMESTAMP(next_time), runs, last_job_uuid, status, UNIX_TIMESTAMP(create_time)"
+
+func getDueRecurringJobs() []*RecurringJob {
+	rows, err := db.Query("select "+recurringColumns+" from recurring "+
+		"where status = ? and next_time <= NOW()", RecurringActive)
+	if err != nil {
+		logger.Println("Error querying due recurring jobs: ", err)
+		return nil
+	}
+	defer rows.Close()
+	return scanRecurringJobs(rows)
+}
+
+// getRecurringJobs returns definitions of the user not deleted
+func getRecurringJobs(accessKey string) ([]*RecurringJob, error) {
+	rows, err := db.Query("select "+recurringColumns+" from recurring "+
+		"where access_key = ? and status != ? order by id", accessKey, RecurringDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := scanRecurringJobs(rows)
+	if jobs == nil {
+		jobs = []*RecurringJob{}
+	}
+	return jobs, rows.Err()
+}
+
+// advanceRecurringJob moves the definition from run at nextTime to its next
+// run, or to status Done, and returns false if it's already moved
+func advanceRecurringJob(uuid string, nextTime int64, status string, next time.Time,
+	jobUuid string) (bool, error) {
+	var nextArg interface{}
+	if !next.IsZero() {
+		nextArg = next.Unix()
+	}
+	result, err := db.Exec("update recurring set next_time = FROM_UNIXTIME(?), status = ?, "+
+		"runs = runs + 1, last_job_uuid = ? where uuid = ? and status = ? and "+
+		"UNIX_TIMESTAMP(next_time) = ?", nextArg, status, jobUuid, uuid, RecurringActive, nextTime)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// deleteRecurringJob stops the definition, jobs already run are not affected
+func deleteRecurringJob(accessKey string, uuid string) (bool, error) {
+	result, err := db.Exec("update recurring set status = ?, next_time = NULL "+
+		"where uuid = ? and access_key = ? and status != ?",
+		RecurringDeleted, uuid, accessKey, RecurringDeleted)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// insertTasks inserts tasks of a job one by one. Tasks take the status the
+// job has when they're inserted, since the job may be unblocked by its
+// parents, or cancelled, meanwhile.
 func insertTasks(tasks []*common.TransferTask) error {
 	for _, task := range tasks {
 		tx, err := db.Begin()
 		if err != nil {
 			return err
 		}
-		result, err := tx.Exec(
-			"insert into task(id, uid, job_uuid, target_type, target_bucket, target_acl, status, access_key, secret_key) "+
-				"values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
-			0, task.UId, task.JobUuid, task.TargetType, task.TargetBucket, task.TargetAcl, task.Status, task.AccessKey, task.SecretKey)
+		var status string
+		err = tx.QueryRow("select status from job where uuid = ? for update",
+			task.JobUuid).Scan(&status)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		taskId, err := result.LastInsertId()
+		switch status {
+		case "Blocked", "Suspended", "Cancelled":
+			task.Status = status
+		case "Finished", "Failed":
+			// not expected, jobs are not finished while tasks are inserted
+			tx.Rollback()
+			return errJobCompleted
+		default:
+			task.Status = "Pending"
+		}
+		err = insertTask(tx, task)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		for _, url := range task.OriginUrls {
-			_, err := tx.Exec("insert into url(id, task_id, origin_url, status) "+
-				"values(?, ?, ?, ?)", 0, taskId, url, task.Status)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-		}
 		tx.Commit()
 	}
 	return nil
 }
 
+func insertTask(tx *sql.Tx, task *common.TransferTask) error {
+	result, err := tx.Exec(
+		"insert into task(id, uid, job_uuid, target_type, target_bucket, target_acl, source_type, transfer_mode, "+
+			"threads, status, access_key, secret_key) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		0, task.UId, task.JobUuid, task.TargetType, task.TargetBucket, task.TargetAcl, task.SourceType,
+		task.TransferMode, task.Threads, task.Status, task.AccessKey, task.SecretKey)
+	if err != nil {
+		return err
+	}
+	taskId, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, url := range task.OriginUrls {
+		var expectedMd5, expectedSha256 string
+		if sum, ok := task.Checksums[url]; ok {
+			expectedMd5, expectedSha256 = sum.MD5, sum.SHA256
+		}
+		_, err := tx.Exec("insert into url(id, task_id, origin_url, target_key, status, expected_md5, "+
+			"expected_sha256) values(?, ?, ?, ?, ?, ?, ?)", 0, taskId, url, task.TargetKeys[url],
+			task.Status, expectedMd5, expectedSha256)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertManifestTask inserts a task expanded from manifest of its job, and
+// moves expansion progress of the job from files on, to position in the
+// manifest after entries of the task. The task is Blocked or
+// Suspended along with the job. false is returned if the job is no longer
+// expanding or has been expanded by others.
+func insertManifestTask(task *common.TransferTask, files int64, position string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var status string
+	var expanding bool
+	var expanded int64
+	err = tx.QueryRow("select status, expanding, manifest_files from job where uuid = ? for update",
+		task.JobUuid).Scan(&status, &expanding, &expanded)
+	if err != nil {
+		return false, err
+	}
+	if !expanding || expanded != files {
+		return false, nil
+	}
+	task.Status = "Pending"
+	if status == "Blocked" || status == "Suspended" {
+		task.Status = status
+	}
+	err = insertTask(tx, task)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("update job set manifest_files = ?, manifest_position = ? where uuid = ?",
+		files+int64(len(task.OriginUrls)), position, task.JobUuid)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// getManifestState returns manifest of the job, how many of its entries are
+// expanded and the position after them, nil if the job is not expanding
+func getManifestState(jobUuid string) (state *manifestState, files int64, position string, err error) {
+	var manifest string
+	err = db.QueryRow("select manifest, manifest_files, manifest_position from job "+
+		"where uuid = ? and expanding", jobUuid).Scan(&manifest, &files, &position)
+	if err == sql.ErrNoRows {
+		return nil, 0, "", nil
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+	state = new(manifestState)
+	err = json.Unmarshal([]byte(manifest), state)
+	if err != nil || state.Manifest == nil || state.Task == nil {
+		return nil, 0, "", &manifestError{"Malformed manifest state"}
+	}
+	return state, files, position, nil
+}
+
+func getExpandingJobs() (jobUuids []string, err error) {
+	rows, err := db.Query("select uuid from job where expanding")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobUuid string
+		if err := rows.Scan(&jobUuid); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		jobUuids = append(jobUuids, jobUuid)
+	}
+	return jobUuids, rows.Err()
+}
+
+// stopExpanding marks manifest of the job expanded, with the error if any
+func stopExpanding(jobUuid string, message string) error {
+	var errorMessage interface{}
+	if message != "" {
+		errorMessage = message
+	}
+	_, err := db.Exec("update job set expanding = FALSE, manifest_error = ? where uuid = ?",
+		errorMessage, jobUuid)
+	return err
+}
+
+func getManifestProgress(jobUuid string) (*ManifestProgress, error) {
+	var hasManifest bool
+	var progress ManifestProgress
+	var message sql.NullString
+	err := db.QueryRow("select manifest is not null, expanding, manifest_files, manifest_error "+
+		"from job where uuid = ?", jobUuid).Scan(&hasManifest, &progress.Expanding,
+		&progress.Files, &message)
+	if err != nil || !hasManifest {
+		return nil, err
+	}
+	progress.Error = message.String
+	return &progress, nil
+}
+
+func createManifestUpload(accessKey string, id string) error {
+	_, err := db.Exec("insert into manifest(id, uuid, access_key, status, create_time) "+
+		"values(?, ?, ?, ?, NOW())", 0, id, accessKey, ManifestUploading)
+	return err
+}
+
+var (
+	errManifestNotFound   = errors.New("Manifest not found")
+	errManifestUsed       = errors.New("Manifest is used by jobs")
+	errManifestIncomplete = errors.New("Manifest parts are not continuous from 1")
+)
+
+func getManifestUpload(accessKey string, id string) (*ManifestUpload, error) {
+	upload := ManifestUpload{Id: id}
+	err := db.QueryRow("select m.status, UNIX_TIMESTAMP(m.create_time), count(p.id), "+
+		"coalesce(sum(length(p.data)), 0) from manifest m "+
+		"left join manifest_part p on p.manifest_uuid = m.uuid "+
+		"where m.uuid = ? and m.access_key = ? group by m.id", id, accessKey).Scan(
+		&upload.Status, &upload.CreateTime, &upload.Parts, &upload.Size)
+	if err == sql.ErrNoRows {
+		return nil, errManifestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// lockManifestUpload locks the uploaded manifest of the user and returns its
+// status
+func lockManifestUpload(tx *sql.Tx, accessKey string, id string) (status string, err error) {
+	err = tx.QueryRow("select status from manifest where uuid = ? and access_key = ? for update",
+		id, accessKey).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", errManifestNotFound
+	}
+	return
+}
+
+func putManifestPart(accessKey string, id string, part int, data []byte) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status, err := lockManifestUpload(tx, accessKey, id)
+	if err != nil {
+		return err
+	}
+	if status != ManifestUploading {
+		return errManifestUsed
+	}
+	_, err = tx.Exec("insert into manifest_part(id, manifest_uuid, part, data) values(?, ?, ?, ?) "+
+		"on duplicate key update data = values(data)", 0, id, part, data)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockManifestParts locks the uploaded manifest and checks its parts are
+// continuous from 1. Number of parts is returned.
+func lockManifestParts(tx *sql.Tx, accessKey string, id string) (parts int, err error) {
+	_, err = lockManifestUpload(tx, accessKey, id)
+	if err != nil {
+		return 0, err
+	}
+	var lastPart int
+	err = tx.QueryRow("select count(*), coalesce(max(part), 0) from manifest_part "+
+		"where manifest_uuid = ?", id).Scan(&parts, &lastPart)
+	if err != nil {
+		return 0, err
+	}
+	if parts == 0 || parts != lastPart {
+		return 0, errManifestIncomplete
+	}
+	return parts, nil
+}
+
+// checkManifestUpload checks parts of the uploaded manifest without using
+// it, so a rejected submission leaves it as it is
+func checkManifestUpload(accessKey string, id string) (parts int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return lockManifestParts(tx, accessKey, id)
+}
+
+// useManifestUpload checks parts of the uploaded manifest and marks it Used
+// in tx which saves the job or recurring job reading it, so parts cannot be
+// changed while jobs are reading it. Number of parts is returned.
+func useManifestUpload(tx *sql.Tx, accessKey string, id string) (parts int, err error) {
+	parts, err = lockManifestParts(tx, accessKey, id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("update manifest set status = ? where uuid = ?", ManifestUsed, id)
+	if err != nil {
+		return 0, err
+	}
+	return parts, nil
+}
+
+// getManifestPart returns data of the part, nil if there's no such part
+func getManifestPart(id string, part int) (data []byte, err error) {
+	err = db.QueryRow("select data from manifest_part where manifest_uuid = ? and part = ?",
+		id, part).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return
+}
+
+// getManifestPartSizes returns sizes of parts of the uploaded manifest in
+// order of parts
+func getManifestPartSizes(id string) (sizes []int64, err error) {
+	rows, err := db.Query("select length(data) from manifest_part where manifest_uuid = ? "+
+		"order by part", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var size int64
+		if err := rows.Scan(&size); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, rows.Err()
+}
+
+func deleteManifestUpload(accessKey string, id string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status, err := lockManifestUpload(tx, accessKey, id)
+	if err != nil {
+		return err
+	}
+	if status == ManifestUsed {
+		// jobs expanding the manifest and active recurring jobs still read
+		// it, id of the manifest is in their saved manifest or request
+		pattern := "%" + id + "%"
+		var readers int
+		err = tx.QueryRow("select (select count(*) from job where expanding and manifest like ?) + "+
+			"(select count(*) from recurring where status = ? and request like ?)",
+			pattern, RecurringActive, pattern).Scan(&readers)
+		if err != nil {
+			return err
+		}
+		if readers > 0 {
+			return errManifestUsed
+		}
+	}
+	_, err = tx.Exec("delete from manifest_part where manifest_uuid = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from manifest where uuid = ?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func upsertSlave(slave *Slave) error {
 	_, err := db.Exec("insert into slave(id, uuid, hostname, status) "+
 		"values(?, ?, ?, ?) on duplicate key update "+
@@ -92,8 +642,16 @@ func getIdleExecutorsOnSlave(tx *sql.Tx, slaveUuid string) (executors []*Executo
 }
 
 func getPendingTasks(uid string, tx *sql.Tx, limit int) (tasks []*common.TransferTask) {
+	// queried before the task rows are opened, the connection can't run
+	// another query while they're read
+	var userSpeed int64
+	err := tx.QueryRow("select max_speed from user where access_key = ?", uid).Scan(&userSpeed)
+	if err != nil {
+		logger.Println("Error querying max speed of user", uid, "with error", err)
+	}
 	taskRows, err := tx.Query(
-		"select id, job_uuid, target_type, target_bucket, target_acl, access_key, secret_key from task "+
+		"select id, job_uuid, target_type, target_bucket, target_acl, source_type, transfer_mode, threads, "+
+			"access_key, secret_key from task "+
 			"where uid = ? and status = ? limit ? for update", uid, "Pending", limit)
 	if err != nil {
 		logger.Println("Error querying pending tasks: ", err)
@@ -102,9 +660,12 @@ func getPendingTasks(uid string, tx *sql.Tx, limit int) (tasks []*common.Transfe
 	defer taskRows.Close()
 	for taskRows.Next() {
 		var task common.TransferTask
+		task.UId = uid
 		var targetType string
+		var sourceType sql.NullString
 		if err := taskRows.Scan(&task.Id, &task.JobUuid, &targetType, &task.TargetBucket,
-			&task.TargetAcl, &task.AccessKey, &task.SecretKey); err != nil {
+			&task.TargetAcl, &sourceType, &task.TransferMode, &task.Threads, &task.AccessKey,
+			&task.SecretKey); err != nil {
 			logger.Println("Row scan error: ", err)
 			continue
 		}
@@ -112,31 +673,188 @@ func getPendingTasks(uid string, tx *sql.Tx, limit int) (tasks []*common.Transfe
 		if addr, ok := cluster[targetType]; ok {
 			task.TargetType = "s3"
 			task.TargetCluster = addr
+		} else if targetType == "Vaas" && CONFIG.VaasAddress != "" {
+			task.TargetType = "Vaas"
+			task.TargetCluster = CONFIG.VaasAddress
 		} else {
 			logger.Println("Target type is wrong. target: ", targetType)
 			continue
 		}
+		if addr, ok := cluster[sourceType.String]; ok {
+			task.SourceType = "s3"
+			task.SourceCluster = addr
+		}
 		tasks = append(tasks, &task)
 	}
+	if userSpeed > 0 && len(tasks) > 0 {
+		// the limit is shared with running tasks of the user, until they're
+		// rebalanced by reported rates
+		var running int64
+		err = tx.QueryRow("select count(*) from task where uid = ? and status in (?, ?)",
+			uid, "Scheduled", "Running").Scan(&running)
+		if err != nil {
+			logger.Println("Error querying running tasks of user", uid, "with error", err)
+		}
+		userSpeed /= running + int64(len(tasks))
+		if userSpeed == 0 {
+			userSpeed = 1
+		}
+	}
+	// limit of a job is shared with its running tasks too
+	jobTasks := make(map[string]int64)
 	for _, task := range tasks {
-		urlRows, err := tx.Query("select origin_url from url where task_id = ?", task.Id)
+		jobTasks[task.JobUuid]++
+	}
+	jobShares := make(map[string]int64)
+	var sourceAccessKey, sourceSecretKey string
+	// credentials of jobs, opened once for all tasks of a job
+	jobCredentials := make(map[string]map[string]*common.Credential)
+	for _, task := range tasks {
+		if task.SourceType != "" {
+			// keys are read when needed, and only once
+			if sourceAccessKey == "" {
+				sourceAccessKey, sourceSecretKey = getKeysForUser(uid, "s3")
+			}
+			task.SourceAccessKey, task.SourceSecretKey = sourceAccessKey, sourceSecretKey
+		}
+		var jobSpeed int64
+		var sealed sql.NullString
+		err = tx.QueryRow("select max_speed, credentials from job where uuid = ?",
+			task.JobUuid).Scan(&jobSpeed, &sealed)
+		if err != nil {
+			logger.Println("Error querying max speed of job", task.JobUuid, "with error", err)
+		}
+		if jobSpeed > 0 {
+			share, ok := jobShares[task.JobUuid]
+			if !ok {
+				var running int64
+				err = tx.QueryRow("select count(*) from task where job_uuid = ? and status in (?, ?)",
+					task.JobUuid, "Scheduled", "Running").Scan(&running)
+				if err != nil {
+					logger.Println("Error querying running tasks of job", task.JobUuid, "with error", err)
+				}
+				share = jobSpeed / (running + jobTasks[task.JobUuid])
+				if share == 0 {
+					share = 1
+				}
+				jobShares[task.JobUuid] = share
+			}
+			jobSpeed = share
+		}
+		task.MaxSpeed = minSpeed(userSpeed, jobSpeed)
+		if sealed.String != "" {
+			credentials, ok := jobCredentials[task.JobUuid]
+			if !ok {
+				credentials, err = openCredentials(sealed.String)
+				if err != nil {
+					logger.Println("Error opening credentials of job", task.JobUuid, "with error", err)
+				}
+				jobCredentials[task.JobUuid] = credentials
+			}
+			task.Credentials = credentials
+		}
+		urlRows, err := tx.Query("select origin_url, target_key, upload_id, upload_parts, expected_md5, "+
+			"expected_sha256 from url where task_id = ?", task.Id)
 		if err != nil {
 			logger.Println("Error querying urls: ", err)
 			continue
 		}
 		for urlRows.Next() {
 			var url string
-			if err := urlRows.Scan(&url); err != nil {
+			var targetKey, uploadId, uploadParts, expectedMd5, expectedSha256 sql.NullString
+			if err := urlRows.Scan(&url, &targetKey, &uploadId, &uploadParts, &expectedMd5,
+				&expectedSha256); err != nil {
 				logger.Println("Row scan error: ", err)
 				break
 			}
 			task.OriginUrls = append(task.OriginUrls, url)
+			if targetKey.String != "" {
+				if task.TargetKeys == nil {
+					task.TargetKeys = make(map[string]string)
+				}
+				task.TargetKeys[url] = targetKey.String
+			}
+			if expectedMd5.String != "" || expectedSha256.String != "" {
+				if task.Checksums == nil {
+					task.Checksums = make(map[string]*common.Checksum)
+				}
+				task.Checksums[url] = &common.Checksum{MD5: expectedMd5.String, SHA256: expectedSha256.String}
+			}
+			if uploadId.String == "" {
+				continue
+			}
+			// multipart upload started by a lost executor, continue it
+			upload := &common.Upload{UploadId: uploadId.String}
+			upload.Parts, err = parseUploadParts(uploadParts.String)
+			if err != nil {
+				logger.Println("Malformed upload parts of url", url, "with error", err)
+			}
+			if task.Uploads == nil {
+				task.Uploads = make(map[string]*common.Upload)
+			}
+			task.Uploads[url] = upload
 		}
 		urlRows.Close()
 	}
 	return
 }
 
+// minSpeed returns the lower limit, 0 means unlimited
+func minSpeed(a int64, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func setUserMaxSpeed(accessKey string, maxSpeed int64) error {
+	_, err := db.Exec("update user set max_speed = ? where access_key = ?", maxSpeed, accessKey)
+	if err != nil {
+		return err
+	}
+	userSpeedLock.Lock()
+	if maxSpeed > 0 {
+		userMaxSpeed[accessKey] = maxSpeed
+	} else {
+		delete(userMaxSpeed, accessKey)
+	}
+	userSpeedLock.Unlock()
+	// running tasks of the user are adjusted too
+	wakeRebalancer()
+	return nil
+}
+
+func setJobMaxSpeed(jobUuid string, maxSpeed int64) error {
+	_, err := db.Exec("update job set max_speed = ? where uuid = ?", maxSpeed, jobUuid)
+	if err != nil {
+		return err
+	}
+	// running tasks of the job are adjusted too
+	wakeRebalancer()
+	return nil
+}
+
+// loadUserMaxSpeed reads limits of users set by /setmaxspeed
+func loadUserMaxSpeed() error {
+	rows, err := db.Query("select access_key, max_speed from user where max_speed > 0")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	userSpeedLock.Lock()
+	defer userSpeedLock.Unlock()
+	for rows.Next() {
+		var accessKey string
+		var maxSpeed int64
+		if err := rows.Scan(&accessKey, &maxSpeed); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		userMaxSpeed[accessKey] = maxSpeed
+	}
+	return nil
+}
+
 func initializeTaskStatus(tx *sql.Tx, tasks []*mesosproto.TaskInfo, slaveUuid string) {
 	for _, task := range tasks {
 		taskId := task.TaskId.GetValue()
@@ -169,14 +887,93 @@ func initializeTaskStatus(tx *sql.Tx, tasks []*mesosproto.TaskInfo, slaveUuid st
 }
 
 func updateUrl(update *common.UrlUpdate) {
-	_, err := db.Exec("update url set status = ?, target_url = ?, size = ? where "+
-		"task_id = ? and origin_url = ?",
-		update.Status, update.TargetUrl, update.Size, update.TaskId, update.OriginUrl)
+	var err error
+	if update.Checksum != nil {
+		_, err = db.Exec("update url set md5 = ?, sha256 = ? where task_id = ? and origin_url = ?",
+			update.Checksum.MD5, update.Checksum.SHA256, update.TaskId, update.OriginUrl)
+		if err != nil {
+			logger.Println("Error updating url checksum: ", err)
+		}
+	}
+	switch update.Status {
+	case "Finished":
+		// upload is completed, its state is no longer needed
+		var result sql.Result
+		result, err = db.Exec("update url set status = ?, target_url = ?, size = ?, "+
+			"upload_id = NULL, upload_parts = NULL, error_class = NULL, http_status = NULL, "+
+			"error_message = NULL where task_id = ? and origin_url = ?",
+			update.Status, update.TargetUrl, update.Size, update.TaskId, update.OriginUrl)
+		// MySQL doesn't count rows not changed, so an update delivered again
+		// is not counted twice
+		if err == nil {
+			if n, _ := result.RowsAffected(); n > 0 {
+				addUserUsage(update.TaskId, update.Size)
+			}
+		}
+	case "Failed", "ChecksumFailed":
+		_, err = db.Exec("update url set status = ?, target_url = ?, size = ?, "+
+			"error_class = ?, http_status = ?, error_message = ? where "+
+			"task_id = ? and origin_url = ?",
+			update.Status, update.TargetUrl, update.Size, update.ErrorClass,
+			update.HttpStatus, update.Message, update.TaskId, update.OriginUrl)
+	default:
+		_, err = db.Exec("update url set status = ?, target_url = ?, size = ? where "+
+			"task_id = ? and origin_url = ?",
+			update.Status, update.TargetUrl, update.Size, update.TaskId, update.OriginUrl)
+	}
 	if err != nil {
 		logger.Println("Error updating url: ", err)
 	}
 }
 
+// saveUploadState records multipart upload of an url, so the upload could be
+// continued when the task is rescheduled. Parts in update are appended to
+// the ones stored, one JSON object per line, unless a new upload is started.
+func saveUploadState(update *common.UrlUpdate) {
+	if update.Upload == nil {
+		return
+	}
+	var parts string
+	for _, part := range update.Upload.Parts {
+		line, err := json.Marshal(part)
+		if err != nil {
+			logger.Println("Error marshal upload part: ", err)
+			return
+		}
+		parts += string(line) + "\n"
+	}
+	// upload_parts is set before upload_id, so it's compared with the old id
+	_, err := db.Exec("update url set upload_parts = if(upload_id = ?, "+
+		"concat(ifnull(upload_parts, ''), ?), ?), upload_id = ? where "+
+		"task_id = ? and origin_url = ?", update.Upload.UploadId, parts, parts,
+		update.Upload.UploadId, update.TaskId, update.OriginUrl)
+	if err != nil {
+		logger.Println("Error saving upload state: ", err)
+	}
+}
+
+// parseUploadParts reads parts saved by saveUploadState. A part sent again
+// replaces the old one with the same number, parts are sorted by number.
+func parseUploadParts(saved string) ([]common.Part, error) {
+	partByN := make(map[int]common.Part)
+	for _, line := range strings.Split(saved, "\n") {
+		if line == "" {
+			continue
+		}
+		var part common.Part
+		if err := json.Unmarshal([]byte(line), &part); err != nil {
+			return nil, err
+		}
+		partByN[part.N] = part
+	}
+	var parts []common.Part
+	for _, part := range partByN {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+	return parts, nil
+}
+
 func updateTask(taskId string, executorUuid string, status string) {
 	taskIdInt, _ := strconv.ParseInt(taskId, 10, 64)
 	_, err := db.Exec("update task set status = ? where id = ?", status, taskIdInt)
@@ -202,7 +999,8 @@ func updateTask(taskId string, executorUuid string, status string) {
 
 func getJobSummary(jobUuid string) (summary JobResult, err error) {
 	summary.JobUuid = jobUuid
-	rows, err := db.Query("select u.origin_url, u.status from url u "+
+	rows, err := db.Query("select u.origin_url, u.status, u.attempts, u.size, u.md5, u.sha256, "+
+		"u.error_class, u.http_status, u.error_message from url u "+
 		"join task t on u.task_id = t.id "+
 		"join job j on t.job_uuid = j.uuid "+
 		"where j.uuid = ?", jobUuid)
@@ -210,104 +1008,404 @@ func getJobSummary(jobUuid string) (summary JobResult, err error) {
 		logger.Println("Error querying job url status: ", err)
 		return
 	}
-	defer rows.Close()
+	defer rows.Close()
+	for rows.Next() {
+		var url, status string
+		var attempts, size, httpStatus sql.NullInt64
+		var md5, sha256, errorClass, message sql.NullString
+		if err := rows.Scan(&url, &status, &attempts, &size, &md5, &sha256,
+			&errorClass, &httpStatus, &message); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		summary.Files = append(summary.Files, FileResult{
+			Url:        url,
+			Status:     status,
+			Attempts:   attempts.Int64,
+			Size:       size.Int64,
+			MD5:        md5.String,
+			SHA256:     sha256.String,
+			ErrorClass: errorClass.String,
+			HttpStatus: httpStatus.Int64,
+			Message:    message.String,
+		})
+		switch status {
+		case "Finished":
+			summary.SuccessUrls = append(summary.SuccessUrls, url)
+		case "Failed", "ChecksumFailed":
+			summary.FailedUrls = append(summary.FailedUrls, url)
+		case "Pending":
+			summary.PendingUrls = append(summary.PendingUrls, url)
+		case "Cancelled":
+			summary.CancelledUrls = append(summary.CancelledUrls, url)
+		}
+	}
+	err = db.QueryRow("select status from job where uuid = ?", jobUuid).Scan(&summary.Status)
+	if err != nil {
+		logger.Println("Error querying job status: ", err)
+	}
+	summary.Manifest, err = getManifestProgress(jobUuid)
+	if err != nil {
+		logger.Println("Error querying manifest progress: ", err)
+	}
+	return summary, nil
+}
+
+func getJobUuidOfTask(taskId string) (jobUuid string, err error) {
+	err = db.QueryRow("select job_uuid from task where id = ?", taskId).Scan(&jobUuid)
+	return
+}
+
+// getTaskUrls returns origin urls of the task in status
+func getTaskUrls(taskId string, status string) (urls []string) {
+	rows, err := db.Query("select origin_url from url where task_id = ? and status = ?",
+		taskId, status)
+	if err != nil {
+		logger.Println("Error querying urls of task", taskId, "with error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		urls = append(urls, url)
+	}
+	return
+}
+
+func tryFinishJob(taskId string) {
+	var jobUuid string
+	err := db.QueryRow("select job_uuid from task where id = ?", taskId).Scan(&jobUuid)
+	if err != nil {
+		logger.Println("Error querying job uuid: ", err)
+		return
+	}
+	finishJobIfDone(jobUuid)
+}
+
+// finishJobIfDone completes the job if all its tasks are done and its
+// manifest, if any, is expanded. Jobs whose manifest failed are Failed.
+// Blocked jobs are checked again once unblocked, a manifest without entries
+// doesn't complete them before their parents. Jobs whose tasks are being
+// inserted are checked once all are inserted.
+func finishJobIfDone(jobUuid string) {
+	if isInserting(jobUuid) {
+		return
+	}
+	var status string
+	var expanding bool
+	var errorMessage sql.NullString
+	err := db.QueryRow("select status, expanding, manifest_error from job where uuid = ?",
+		jobUuid).Scan(&status, &expanding, &errorMessage)
+	if err != nil {
+		logger.Println("Error querying manifest of job", jobUuid, "with error", err)
+		return
+	}
+	if expanding || status == "Blocked" {
+		return
+	}
+	var failed, finished, total int
+	err = db.QueryRow("select count(*) from task where "+
+		"job_uuid = ? and status = ?", jobUuid, "Finished").Scan(&finished)
+	if err != nil {
+		logger.Println("Error querying finished task number: ", err)
+		return
+	}
+	err = db.QueryRow("select count(*) from task where "+
+		"job_uuid = ? and status = ?", jobUuid, "Failed").Scan(&failed)
+	if err != nil {
+		logger.Println("Error querying failed task number: ", err)
+		return
+	}
+	// tasks whose failed files have been moved to new tasks are not counted
+	err = db.QueryRow("select count(*) from task where "+
+		"job_uuid = ? and status != ?", jobUuid, "Retried").Scan(&total)
+	if err != nil {
+		logger.Println("Error querying total task number: ", err)
+		return
+	}
+	if errorMessage.Valid {
+		failed++
+		total++
+	}
+	if failed+finished == total {
+		var finishedSize int64
+		if finished > 0 {
+			err = db.QueryRow("select sum(u.size) from url u "+
+			    "join task t on u.task_id = t.id "+
+			    "join job j on t.job_uuid = j.uuid "+
+			    "where j.uuid = ? and u.status = ?", jobUuid, "Finished").Scan(&finishedSize)
+			if err != nil {
+				logger.Println("Error get total finished size: ", err)
+				return
+			}
+		}
+
+		// the job is completed only once, by whoever updates it first, and
+		// jobs cancelled meanwhile are left alone
+		var result sql.Result
+		if failed > 0 {
+			result, err = db.Exec("update job set status = ? where "+
+				"uuid = ? and status not in (?, ?, ?)", "Failed", jobUuid,
+				"Finished", "Failed", "Cancelled")
+		} else {
+			result, err = db.Exec("update job set complete_time = NOW(), status = ?, finished_size = ? where "+
+				"uuid = ? and status not in (?, ?, ?)", "Finished", finishedSize, jobUuid,
+				"Finished", "Failed", "Cancelled")
+		}
+		if err != nil {
+			logger.Println("Error updating job status: ", err)
+			return
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return
+		}
+		if failed > 0 {
+			publishJobEvent(jobUuid, "Failed")
+		} else {
+			publishJobEvent(jobUuid, "Finished")
+		}
+		sendJobCallback(jobUuid)
+		releaseChildren(jobUuid)
+	}
+}
+
+// sendJobCallback sends summary of a job to its callback url if there's one
+func sendJobCallback(jobUuid string) {
+	var callbackUrl, callbackToken sql.NullString
+	err := db.QueryRow("select callback_token, callback_url from job where "+
+		"uuid = ?", jobUuid).Scan(&callbackToken, &callbackUrl)
+	if err != nil {
+		logger.Println("Error querying callback info: ", err)
+		return
+	}
+	if !callbackUrl.Valid || callbackUrl.String == "" {
+		return
+	}
+	summary, err := getJobSummary(jobUuid)
+	if err != nil {
+		logger.Println("Error getting job summary for job", jobUuid, "with error", err)
+		return
+	}
+	body, err := json.Marshal(summary)
+	if err != nil {
+		logger.Println("Error marshalling json: ", err)
+		return
+	}
+	queueCallback(jobUuid, callbackUrlWithToken(callbackUrl.String, callbackToken.String), body)
+}
+
+func insertCallback(jobUuid string, url string, body []byte) error {
+	_, err := db.Exec("insert into callback(job_uuid, url, body, status, attempts, "+
+		"create_time, next_time) values(?, ?, ?, ?, 0, NOW(), NOW())",
+		jobUuid, url, string(body), "Pending")
+	return err
+}
+
+// getDueCallbacks returns pending callbacks whose next attempt is due, along
+// with secret keys of job owners to sign them
+func getDueCallbacks(limit int) (callbacks []*callbackDelivery) {
+	rows, err := db.Query("select c.id, c.job_uuid, c.url, c.body, c.attempts, u.secret_key "+
+		"from callback c join job j on c.job_uuid = j.uuid "+
+		"left join user u on j.access_key = u.access_key "+
+		"where c.status = ? and c.next_time <= NOW() order by c.next_time limit ?",
+		"Pending", limit)
+	if err != nil {
+		logger.Println("Error querying due callbacks: ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var callback callbackDelivery
+		var body string
+		var secretKey sql.NullString
+		if err := rows.Scan(&callback.id, &callback.jobUuid, &callback.url, &body,
+			&callback.attempts, &secretKey); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		callback.body = []byte(body)
+		callback.secretKey = secretKey.String
+		callbacks = append(callbacks, &callback)
+	}
+	return
+}
+
+// saveCallbackAttempt records an attempt and updates the callback, nextTime
+// is used only when status is Pending
+func saveCallbackAttempt(callbackId int64, attempt *CallbackAttempt, status string,
+	attempts int, nextTime time.Time) error {
+	_, err := db.Exec("insert into callback_attempt(callback_id, attempt_time, status_code, "+
+		"error, duration) values(?, FROM_UNIXTIME(?), ?, ?, ?)",
+		callbackId, attempt.Time, attempt.StatusCode, attempt.Error, attempt.Duration)
+	if err != nil {
+		return err
+	}
+	if status == "Pending" {
+		_, err = db.Exec("update callback set status = ?, attempts = ?, next_time = FROM_UNIXTIME(?) "+
+			"where id = ?", status, attempts, nextTime.Unix(), callbackId)
+	} else {
+		_, err = db.Exec("update callback set status = ?, attempts = ?, next_time = NULL "+
+			"where id = ?", status, attempts, callbackId)
+	}
+	return err
+}
+
+func getCallbacks(jobUuid string) ([]CallbackResult, error) {
+	rows, err := db.Query("select id, url, status, attempts, UNIX_TIMESTAMP(create_time), "+
+		"UNIX_TIMESTAMP(next_time) from callback where job_uuid = ? order by id", jobUuid)
+	if err != nil {
+		return nil, err
+	}
+	callbacks := []CallbackResult{}
 	for rows.Next() {
-		var url, status string
-		if err := rows.Scan(&url, &status); err != nil {
+		var callback CallbackResult
+		var nextTime sql.NullInt64
+		if err := rows.Scan(&callback.Id, &callback.Url, &callback.Status, &callback.Attempts,
+			&callback.CreateTime, &nextTime); err != nil {
 			logger.Println("Row scan error: ", err)
 			continue
 		}
-		switch status {
-		case "Finished":
-			summary.SuccessUrls = append(summary.SuccessUrls, url)
-		case "Failed":
-			summary.FailedUrls = append(summary.FailedUrls, url)
-		case "Pending":
-			summary.PendingUrls = append(summary.PendingUrls, url)
+		callback.NextTime = nextTime.Int64
+		callback.History = []CallbackAttempt{}
+		callbacks = append(callbacks, callback)
+	}
+	rows.Close()
+	for i := range callbacks {
+		rows, err := db.Query("select UNIX_TIMESTAMP(attempt_time), status_code, error, duration "+
+			"from callback_attempt where callback_id = ? order by id", callbacks[i].Id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var attempt CallbackAttempt
+			var errorMessage sql.NullString
+			if err := rows.Scan(&attempt.Time, &attempt.StatusCode, &errorMessage,
+				&attempt.Duration); err != nil {
+				logger.Println("Row scan error: ", err)
+				continue
+			}
+			attempt.Error = errorMessage.String
+			callbacks[i].History = append(callbacks[i].History, attempt)
 		}
+		rows.Close()
 	}
-	return summary, nil
+	return callbacks, nil
 }
 
-func tryFinishJob(taskId string) {
-	var jobUuid string
-	err := db.QueryRow("select job_uuid from task where id = ?", taskId).Scan(&jobUuid)
+// retriggerCallbacks makes callbacks of the job delivered again from the
+// first attempt, or only the callback callbackId if it's not 0
+func retriggerCallbacks(jobUuid string, callbackId int64) (int64, error) {
+	query := "update callback set status = ?, attempts = 0, next_time = NOW() where job_uuid = ?"
+	args := []interface{}{"Pending", jobUuid}
+	if callbackId != 0 {
+		query += " and id = ?"
+		args = append(args, callbackId)
+	}
+	result, err := db.Exec(query, args...)
 	if err != nil {
-		logger.Println("Error querying job uuid: ", err)
-		return
+		return 0, err
 	}
-	var failed, finished, total int
-	err = db.QueryRow("select count(*) from task where "+
-		"job_uuid = ? and status = ?", jobUuid, "Finished").Scan(&finished)
+	return result.RowsAffected()
+}
+
+func taskLostUpdate(taskId string, executorUuid string) {
+	taskIdInt, _ := strconv.ParseInt(taskId, 10, 64)
+	_, err := db.Exec("update task set status = ?, executor_uuid = NULL, schedule_time = NULL where "+
+		"id = ?", "Pending", taskIdInt)
 	if err != nil {
-		logger.Println("Error querying finished task number: ", err)
-		return
+		logger.Println("Error updating task status for id", taskIdInt, "with error ", err)
 	}
-	err = db.QueryRow("select count(*) from task where "+
-		"job_uuid = ? and status = ?", jobUuid, "Failed").Scan(&failed)
+	// make sure the owner is scheduled, so the task will be run again
+	var uid string
+	err = db.QueryRow("select uid from task where id = ?", taskIdInt).Scan(&uid)
 	if err != nil {
-		logger.Println("Error querying failed task number: ", err)
+		logger.Println("Error querying owner of task", taskIdInt, "with error ", err)
 		return
 	}
-	err = db.QueryRow("select count(*) from task where "+
-		"job_uuid = ?", jobUuid).Scan(&total)
+	err = chkAndAddSchedUser(uid)
 	if err != nil {
-		logger.Println("Error querying total task number: ", err)
-		return
+		logger.Println("Error checking and adding user to sched list: ", err)
 	}
-	if failed+finished == total {
-		var finishedSize int64
-		if finished > 0 {
-			err = db.QueryRow("select sum(u.size) from url u "+
-			    "join task t on u.task_id = t.id "+
-			    "join job j on t.job_uuid = j.uuid "+
-			    "where j.uuid = ? and u.status = ?", jobUuid, "Finished").Scan(&finishedSize)
-			if err != nil {
-				logger.Println("Error get total finished size: ", err)
-				return
-			}
-		}
+}
 
-		if failed > 0 {
-			_, err = db.Exec("update job set status = ? where "+
-				"uuid = ?", "Failed", jobUuid)
-		} else {
-			_, err = db.Exec("update job set complete_time = NOW(), status = ?, finished_size = ? where "+
-				"uuid = ?", "Finished", finishedSize, jobUuid)
-		}
-		if err != nil {
-			logger.Println("Error updating job status: ", err)
-		}
-		var callbackUrl, callbackToken sql.NullString
-		err := db.QueryRow("select callback_token, callback_url from job where "+
-			"uuid = ?", jobUuid).Scan(&callbackToken, &callbackUrl)
-		if err != nil {
-			logger.Println("Error querying callback info: ", err)
-			return
-		}
-		if !callbackUrl.Valid || callbackUrl.String == "" {
-			return
+func getTaskStatus(taskId string) (status string, err error) {
+	err = db.QueryRow("select status from task where id = ?", taskId).Scan(&status)
+	return
+}
+
+// getActiveTasks returns tasks which are scheduled or running, with the slave
+// they are on
+func getActiveTasks() (tasks []*mesosproto.TaskStatus) {
+	rows, err := db.Query("select t.id, e.slave_uuid from task t "+
+		"left join executor e on t.executor_uuid = e.uuid "+
+		"where t.status = ? or t.status = ?", "Scheduled", "Running")
+	if err != nil {
+		logger.Println("Error querying active tasks: ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taskId string
+		var slaveUuid sql.NullString
+		if err := rows.Scan(&taskId, &slaveUuid); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
 		}
-		url := callbackUrl.String
-		if callbackToken.Valid && callbackToken.String != "" {
-			url += "?" + callbackToken.String
+		status := &mesosproto.TaskStatus{
+			TaskId: &mesosproto.TaskID{Value: proto.String(taskId)},
+			State:  mesosproto.TaskState_TASK_RUNNING.Enum(),
 		}
-		summary, err := getJobSummary(jobUuid)
-		if err != nil {
-			logger.Println("Error getting job summary for job", jobUuid, "with error", err)
-			return
+		if slaveUuid.Valid {
+			status.SlaveId = &mesosproto.SlaveID{Value: proto.String(slaveUuid.String)}
 		}
-		putJobCallback(url, &summary)
+		tasks = append(tasks, status)
 	}
+	return
 }
 
-func taskLostUpdate(taskId string, executorUuid string) {
-	taskIdInt, _ := strconv.ParseInt(taskId, 10, 64)
-	_, err := db.Exec("update task set status = ?, executor_uuid = NULL, schedule_time = NULL where "+
-		"id = ?", "Pending", taskIdInt)
+// getRunningTasks returns running tasks with where they run and the limit of
+// their jobs, for rebalancing rates of users
+func getRunningTasks() (tasks []*RunningTask, err error) {
+	rows, err := db.Query("select t.id, t.uid, t.job_uuid, t.executor_uuid, e.slave_uuid, j.max_speed from task t "+
+		"join executor e on t.executor_uuid = e.uuid "+
+		"join job j on t.job_uuid = j.uuid "+
+		"where t.status = ?", "Running")
 	if err != nil {
-		logger.Println("Error updating task status for id", taskIdInt, "with error ", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		task := &RunningTask{}
+		var jobSpeed sql.NullInt64
+		if err := rows.Scan(&task.Id, &task.UId, &task.JobUuid, &task.ExecutorId, &task.SlaveId,
+			&jobSpeed); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		task.JobMaxSpeed = jobSpeed.Int64
+		tasks = append(tasks, task)
+	}
+	err = rows.Err()
+	return
+}
+
+func getFrameworkId(name string) (frameworkId string, err error) {
+	var id sql.NullString
+	err = db.QueryRow("select framework_id from framework where name = ?", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
+	return id.String, err
+}
+
+func saveFrameworkId(name string, frameworkId string) error {
+	_, err := db.Exec("insert into framework(id, name, framework_id) values(?, ?, ?) "+
+		"on duplicate key update framework_id = values(framework_id)", 0, name, frameworkId)
+	return err
 }
 
 func executorLostUpdate(executorUuid string) {
@@ -363,8 +1461,8 @@ func getKeysForUser(userAccessKey string, requestType string) (string, string) {
 		accessKeyColumnName = "s3_ak"
 		secretKeyColumnName = "s3_sk"
 	case "Vaas":
-		accessKeyColumnName = "vaas_ak"
-		secretKeyColumnName = "vaas_sk"
+		accessKeyColumnName = "vass_ak"
+		secretKeyColumnName = "vass_sk"
 	}
 	var ak, sk sql.NullString
 	err := db.QueryRow("select "+accessKeyColumnName+","+secretKeyColumnName+
@@ -453,6 +1551,150 @@ func suspendJob(jobUuid string) error {
 	return nil
 }
 
+var errJobCompleted = errors.New("Job is already completed")
+
+// cancelJob marks a job and all its unfinished tasks and files Cancelled, and
+// returns ids of tasks that have been sent to executors, which should be
+// killed. Updates of those tasks from executors are ignored afterwards.
+func cancelJob(jobUuid string) (activeTasks []string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRow("select status from job where uuid = ? for update", jobUuid).Scan(&status)
+	if err != nil {
+		return nil, err
+	}
+	if status == "Finished" || status == "Failed" || status == "Cancelled" {
+		return nil, errJobCompleted
+	}
+	rows, err := tx.Query("select id, executor_uuid from task where "+
+		"job_uuid = ? and (status = ? or status = ?) for update", jobUuid, "Scheduled", "Running")
+	if err != nil {
+		return nil, err
+	}
+	var executorUuids []string
+	for rows.Next() {
+		var taskId string
+		var executorUuid sql.NullString
+		if err := rows.Scan(&taskId, &executorUuid); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		activeTasks = append(activeTasks, taskId)
+		if executorUuid.Valid {
+			executorUuids = append(executorUuids, executorUuid.String)
+		}
+	}
+	rows.Close()
+	for _, executorUuid := range executorUuids {
+		_, err = tx.Exec("update executor set task_running = task_running - 1 where "+
+			"uuid = ?", executorUuid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Exec("update url u join task t on u.task_id = t.id set u.status = ? "+
+		"where t.job_uuid = ? and u.status = ?", "Cancelled", jobUuid, "Pending")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("update task set status = ? where job_uuid = ? and status in (?, ?, ?, ?, ?)",
+		"Cancelled", jobUuid, "Pending", "Suspended", "Blocked", "Scheduled", "Running")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("update job set status = ?, complete_time = NOW(), expanding = FALSE where uuid = ?",
+		"Cancelled", jobUuid)
+	if err != nil {
+		return nil, err
+	}
+	return activeTasks, tx.Commit()
+}
+
+var errJobNotFailed = errors.New("Job is not failed")
+
+// countFailedUrls returns how many files of the job would be retried by
+// retryJob
+func countFailedUrls(jobUuid string) (count int, err error) {
+	err = db.QueryRow("select count(*) from url u join task t on u.task_id = t.id "+
+		"where t.job_uuid = ? and (u.status = ? or u.status = ?)",
+		jobUuid, "Failed", "ChecksumFailed").Scan(&count)
+	return
+}
+
+// retryJob moves failed files of a failed job into new Pending tasks, which
+// have the same settings as the tasks they were in. The old tasks are marked
+// Retried and no longer count towards job status. If the manifest of the job
+// failed, it's expanding again.
+func retryJob(jobUuid string) (retried int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var status string
+	err = tx.QueryRow("select status from job where uuid = ? for update", jobUuid).Scan(&status)
+	if err != nil {
+		return 0, err
+	}
+	if status != "Failed" {
+		return 0, errJobNotFailed
+	}
+	rows, err := tx.Query("select distinct t.id from task t join url u on u.task_id = t.id "+
+		"where t.job_uuid = ? and (u.status = ? or u.status = ?)", jobUuid, "Failed", "ChecksumFailed")
+	if err != nil {
+		return 0, err
+	}
+	var taskIds []int64
+	for rows.Next() {
+		var taskId int64
+		if err := rows.Scan(&taskId); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		taskIds = append(taskIds, taskId)
+	}
+	rows.Close()
+	for _, taskId := range taskIds {
+		result, err := tx.Exec("insert into task(id, uid, job_uuid, target_type, target_bucket, target_acl, "+
+			"source_type, transfer_mode, threads, status, access_key, secret_key) "+
+			"select 0, uid, job_uuid, target_type, target_bucket, target_acl, source_type, transfer_mode, "+
+			"threads, ?, access_key, secret_key from task where id = ?", "Pending", taskId)
+		if err != nil {
+			return 0, err
+		}
+		newTaskId, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		// upload state is kept, so unfinished multipart uploads are resumed
+		result, err = tx.Exec("update url set task_id = ?, status = ?, attempts = attempts + 1, "+
+			"target_url = NULL, error_class = NULL, http_status = NULL, error_message = NULL "+
+			"where task_id = ? and (status = ? or status = ?)",
+			newTaskId, "Pending", taskId, "Failed", "ChecksumFailed")
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		retried += int(n)
+		_, err = tx.Exec("update task set status = ? where id = ?", "Retried", taskId)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// manifest which failed is read again from where it stopped
+	_, err = tx.Exec("update job set status = ?, complete_time = NULL, "+
+		"expanding = manifest_error is not null, manifest_error = NULL where uuid = ?",
+		"Pending", jobUuid)
+	if err != nil {
+		return 0, err
+	}
+	return retried, tx.Commit()
+}
+
 func resumeJob(jobUuid string) error {
 	_, err := db.Exec("update task t join job j on t.job_uuid = j.uuid "+
 		"set t.status = ?, j.status = ? "+
@@ -464,25 +1706,52 @@ func resumeJob(jobUuid string) error {
 	return nil
 }
 
-func getUserTimeSpans(ak string, spans *[]Span) error {
-	rows, err := db.Query("select start, end from schedule where access_key = ?", ak)
+// getUserSchedule reads schedule of the user, schedules with bad timezone
+// are ignored
+func getUserSchedule(ak string) (*Schedule, error) {
+	rows, err := db.Query("select timezone, action, days, start_minute, end_minute, start, end "+
+		"from schedule where access_key = ? order by id", ak)
 	if err != nil {
 		logger.Println("Error querying table schedule:", err)
-		return err
+		return nil, err
 	}
 	defer rows.Close()
+	schedule := &Schedule{}
 	for rows.Next() {
-		var span Span
-		if err := rows.Scan(&span.Start, &span.End); err != nil {
+		window := &Window{}
+		var days string
+		var startHour, endHour int
+		if err := rows.Scan(&schedule.Timezone, &window.Action, &days,
+			&window.start, &window.end, &startHour, &endHour); err != nil {
 			logger.Println("Row scan error:", err)
 			continue
 		}
-		*spans = append(*spans, span)
+		if window.Action == "" {
+			// span saved by the old API, see scheduleFromSpans
+			schedule.Timezone = "Local"
+			window.Action = ScheduleDeny
+			window.start, window.end = startHour*60, endHour*60
+		}
+		for _, day := range strings.Split(days, ",") {
+			if d, err := strconv.Atoi(day); err == nil {
+				window.Days = append(window.Days, d)
+			}
+		}
+		window.Start = formatClock(window.start)
+		window.End = formatClock(window.end)
+		schedule.Windows = append(schedule.Windows, window)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := schedule.validate(); err != nil {
+		logger.Println("Bad schedule of user", ak, "with error", err)
+		return &Schedule{}, nil
+	}
+	return schedule, nil
 }
 
-func delAndInsertScheTable(accessKey string, spans []Span) error {
+func saveUserSchedule(accessKey string, schedule *Schedule) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -492,20 +1761,24 @@ func delAndInsertScheTable(accessKey string, spans []Span) error {
 		tx.Rollback()
 		return err
 	}
-	for i := 0; i< len(spans); i++ {
-		_, err := tx.Exec("insert into schedule(access_key, start, end) " +
-		    "values(?, ?, ?)", accessKey, spans[i].Start, spans[i].End)
+	for _, window := range schedule.Windows {
+		var days []string
+		for _, day := range window.Days {
+			days = append(days, strconv.Itoa(day))
+		}
+		_, err := tx.Exec("insert into schedule(access_key, timezone, action, days, "+
+			"start_minute, end_minute) values(?, ?, ?, ?, ?, ?)", accessKey, schedule.Timezone,
+			window.Action, strings.Join(days, ","), window.start, window.end)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
 
 func queryJobList(accessKey string, stime string, etime string, status int, jobid string, result *[]JobList) error {
-	sql := "select uuid, create_time, complete_time, status from job where access_key = \"" + accessKey + "\""
+	sql := "select uuid, create_time, complete_time, status, parent_uuid from job where access_key = \"" + accessKey + "\""
 	if len(stime) != 0 {
 		sql = sql + " AND create_time > FROM_UNIXTIME(" + stime + ")"
 	}
@@ -527,6 +1800,9 @@ func queryJobList(accessKey string, stime string, etime string, status int, jobi
 	if status & 8 != 0 {
 		sql = sql + " AND status = \"Scheduled\""
 	}
+	if status & 16 != 0 {
+		sql = sql + " AND status = \"Cancelled\""
+	}
 	sql += " order by create_time desc limit 1000"
 	logger.Println("EqueryJobList:", sql)
 	rows, err := db.Query(sql)
@@ -539,7 +1815,8 @@ func queryJobList(accessKey string, stime string, etime string, status int, jobi
 		var job JobList
 		var rawCreateTime []byte
 		var rawCompleteTime []byte
-		if err := rows.Scan(&job.JobUuid, &rawCreateTime, &rawCompleteTime, &job.Status); err != nil {
+		var rawParent []byte
+		if err := rows.Scan(&job.JobUuid, &rawCreateTime, &rawCompleteTime, &job.Status, &rawParent); err != nil {
 			logger.Println("Row scan error:", err)
 			continue
 		}
@@ -568,6 +1845,7 @@ func queryJobList(accessKey string, stime string, etime string, status int, jobi
 		} else  {
 			job.CompleteTime = 0
 		}
+		job.Parent = string(rawParent)
 		*result = append(*result, job)
 	}
 	return nil
@@ -603,26 +1881,6 @@ func queryScheduledJobUuids(accessKey string, jobUuids *[]string) error {
 	return nil
 }
 
-func queryRunningUrls(jobUuid string, urls *[]string) error {
-	rows, err := db.Query("select u.origin_url from url u "+
-	    " join task t on u.task_id = t.id join job j on t.job_uuid = j.uuid "+
-		"  where j.uuid = ? and t.status = ?", jobUuid, "Running")
-	if err != nil {
-		logger.Println("Error querying running tasks:", err)
-		return err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var url string
-		if err := rows.Scan(&url); err != nil {
-			logger.Println("Row scan error:", err)
-			continue
-		}
-		*urls = append(*urls, url)
-	}
-	return nil
-}
-
 func getPendingUsers(aks *[]string) error {
 	rows, err := db.Query("select distinct(access_key) from job "+
 	"  where status = ? or status = ?", "Pending", "Scheduled")
@@ -653,6 +1911,167 @@ func getUserPriority(ak string) (int, error) {
 	return priority, nil
 }
 
+func getUserWeight(ak string) (int, error) {
+	weight := 1
+	err := db.QueryRow("select weight from user where "+
+		"access_key = ?", ak).Scan(&weight)
+	if err != nil {
+		return 1, err
+	}
+	if weight < 1 {
+		weight = 1
+	}
+	return weight, nil
+}
+
+var errUserNotFound = errors.New("User not found")
+
+func setUserWeight(ak string, weight int) error {
+	result, err := db.Exec("update user set weight = ? where access_key = ?", weight, ak)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		// MySQL doesn't count rows not changed, tell them from missing users
+		var id int64
+		err = db.QueryRow("select id from user where access_key = ?", ak).Scan(&id)
+		if err == sql.ErrNoRows {
+			return errUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+	}
+	updateSchedUserWeight(ak, weight)
+	return nil
+}
+
+// getUserTaskCounts returns number of scheduled or running tasks, and number
+// of pending tasks, of every user
+func getUserTaskCounts() (running map[string]int, pending map[string]int, err error) {
+	rows, err := db.Query("select uid, status, count(*) from task "+
+		"where status in (?, ?, ?) group by uid, status", "Pending", "Scheduled", "Running")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	running = make(map[string]int)
+	pending = make(map[string]int)
+	for rows.Next() {
+		var uid, status string
+		var count int
+		if err := rows.Scan(&uid, &status, &count); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		if status == "Pending" {
+			pending[uid] += count
+		} else {
+			running[uid] += count
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// getUserShares returns users with pending or running tasks, shares are
+// filled by caller
+func getUserShares() (users []*UserShare, err error) {
+	rows, err := db.Query("select u.access_key, u.priority, u.weight, t.status, count(*) from task t "+
+		"join user u on t.uid = u.access_key where t.status in (?, ?, ?) "+
+		"group by u.access_key, u.priority, u.weight, t.status order by u.access_key",
+		"Pending", "Scheduled", "Running")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	users = []*UserShare{}
+	var user *UserShare
+	for rows.Next() {
+		var ak, status string
+		var priority, weight, count int
+		if err := rows.Scan(&ak, &priority, &weight, &status, &count); err != nil {
+			logger.Println("Row scan error: ", err)
+			continue
+		}
+		if user == nil || user.AccessKey != ak {
+			if weight < 1 {
+				weight = 1
+			}
+			user = &UserShare{AccessKey: ak, Priority: priority, Weight: weight}
+			users = append(users, user)
+		}
+		if status == "Pending" {
+			user.Pending += count
+		} else {
+			user.Running += count
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func getUserQuota(ak string) (*Quota, error) {
+	quota := &Quota{}
+	err := db.QueryRow("select max_running_tasks, max_queued_urls, daily_bytes, monthly_bytes "+
+		"from user where access_key = ?", ak).Scan(&quota.MaxRunningTasks,
+		&quota.MaxQueuedUrls, &quota.DailyBytes, &quota.MonthlyBytes)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+func setUserQuota(ak string, quota *Quota) error {
+	result, err := db.Exec("update user set max_running_tasks = ?, max_queued_urls = ?, "+
+		"daily_bytes = ?, monthly_bytes = ? where access_key = ?", quota.MaxRunningTasks,
+		quota.MaxQueuedUrls, quota.DailyBytes, quota.MonthlyBytes, ak)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		_, err = getUserQuota(ak)
+		return err
+	}
+	return nil
+}
+
+func getUserUsage(ak string) (*Usage, error) {
+	usage := &Usage{}
+	err := db.QueryRow("select count(*) from task where uid = ? and status in (?, ?)",
+		ak, "Scheduled", "Running").Scan(&usage.RunningTasks)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("select count(*) from url u join task t on u.task_id = t.id "+
+		"where t.uid = ? and u.status not in (?, ?, ?, ?)",
+		ak, "Finished", "Failed", "ChecksumFailed", "Cancelled").Scan(&usage.QueuedUrls)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("select ifnull(sum(if(day = CURDATE(), bytes, 0)), 0), ifnull(sum(bytes), 0) "+
+		"from user_usage where access_key = ? and day >= DATE_FORMAT(CURDATE(), '%Y-%m-01')",
+		ak).Scan(&usage.DailyBytes, &usage.MonthlyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// addUserUsage counts size bytes of a finished file in the task to usage of
+// its owner today
+func addUserUsage(taskId int64, size int64) {
+	_, err := db.Exec("insert into user_usage(access_key, day, bytes) "+
+		"select uid, CURDATE(), ? from task where id = ? "+
+		"on duplicate key update bytes = bytes + values(bytes)", size, taskId)
+	if err != nil {
+		logger.Println("Error adding usage of task", taskId, "with error", err)
+	}
+}
+
 func clearExecutors() {
 	_, err := db.Exec("update executor set status = ?", "Lost")
 	if err != nil {
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+func Test_ParseUploadParts(t *testing.T) {
+	saved := `{"n":2,"etag":"b","size":10}
+{"n":1,"etag":"a","size":10}
+{"n":2,"etag":"c","size":10}
+`
+	parts, err := parseUploadParts(saved)
+	if err != nil {
+		t.Fatal("Error parsing parts:", err)
+	}
+	expected := []common.Part{{N: 1, ETag: "a", Size: 10}, {N: 2, ETag: "c", Size: 10}}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Error("Parts parsed:", parts, "expected:", expected)
+	}
+	if parts, err = parseUploadParts(""); err != nil || len(parts) != 0 {
+		t.Error("Parts of empty string:", parts, err)
+	}
+	if _, err = parseUploadParts("[]"); err == nil {
+		t.Error("Malformed parts should not be parsed")
+	}
+}
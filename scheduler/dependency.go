@@ -0,0 +1,66 @@
+package main
+
+// Jobs submitted with "depends-on" are Blocked, and so are their tasks, until
+// all parent jobs are Finished. Every time a job completes, its Blocked
+// children are checked again. A failed parent keeps children Blocked, since
+// it may be retried, unless the children are cancelled on parent failure.
+
+// checkDependencies unblocks the job if all its parents are Finished, or
+// cancels it if a parent failed or was cancelled and it's cancelled on parent
+// failure
+func checkDependencies(jobUuid string) {
+	parents, cancelOnFailure, err := getJobParents(jobUuid)
+	if err != nil {
+		logger.Println("Error querying parents of job", jobUuid, "with error", err)
+		return
+	}
+	unfinished := 0
+	for parent, status := range parents {
+		switch status {
+		case "Finished":
+		case "Failed", "Cancelled":
+			if cancelOnFailure {
+				logger.Println("Cancel job", jobUuid, "since parent job", parent, "is", status)
+				err = sched.cancelJob(jobUuid)
+				if err != nil && err != errJobCompleted {
+					logger.Println("Error cancelling job", jobUuid, "with error", err)
+				}
+				return
+			}
+			unfinished++
+		default:
+			unfinished++
+		}
+	}
+	if unfinished > 0 {
+		return
+	}
+	accessKey, err := unblockJob(jobUuid)
+	if err != nil {
+		logger.Println("Error unblocking job", jobUuid, "with error", err)
+		return
+	}
+	if accessKey == "" {
+		return
+	}
+	logger.Println("Job", jobUuid, "is unblocked")
+	publishJobEvent(jobUuid, "Pending")
+	// jobs whose manifest has no entries, or failed, have no tasks to run
+	finishJobIfDone(jobUuid)
+	err = chkAndAddSchedUser(accessKey)
+	if err != nil {
+		logger.Println("Error checking and adding user to sched list: ", err)
+	}
+}
+
+// releaseChildren checks Blocked children of the completed job
+func releaseChildren(jobUuid string) {
+	children, err := getBlockedChildren(jobUuid)
+	if err != nil {
+		logger.Println("Error querying children of job", jobUuid, "with error", err)
+		return
+	}
+	for _, child := range children {
+		checkDependencies(child)
+	}
+}
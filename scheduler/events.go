@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// Event is a change of a job or its files, pushed to clients of GET /events.
+// Events come from status updates and framework messages of executors.
+type Event struct {
+	Type    string `json:"type"` // in file/progress/job
+	JobUuid string `json:"jobid"`
+	Url     string `json:"url,omitempty"`
+	// for file events in Queued/Downloading/Uploading/Finished/Failed/
+	// ChecksumFailed/Cancelled, for job events the job status
+	Status     string `json:"status,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Speed      int    `json:"speed,omitempty"`
+	Percentage int    `json:"percentage,omitempty"`
+	ErrorClass string `json:"error-class,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Time       int64  `json:"time"`
+}
+
+// events published to a slow subscriber are dropped once its buffer is full
+const eventBufferSize = 256
+
+// eventHub passes events to subscribers of the job
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[string]map[chan *Event]bool // keyed by job uuid
+	taskJobs    map[int64]string                // job uuid of tasks, cache of database
+}
+
+var events = &eventHub{
+	subscribers: make(map[string]map[chan *Event]bool),
+	taskJobs:    make(map[int64]string),
+}
+
+func (hub *eventHub) subscribe(jobUuid string) chan *Event {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	ch := make(chan *Event, eventBufferSize)
+	if hub.subscribers[jobUuid] == nil {
+		hub.subscribers[jobUuid] = make(map[chan *Event]bool)
+	}
+	hub.subscribers[jobUuid][ch] = true
+	return ch
+}
+
+func (hub *eventHub) unsubscribe(jobUuid string, ch chan *Event) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	delete(hub.subscribers[jobUuid], ch)
+	if len(hub.subscribers[jobUuid]) == 0 {
+		delete(hub.subscribers, jobUuid)
+	}
+}
+
+// idle tells whether nobody is listening, so events need not be built
+func (hub *eventHub) idle() bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return len(hub.subscribers) == 0
+}
+
+func (hub *eventHub) publish(event *Event) {
+	event.Time = time.Now().Unix()
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	for ch := range hub.subscribers[event.JobUuid] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (hub *eventHub) jobOfTask(taskId int64) string {
+	hub.lock.Lock()
+	jobUuid, ok := hub.taskJobs[taskId]
+	hub.lock.Unlock()
+	if ok {
+		return jobUuid
+	}
+	jobUuid, err := getJobUuidOfTask(strconv.FormatInt(taskId, 10))
+	if err != nil {
+		logger.Println("Error querying job of task", taskId, "with error", err)
+		return ""
+	}
+	hub.lock.Lock()
+	hub.taskJobs[taskId] = jobUuid
+	hub.lock.Unlock()
+	return jobUuid
+}
+
+// forgetTask drops the cached job of a task which has exited
+func (hub *eventHub) forgetTask(taskId string) {
+	id, _ := strconv.ParseInt(taskId, 10, 64)
+	hub.lock.Lock()
+	delete(hub.taskJobs, id)
+	hub.lock.Unlock()
+}
+
+func publishUrlEvent(update *common.UrlUpdate) {
+	if events.idle() {
+		return
+	}
+	// an Uploading update with upload state is a checkpoint, not a transition
+	if update.Status == "Uploading" && update.Upload != nil {
+		return
+	}
+	event := &Event{
+		Type:       "file",
+		JobUuid:    events.jobOfTask(update.TaskId),
+		Url:        update.OriginUrl,
+		Status:     update.Status,
+		Size:       update.Size,
+		ErrorClass: update.ErrorClass,
+		Message:    update.Message,
+	}
+	events.publish(event)
+}
+
+func publishProgressEvent(report *common.ProgressReport) {
+	if events.idle() {
+		return
+	}
+	events.publish(&Event{
+		Type:       "progress",
+		JobUuid:    report.JobUuid,
+		Url:        report.Info.Url,
+		Size:       report.Info.Size,
+		Speed:      report.Info.Speed,
+		Percentage: report.Info.Percentage,
+	})
+}
+
+// publishRequeuedEvents tells files of a lost task are Queued again
+func publishRequeuedEvents(taskId string) {
+	if events.idle() {
+		return
+	}
+	jobUuid, err := getJobUuidOfTask(taskId)
+	if err != nil {
+		logger.Println("Error querying job of task", taskId, "with error", err)
+		return
+	}
+	for _, url := range getTaskUrls(taskId, "Pending") {
+		events.publish(&Event{Type: "file", JobUuid: jobUuid, Url: url, Status: "Queued"})
+	}
+}
+
+func publishJobEvent(jobUuid string, status string) {
+	if events.idle() {
+		return
+	}
+	events.publish(&Event{Type: "job", JobUuid: jobUuid, Status: status})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// With CONFIG.SchedulePolicy "fairshare", tasks of an offer are shared by all
+// users with pending tasks instead of going to the user with the highest
+// priority. Every slot goes to the user with the least running tasks per
+// weight, so over time running tasks of users are in proportion to their
+// weights (user.weight, 1 by default) and a large user can't starve others.
+
+const (
+	SchedulePolicyPriority  = "priority"
+	SchedulePolicyFairShare = "fairshare"
+)
+
+type UserShare struct {
+	AccessKey string  `json:"access-key"`
+	Priority  int     `json:"priority"`
+	Weight    int     `json:"weight"`
+	Running   int     `json:"running"` // tasks scheduled or running
+	Pending   int     `json:"pending"`
+	Share     float64 `json:"share"`  // entitled ratio of running tasks, by weight
+	Actual    float64 `json:"actual"` // ratio of running tasks actually taken
+}
+
+type SharesResponse struct {
+	Policy string       `json:"policy"`
+	Users  []*UserShare `json:"users"`
+}
+
+func getFairSharePendingTasks(tx *sql.Tx, limit int) (tasks []*common.TransferTask) {
+	if limit == 0 {
+		return
+	}
+	running, pending, err := getUserTaskCounts()
+	if err != nil {
+		logger.Println("Error counting tasks of users: ", err)
+		return
+	}
+	var users []schedUserInfo
+	for _, user := range getActiveSchedUsers(time.Now()) {
+		if pending[user.ak] == 0 {
+			removeSchedUser(user.ak)
+			continue
+		}
+		slots := taskSlotsOfUser(user.ak)
+		if slots == 0 {
+			continue
+		}
+		if slots > 0 && slots < pending[user.ak] {
+			pending[user.ak] = slots
+		}
+		users = append(users, user)
+	}
+	slots := allocateSlots(users, running, pending, limit)
+	for _, user := range users {
+		if slots[user.ak] == 0 {
+			continue
+		}
+		userTasks := getPendingTasks(user.ak, tx, slots[user.ak])
+		if len(userTasks) == 0 {
+			removeSchedUser(user.ak)
+			continue
+		}
+		tasks = append(tasks, userTasks...)
+	}
+	return
+}
+
+// allocateSlots gives limit slots to users one by one, every time to the user
+// with the least running tasks per weight, who has pending tasks left
+func allocateSlots(users []schedUserInfo, running map[string]int, pending map[string]int,
+	limit int) map[string]int {
+	slots := make(map[string]int)
+	for ; limit > 0; limit-- {
+		best := -1
+		var bestLoad float64
+		for i, user := range users {
+			if slots[user.ak] >= pending[user.ak] {
+				continue
+			}
+			load := float64(running[user.ak]+slots[user.ak]) / float64(user.weight)
+			if best == -1 || load < bestLoad {
+				best = i
+				bestLoad = load
+			}
+		}
+		if best == -1 {
+			break
+		}
+		slots[users[best].ak]++
+	}
+	return slots
+}
+
+// getShares returns entitled and actual shares of users with pending or
+// running tasks
+func getShares() (*SharesResponse, error) {
+	users, err := getUserShares()
+	if err != nil {
+		return nil, err
+	}
+	var totalWeight, totalRunning int
+	for _, user := range users {
+		totalWeight += user.Weight
+		totalRunning += user.Running
+	}
+	for _, user := range users {
+		if totalWeight > 0 {
+			user.Share = float64(user.Weight) / float64(totalWeight)
+		}
+		if totalRunning > 0 {
+			user.Actual = float64(user.Running) / float64(totalRunning)
+		}
+	}
+	policy := CONFIG.SchedulePolicy
+	if policy != SchedulePolicyFairShare {
+		policy = SchedulePolicyPriority
+	}
+	return &SharesResponse{Policy: policy, Users: users}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_AllocateSlots(t *testing.T) {
+	users := []schedUserInfo{{ak: "a", weight: 1}, {ak: "b", weight: 3}}
+	cases := []struct {
+		running map[string]int
+		pending map[string]int
+		limit   int
+		slots   map[string]int
+	}{
+		// slots are split by weight
+		{map[string]int{}, map[string]int{"a": 10, "b": 10}, 8,
+			map[string]int{"a": 2, "b": 6}},
+		// users with less running tasks per weight go first
+		{map[string]int{"a": 0, "b": 6}, map[string]int{"a": 10, "b": 10}, 4,
+			map[string]int{"a": 3, "b": 1}},
+		// slots a user has no pending tasks for go to others
+		{map[string]int{}, map[string]int{"a": 10, "b": 1}, 4,
+			map[string]int{"a": 3, "b": 1}},
+		// limit is not reached if there're not enough pending tasks
+		{map[string]int{}, map[string]int{"a": 1, "b": 1}, 4,
+			map[string]int{"a": 1, "b": 1}},
+		{map[string]int{}, map[string]int{}, 4, map[string]int{}},
+		{map[string]int{}, map[string]int{"a": 10, "b": 10}, 0, map[string]int{}},
+	}
+	for _, c := range cases {
+		slots := allocateSlots(users, c.running, c.pending, c.limit)
+		if !reflect.DeepEqual(slots, c.slots) {
+			t.Error("Slots of", c.running, c.pending, c.limit, "should be", c.slots,
+				"but got", slots)
+		}
+	}
+}
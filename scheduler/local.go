@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/mesosproto"
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// localBackend runs executors as child processes on the scheduler's machine,
+// so Optimus could work without a Mesos cluster, e.g. for development and CI.
+// Resources configured by LocalCpus/LocalMemory/LocalDisk are offered to
+// scheduler every second, and each executor runs in its own directory under
+// LocalWorkDirectory like a Mesos sandbox.
+type localBackend struct {
+	scheduler *Scheduler
+	slaveId   string
+	hostname  string
+	offers    int
+
+	lock      sync.Mutex
+	executors map[string]*localExecutor // keyed by executor id
+
+	events chan func() // calls into scheduler, run one by one by Run()
+	stop   chan bool
+}
+
+type localExecutor struct {
+	id      string
+	info    *mesosproto.ExecutorInfo
+	cmd     *exec.Cmd
+	encoder *json.Encoder // writes to fd 3 of executor
+	tasks   map[string]*mesosproto.TaskInfo
+}
+
+func newLocalBackend(scheduler *Scheduler) (ClusterBackend, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if CONFIG.LocalWorkDirectory == "" {
+		return nil, errors.New("LocalWorkDirectory is not configured")
+	}
+	return &localBackend{
+		scheduler: scheduler,
+		slaveId:   "local-" + hostname,
+		hostname:  hostname,
+		executors: make(map[string]*localExecutor),
+		events:    make(chan func(), 1024),
+		stop:      make(chan bool),
+	}, nil
+}
+
+func (backend *localBackend) Run() error {
+	logger.Println("Local backend started on", backend.hostname)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-backend.events:
+			event()
+		case <-ticker.C:
+			backend.offer()
+		case <-backend.stop:
+			logger.Println("Local backend stopped")
+			return nil
+		}
+	}
+}
+
+func (backend *localBackend) Stop() {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	for _, executor := range backend.executors {
+		executor.send(&common.LocalMessage{Type: common.LocalMsgShutdown})
+	}
+	close(backend.stop)
+}
+
+func scalarResources(resources []*mesosproto.Resource) (cpus, mem, disk float64) {
+	for _, resource := range resources {
+		switch resource.GetName() {
+		case "cpus":
+			cpus += resource.GetScalar().GetValue()
+		case "mem":
+			mem += resource.GetScalar().GetValue()
+		case "disk":
+			disk += resource.GetScalar().GetValue()
+		}
+	}
+	return
+}
+
+// offer resources not used by executors and their tasks to scheduler
+func (backend *localBackend) offer() {
+	backend.lock.Lock()
+	cpus, mem, disk := CONFIG.LocalCpus, CONFIG.LocalMemory, CONFIG.LocalDisk
+	for _, executor := range backend.executors {
+		c, m, d := scalarResources(executor.info.GetResources())
+		cpus, mem, disk = cpus-c, mem-m, disk-d
+		for _, task := range executor.tasks {
+			c, m, d := scalarResources(task.GetResources())
+			cpus, mem, disk = cpus-c, mem-m, disk-d
+		}
+	}
+	backend.offers++
+	offer := &Offer{
+		Id:       backend.slaveId + "-" + strconv.Itoa(backend.offers),
+		SlaveId:  backend.slaveId,
+		Hostname: backend.hostname,
+		Cpus:     cpus,
+		Mem:      mem,
+		Disk:     disk,
+	}
+	backend.lock.Unlock()
+
+	backend.scheduler.resourceOffers([]*Offer{offer})
+}
+
+func (backend *localBackend) LaunchTasks(offerId string, tasks []*mesosproto.TaskInfo) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	for _, task := range tasks {
+		executorId := task.GetExecutor().GetExecutorId().GetValue()
+		executor, ok := backend.executors[executorId]
+		if !ok {
+			var err error
+			executor, err = backend.startExecutor(task.GetExecutor())
+			if err != nil {
+				logger.Println("Error starting executor", executorId, "with error", err)
+				// called from Run(), so the update must be posted asynchronously
+				go backend.post(task.GetTaskId().GetValue(), executorId, mesosproto.TaskState_TASK_LOST)
+				continue
+			}
+			backend.executors[executorId] = executor
+		}
+		executor.tasks[task.GetTaskId().GetValue()] = task
+		executor.send(&common.LocalMessage{
+			Type:   common.LocalMsgLaunch,
+			TaskId: task.GetTaskId().GetValue(),
+			Name:   task.GetName(),
+			Data:   task.GetData(),
+		})
+	}
+	return nil
+}
+
+func (backend *localBackend) DeclineOffer(offerId string) {
+	// resources not used are offered again next time
+}
+
+func (backend *localBackend) KillTask(taskId string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	for _, executor := range backend.executors {
+		if _, ok := executor.tasks[taskId]; ok {
+			return executor.send(&common.LocalMessage{Type: common.LocalMsgKill, TaskId: taskId})
+		}
+	}
+	return errors.New("Task " + taskId + " is not running")
+}
+
+func (backend *localBackend) SendFrameworkMessage(executorId string, slaveId string,
+	message string) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	executor, ok := backend.executors[executorId]
+	if !ok {
+		return errors.New("Executor " + executorId + " is not running")
+	}
+	return executor.send(&common.LocalMessage{Type: common.LocalMsgFramework, Message: message})
+}
+
+// post a status update of task to scheduler
+func (backend *localBackend) post(taskId string, executorId string, state mesosproto.TaskState) {
+	status := &mesosproto.TaskStatus{
+		TaskId:     &mesosproto.TaskID{Value: proto.String(taskId)},
+		State:      state.Enum(),
+		SlaveId:    &mesosproto.SlaveID{Value: proto.String(backend.slaveId)},
+		ExecutorId: &mesosproto.ExecutorID{Value: proto.String(executorId)},
+	}
+	backend.events <- func() {
+		backend.scheduler.statusUpdate(status)
+	}
+}
+
+// start executor process in its own directory. Like Mesos, arguments of the
+// command are passed as the whole argv, "--local true" is appended to tell
+// executor to talk to scheduler through fd 3 and 4.
+func (backend *localBackend) startExecutor(info *mesosproto.ExecutorInfo) (*localExecutor, error) {
+	executorId := info.GetExecutorId().GetValue()
+	dir := filepath.Join(CONFIG.LocalWorkDirectory, executorId)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	command, err := filepath.Abs(info.GetCommand().GetValue())
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		return nil, err
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		return nil, err
+	}
+	defer stderr.Close()
+	// toExecutor is fd 3 of executor, fromExecutor is fd 4
+	toExecutorR, toExecutorW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer toExecutorR.Close()
+	fromExecutorR, fromExecutorW, err := os.Pipe()
+	if err != nil {
+		toExecutorW.Close()
+		return nil, err
+	}
+	defer fromExecutorW.Close()
+
+	cmd := exec.Command(command)
+	cmd.Args = append(append([]string{}, info.GetCommand().GetArguments()...), "--local", "true")
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{toExecutorR, fromExecutorW}
+	err = cmd.Start()
+	if err != nil {
+		toExecutorW.Close()
+		fromExecutorR.Close()
+		return nil, err
+	}
+	logger.Println("Started executor", executorId, "with pid", cmd.Process.Pid)
+
+	executor := &localExecutor{
+		id:      executorId,
+		info:    info,
+		cmd:     cmd,
+		encoder: json.NewEncoder(toExecutorW),
+		tasks:   make(map[string]*mesosproto.TaskInfo),
+	}
+	go backend.watch(executor, fromExecutorR, toExecutorW)
+	return executor, nil
+}
+
+// watch reads messages from executor until it exits
+func (backend *localBackend) watch(executor *localExecutor, r *os.File, w *os.File) {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg common.LocalMessage
+		err := decoder.Decode(&msg)
+		if err != nil {
+			break
+		}
+		switch msg.Type {
+		case common.LocalMsgStatus:
+			state, ok := mesosproto.TaskState_value[msg.State]
+			if !ok {
+				logger.Println("Unknown task state from executor", executor.id, ":", msg.State)
+				continue
+			}
+			switch mesosproto.TaskState(state) {
+			case mesosproto.TaskState_TASK_FINISHED, mesosproto.TaskState_TASK_FAILED,
+				mesosproto.TaskState_TASK_KILLED, mesosproto.TaskState_TASK_LOST,
+				mesosproto.TaskState_TASK_ERROR:
+				backend.lock.Lock()
+				delete(executor.tasks, msg.TaskId)
+				backend.lock.Unlock()
+			}
+			backend.post(msg.TaskId, executor.id, mesosproto.TaskState(state))
+		case common.LocalMsgFramework:
+			message := msg.Message
+			backend.events <- func() {
+				backend.scheduler.frameworkMessage(executor.id, backend.slaveId, message)
+			}
+		default:
+			logger.Println("Unknown message from executor", executor.id, ":", msg.Type)
+		}
+	}
+	r.Close()
+	w.Close()
+	err := executor.cmd.Wait()
+	logger.Println("Executor", executor.id, "exited with", err)
+
+	backend.lock.Lock()
+	delete(backend.executors, executor.id)
+	var lostTasks []string
+	for taskId := range executor.tasks {
+		lostTasks = append(lostTasks, taskId)
+	}
+	backend.lock.Unlock()
+	for _, taskId := range lostTasks {
+		backend.post(taskId, executor.id, mesosproto.TaskState_TASK_LOST)
+	}
+	backend.events <- func() {
+		backend.scheduler.executorLost(executor.id)
+	}
+}
+
+func (executor *localExecutor) send(msg *common.LocalMessage) error {
+	err := executor.encoder.Encode(msg)
+	if err != nil {
+		logger.Println("Error sending message to executor", executor.id, "with error", err)
+	}
+	return err
+}
@@ -3,9 +3,6 @@ package main
 import (
 	"database/sql"
 	"flag"
-	"github.com/gogo/protobuf/proto"
-	"github.com/mesos/mesos-go/mesosproto"
-	"github.com/mesos/mesos-go/scheduler"
 	"github.com/garyburd/redigo/redis"
 	"github.com/FZambia/go-sentinel"
 	"log"
@@ -15,6 +12,7 @@ import (
 	"legitlab.letv.cn/optimus/optimus/common"
 	"time"
 	"os/signal"
+	"sync"
 	"syscall"
 	"errors"
 )
@@ -23,15 +21,18 @@ var (
 	CONFIG        Config
 	logger        *log.Logger
 	db            *sql.DB
-	pool          *redis.Pool
 	requestBuffer chan TransferRequest
 	cluster       map[string]string
-	userMaxSpeed  map[string]int64
+	userMaxSpeed  map[string]int64 // limits of users in bytes per second, guarded by userSpeedLock
+	userSpeedLock sync.RWMutex
+	sched         *Scheduler
 )
 
 type Config struct {
 	LogDirectory             string
+	Backend                  string // where tasks run, "mesos"(default) or "local"
 	MesosMaster              string
+	FailoverTimeout          time.Duration // how long tasks on Mesos survive scheduler being away
 	ExecutorUrl              string
 	ExecuteCommand           string
 	ApiBindAddress           string
@@ -39,15 +40,37 @@ type Config struct {
 	WebRoot                  string
 	RedisMasterName          string
 	RedisAddress             []string
+	ProgressStore            string        // where progress of files is kept, in memory/redis/sentinel
+	ProgressTTL              time.Duration // how long progress of a file is kept after last update
+	VaasAddress              string // endpoint of Vaas service, e.g. http://vaas.example.com
 	ApiAuthGraceTime         time.Duration // allowed time-shift for x-date header
 	RequestBufferSize        int
 	FilesPerTask             int
+	DownloadThreads          int // default number of parallel connections per file on executors
 	ExecutorIdleThreshold    int           // if an executor has taskRunning < THRESHOLD, treat it as idle
+	SchedulePolicy           string        // how users share resources, "priority"(default) or "fairshare"
+	AdminUsers               []string      // access keys allowed to call admin APIs, e.g. /shares
 	TaskScheduleTimeout      time.Duration // if a task has been scheduled for certain time and not
 	// become "Running", consider it as lost and reschedule it
 	CpuPerExecutor float64
 	MemoryPerTask  float64
 	DiskPerTask    float64
+	// resources of local backend, and directory where executors run in
+	LocalCpus          float64
+	LocalMemory        float64
+	LocalDisk          float64
+	LocalWorkDirectory string
+	// callbacks are retried after CallbackRetryInterval, doubled every time
+	CallbackTimeout       time.Duration
+	CallbackRetryInterval time.Duration
+	CallbackMaxAttempts   int
+	// how often rates of running tasks are rebalanced to keep users under
+	// their limits
+	RebalanceInterval time.Duration
+	// file of base64 encoded 32 bytes key, which seals credentials of
+	// ftp/sftp origins in database. Jobs with credentials are rejected if
+	// it's not set.
+	CredentialKeyFile string
 }
 
 /*https://godoc.org/github.com/garyburd/redigo/redis#Pool*/
@@ -123,10 +146,23 @@ func signalListen() {
 		jsonDecoder := json.NewDecoder(configFile)
 		var cfg Config
 		err = jsonDecoder.Decode(&cfg)
+		configFile.Close()
 		if err != nil {
 			logger.Println("Error parsing config file! err", err)
+			continue
+		}
+		if progressStoreChanged(&CONFIG, &cfg) {
+			store, err := newProgressStore(&cfg)
+			if err != nil {
+				logger.Println("Error creating progress store, keep the old one. err", err)
+				cfg.ProgressStore = CONFIG.ProgressStore
+				cfg.RedisAddress = CONFIG.RedisAddress
+				cfg.RedisMasterName = CONFIG.RedisMasterName
+			} else {
+				setProgressStore(store)
+				logger.Println("Progress store is changed to", cfg.ProgressStore)
+			}
 		}
-		configFile.Close()
 		CONFIG = cfg
 	}
 }
@@ -134,53 +170,126 @@ func signalListen() {
 func requestHandler() {
 	for {
 		request := <-requestBuffer
-		err := insertJob(&request)
-		if err != nil {
-			logger.Println("Error inserting request: ", request, "with error: ", err)
-			continue
+		err := insertRequest(&request)
+		// urls are counted in database from now on
+		releaseSubmitQuota(request.accessKey, request.reservedUrls)
+		if request.inserted != nil {
+			request.inserted <- err
 		}
-		var targetType string
-		if _, ok := cluster[request.TargetType]; ok {
-			targetType = "s3"
-		} else {
-			targetType = "Vaas"
+	}
+}
+
+// jobs whose tasks are being inserted, they're not finished until all their
+// tasks are inserted
+var (
+	insertingLock sync.Mutex
+	insertingJobs = make(map[string]bool)
+)
+
+func setInserting(jobUuid string, inserting bool) {
+	insertingLock.Lock()
+	defer insertingLock.Unlock()
+	if inserting {
+		insertingJobs[jobUuid] = true
+	} else {
+		delete(insertingJobs, jobUuid)
+	}
+}
+
+func isInserting(jobUuid string) bool {
+	insertingLock.Lock()
+	defer insertingLock.Unlock()
+	return insertingJobs[jobUuid]
+}
+
+// insertRequest saves the job and its tasks, and returns error if the job
+// is not saved
+func insertRequest(request *TransferRequest) error {
+	var targetType string
+	if _, ok := cluster[request.TargetType]; ok {
+		targetType = "s3"
+	} else {
+		targetType = "Vaas"
+	}
+	accessKey, secretKey := getKeysForUser(request.accessKey, targetType)
+	status := "Pending"
+	if len(request.DependsOn) > 0 {
+		status = "Blocked"
+	}
+	template := common.TransferTask{
+		UId:          request.accessKey,
+		JobUuid:      request.uuid,
+		TargetType:   request.TargetType,
+		TargetBucket: request.TargetBucket,
+		TargetAcl:    request.TargetAcl,
+		SourceType:   request.SourceType,
+		TransferMode: request.TransferMode,
+		Threads:      request.Threads,
+		Checksums:    request.Checksums,
+		Status:       status,
+		AccessKey:    accessKey,
+		SecretKey:    secretKey,
+	}
+	if request.Manifest != nil {
+		request.manifestTask = &template
+	} else {
+		setInserting(request.uuid, true)
+	}
+	err := insertJob(request)
+	if err != nil {
+		setInserting(request.uuid, false)
+		logger.Println("Error inserting request: ", *request, "with error: ", err)
+		return err
+	}
+	if request.Manifest != nil {
+		// tasks are inserted while expanding
+		if status == "Blocked" {
+			checkDependencies(request.uuid)
 		}
-		accessKey, secretKey := getKeysForUser(request.accessKey, targetType)
-		tasks := []*common.TransferTask{}
-		cursor := 0
-		length := len(request.OriginUrls)
-		for {
-			t := common.TransferTask{
-				UId:          request.accessKey,
-				JobUuid:      request.uuid,
-				TargetType:   request.TargetType,
-				TargetBucket: request.TargetBucket,
-				TargetAcl:    request.TargetAcl,
-				Status:       "Pending",
-				AccessKey:    accessKey,
-				SecretKey:    secretKey,
-			}
-			if length > cursor+CONFIG.FilesPerTask {
-				t.OriginUrls = request.OriginUrls[cursor : cursor+CONFIG.FilesPerTask]
-				tasks = append(tasks, &t)
-				cursor += CONFIG.FilesPerTask
-			} else {
-				t.OriginUrls = request.OriginUrls[cursor:length]
-				tasks = append(tasks, &t)
-				break
-			}
+		go expandManifest(request.uuid)
+		return nil
+	}
+	tasks := []*common.TransferTask{}
+	cursor := 0
+	length := len(request.OriginUrls)
+	for {
+		t := template
+		if length > cursor+CONFIG.FilesPerTask {
+			t.OriginUrls = request.OriginUrls[cursor : cursor+CONFIG.FilesPerTask]
+			tasks = append(tasks, &t)
+			cursor += CONFIG.FilesPerTask
+		} else {
+			t.OriginUrls = request.OriginUrls[cursor:length]
+			tasks = append(tasks, &t)
+			break
 		}
-		err = insertTasks(tasks)
+	}
+	err = insertTasks(tasks)
+	setInserting(request.uuid, false)
+	if err != nil {
+		logger.Println("Error inserting tasks: ", tasks, "with error: ", err)
+		return err
+	}
+	// tasks may have completed while the others were inserted
+	finishJobIfDone(request.uuid)
+	if status == "Blocked" {
+		// parents may have completed since the request was accepted
+		checkDependencies(request.uuid)
+		status, err = getJobStatus(request.uuid)
 		if err != nil {
-			logger.Println("Error inserting tasks: ", tasks, "with error: ", err)
-			continue
+			logger.Println("Error querying status of job", request.uuid, "with error", err)
+			return nil
 		}
-		err = chkAndAddSchedUser(request.accessKey)
-		if err != nil {
-			logger.Println("Error checking and adding user to sched list: ", err)
-			continue
+		if status == "Blocked" {
+			return nil
 		}
+		// unblocked while its tasks were inserted
 	}
+	err = chkAndAddSchedUser(request.accessKey)
+	if err != nil {
+		logger.Println("Error checking and adding user to sched list: ", err)
+	}
+	return nil
 }
 
 type scheduledTask struct {
@@ -231,16 +340,41 @@ func main() {
 
 	db = createDbConnection()
 	defer db.Close()
-	clearExecutors()
-	clearRunningTask()
+	store, err := newProgressStore(&CONFIG)
+	if err != nil {
+		panic("Error creating progress store: " + err.Error())
+	}
+	setProgressStore(store)
+	if CONFIG.Backend == "local" {
+		// executors of local backend exit along with scheduler, while tasks
+		// on Mesos are reconciled after registered
+		clearExecutors()
+		clearRunningTask()
+	}
+	err = loadCredentialKey(CONFIG.CredentialKeyFile)
+	if err != nil {
+		logger.Println("Error loading credential key from", CONFIG.CredentialKeyFile, "with error", err)
+		os.Exit(1)
+	}
 	initScheduledUsers()
 	cluster = make(map[string]string)
 	userMaxSpeed = make(map[string]int64)
+	err = loadUserMaxSpeed()
+	if err != nil {
+		panic("Error loading max speed of users: " + err.Error())
+	}
 	err = initS3ClusterAddr(cluster)
 	if err != nil {
 		panic("Error init s3 cluster address: err" + err.Error())
 	}
 
+	sched = newScheduler()
+	backend, err := newBackend(sched)
+	if err != nil {
+		panic("Error creating cluster backend: " + err.Error())
+	}
+	sched.backend = backend
+
 	requestBuffer = make(chan TransferRequest, CONFIG.RequestBufferSize)
 	go requestHandler()
 
@@ -248,26 +382,16 @@ func main() {
 
 	go rescheduler()
 
-	go signalListen()
+	go recurringRunner()
 
-	frameworkInfo := &mesosproto.FrameworkInfo{
-		User: proto.String(""), // let mesos-go fill in
-		Name: proto.String("Optimus Prime"),
-	}
+	go resumeManifests()
 
-	config := scheduler.DriverConfig{
-		Scheduler: newScheduler(),
-		Framework: frameworkInfo,
-		Master:    CONFIG.MesosMaster,
-	}
-	driver, err := scheduler.NewMesosSchedulerDriver(config)
-	if err != nil {
-		logger.Println("Unable to create SchedulerDriver: ", err.Error())
-	}
-	status, err := driver.Run()
-	if err != nil {
-		logger.Println("Framework stopped with status ", status.String(),
-			"and error ", err.Error())
-	}
+	go callbackDeliverer()
+
+	go rebalancer()
+
+	go signalListen()
+
+	backend.Run()
 	logger.Println("Framework terminated")
 }
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+	"legitlab.letv.cn/optimus/optimus/executor/s3"
+)
+
+// Jobs may reference a manifest instead of listing origin files inline. A
+// manifest is read from an http(s) url, from s3://bucket/key with S3 keys of
+// the user on the source cluster, or from parts uploaded to /manifest. Jobs
+// with "source" s3://bucket/prefix are expanded in the same way, with objects
+// under the prefix as entries. Each entry of the manifest is
+//     origin-url[,target-key[,md5,sha256]]
+// in CSV, or the same fields separated by tabs in "lines" format. Empty lines
+// and lines starting with "#" are skipped.
+//
+// The manifest is expanded into tasks of FilesPerTask files while the job is
+// running, so no more than one task of files is kept in memory. The number
+// of entries read so far and the position after them, a byte offset or the
+// last listed key, are saved in the job along with each task, and reading
+// goes on from that position after scheduler restarts or read errors. A job
+// isn't completed while expanding, and fails if its manifest cannot be read
+// or has a bad entry.
+
+const (
+	ManifestFormatLines = "lines"
+	ManifestFormatCsv   = "csv"
+	// objects listed under s3://bucket/prefix, for jobs with source
+	ManifestFormatListing = "listing"
+
+	// statuses of uploaded manifests, parts cannot be changed once Used
+	ManifestUploading = "Uploading"
+	ManifestUsed      = "Used"
+
+	maxManifestExpanders  = 4
+	maxManifestPartSize   = 2 << 20 // within max_allowed_packet of MySQL
+	maxManifestParts      = 10000
+	maxManifestLineSize   = 1 << 20
+	manifestFetchAttempts = 5
+	manifestRetryInterval = 30 * time.Second
+	// connecting to manifest servers, or a read of manifest, times out after it
+	manifestTimeout = 30 * time.Second
+)
+
+// manifests are read slowly along with expanding, so only connecting and
+// each read time out, but not the whole request. Compression is disabled so
+// offsets of manifests are the same as in ranges.
+var manifestClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DisableCompression:    true,
+		DialContext:           (&net.Dialer{Timeout: manifestTimeout}).DialContext,
+		TLSHandshakeTimeout:   manifestTimeout,
+		ResponseHeaderTimeout: manifestTimeout,
+	},
+}
+
+var errManifestTimeout = errors.New("Reading manifest timed out")
+
+// timeoutReader closes body if a read takes longer than manifestTimeout
+type timeoutReader struct {
+	body io.ReadCloser
+}
+
+func (r *timeoutReader) Read(p []byte) (n int, err error) {
+	timer := time.AfterFunc(manifestTimeout, func() { r.body.Close() })
+	n, err = r.body.Read(p)
+	if !timer.Stop() && err != nil {
+		err = errManifestTimeout
+	}
+	return
+}
+
+func (r *timeoutReader) Close() error {
+	return r.body.Close()
+}
+
+type Manifest struct {
+	Url    string `json:"url,omitempty"`
+	Id     string `json:"id,omitempty"`     // manifest uploaded to /manifest
+	Format string `json:"format,omitempty"` // in lines/csv, default is lines
+	Parts  int    `json:"parts,omitempty"`  // parts of uploaded manifest, set on submission
+}
+
+// ManifestUpload is a manifest uploaded in parts
+type ManifestUpload struct {
+	Id         string `json:"manifest-id"`
+	Status     string `json:"status"`
+	Parts      int    `json:"parts"`
+	Size       int64  `json:"size"`
+	CreateTime int64  `json:"create-time"`
+}
+
+// ManifestProgress is the expansion progress of a manifest job
+type ManifestProgress struct {
+	Expanding bool   `json:"expanding"`
+	Files     int64  `json:"files"` // entries expanded into tasks
+	Error     string `json:"error,omitempty"`
+}
+
+// manifestState is saved in job table, Task is the template of tasks
+type manifestState struct {
+	Manifest *Manifest            `json:"manifest"`
+	Task     *common.TransferTask `json:"task"`
+}
+
+// manifestEntry is a file in manifest
+type manifestEntry struct {
+	url       string
+	targetKey string
+	checksum  *common.Checksum
+}
+
+// errors in the manifest itself, reading it again won't help
+type manifestError struct {
+	message string
+}
+
+func (e *manifestError) Error() string {
+	return e.message
+}
+
+var (
+	errManifestStopped = errors.New("Job is cancelled or expanded by others")
+	errManifestQuota   = errors.New("Queued files quota exceeded")
+	errManifestShorter = &manifestError{"Manifest is shorter than expanded"}
+
+	manifestExpanders = make(chan bool, maxManifestExpanders)
+)
+
+func (manifest *Manifest) validate(sourceType string) error {
+	switch manifest.Format {
+	case "":
+		manifest.Format = ManifestFormatLines
+	case ManifestFormatLines, ManifestFormatCsv, ManifestFormatListing:
+	default:
+		return errors.New("Unknown manifest format " + manifest.Format)
+	}
+	if (manifest.Url == "") == (manifest.Id == "") {
+		return errors.New("Either url or id of manifest should be given")
+	}
+	if manifest.Id != "" {
+		if manifest.Format == ManifestFormatListing {
+			return errors.New("Uploaded manifest cannot be listed")
+		}
+		return nil
+	}
+	u, err := url.Parse(manifest.Url)
+	if err != nil {
+		return errors.New("Bad manifest url")
+	}
+	if manifest.Format == ManifestFormatListing {
+		if u.Scheme != "s3" || u.Host == "" {
+			return errors.New("Source should be s3://bucket/prefix")
+		}
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "s3":
+		if _, ok := cluster[sourceType]; !ok {
+			return errors.New("S3 manifest or source needs an S3 source type")
+		}
+		if manifest.Format != ManifestFormatListing && (u.Host == "" || strings.Trim(u.Path, "/") == "") {
+			return errors.New("S3 manifest url should be s3://bucket/key")
+		}
+	default:
+		return errors.New("Manifest url should be http, https or s3")
+	}
+	return nil
+}
+
+// manifestPartReader reads parts of an uploaded manifest one by one, from
+// skip bytes of the part after part
+type manifestPartReader struct {
+	id    string
+	parts int
+	part  int
+	skip  int64
+	data  *bytes.Reader
+}
+
+func (r *manifestPartReader) Read(p []byte) (int, error) {
+	for r.data == nil || r.data.Len() == 0 {
+		if r.part == r.parts {
+			return 0, io.EOF
+		}
+		data, err := getManifestPart(r.id, r.part+1)
+		if err != nil {
+			return 0, err
+		}
+		if data == nil {
+			return 0, &manifestError{"Manifest part " + strconv.Itoa(r.part+1) + " is missing"}
+		}
+		r.part++
+		r.data = bytes.NewReader(data)
+		r.data.Seek(r.skip, io.SeekStart)
+		r.skip = 0
+	}
+	return r.data.Read(p)
+}
+
+func (r *manifestPartReader) Close() error {
+	return nil
+}
+
+// openManifest opens the manifest from offset
+func openManifest(manifest *Manifest, task *common.TransferTask, offset int64) (io.ReadCloser, error) {
+	if manifest.Id != "" {
+		sizes, err := getManifestPartSizes(manifest.Id)
+		if err != nil {
+			return nil, err
+		}
+		r := &manifestPartReader{id: manifest.Id, parts: manifest.Parts}
+		for r.part < len(sizes) && r.part < r.parts && offset >= sizes[r.part] {
+			offset -= sizes[r.part]
+			r.part++
+		}
+		if r.part == r.parts && offset > 0 {
+			return nil, errManifestShorter
+		}
+		r.skip = offset
+		return r, nil
+	}
+	u, err := url.Parse(manifest.Url)
+	if err != nil {
+		return nil, &manifestError{"Bad manifest url"}
+	}
+	if u.Scheme == "s3" {
+		accessKey, secretKey := getKeysForUser(task.UId, "s3")
+		driver := s3.NewDriver(accessKey, secretKey, cluster[task.SourceType], u.Host, "")
+		body, err := driver.Reader(u.Path, offset)
+		if err != nil {
+			return nil, err
+		}
+		return &timeoutReader{body}, nil
+	}
+	req, err := http.NewRequest("GET", manifest.Url, nil)
+	if err != nil {
+		return nil, &manifestError{"Bad manifest url"}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := manifestClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		return &timeoutReader{resp.Body}, nil
+	}
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return nil, errManifestShorter
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = errors.New("Manifest url answered with status " + resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &manifestError{err.Error()}
+		}
+		return nil, err
+	}
+	body := &timeoutReader{resp.Body}
+	if offset > 0 {
+		// ranges are not supported, the part read before is skipped
+		if _, err = io.CopyN(ioutil.Discard, body, offset); err != nil {
+			body.Close()
+			if err == io.EOF {
+				return nil, errManifestShorter
+			}
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// manifestReader returns a function reading fields of the next entry and
+// bytes of r read through the entry, which returns io.EOF at the end of
+// manifest
+func manifestReader(format string, r io.Reader) func() ([]string, int64, error) {
+	if format == ManifestFormatCsv {
+		reader := csv.NewReader(r)
+		reader.Comment = '#'
+		reader.FieldsPerRecord = -1
+		return func() ([]string, int64, error) {
+			fields, err := reader.Read()
+			if parseError, ok := err.(*csv.ParseError); ok {
+				return nil, 0, &manifestError{parseError.Error()}
+			}
+			return fields, reader.InputOffset(), err
+		}
+	}
+	var offset int64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxManifestLineSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		offset += int64(advance)
+		return advance, token, err
+	})
+	return func() ([]string, int64, error) {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			return strings.Split(line, "\t"), offset, nil
+		}
+		if scanner.Err() == bufio.ErrTooLong {
+			return nil, 0, &manifestError{"Manifest line is too long"}
+		}
+		if scanner.Err() != nil {
+			return nil, 0, scanner.Err()
+		}
+		return nil, 0, io.EOF
+	}
+}
+
+// listingReader returns a function reading objects under s3://bucket/prefix
+// after marker as entries, along with keys of them, which returns io.EOF after
+// the last object. Objects are listed in order of keys, a page at a time.
+func listingReader(source string, task *common.TransferTask, marker string) func() ([]string, string, error) {
+	u, _ := url.Parse(source)
+	accessKey, secretKey := getKeysForUser(task.UId, "s3")
+	driver := s3.NewDriver(accessKey, secretKey, cluster[task.SourceType], u.Host, "")
+	prefix := strings.TrimLeft(u.Path, "/")
+	var page []string
+	truncated := true
+	return func() ([]string, string, error) {
+		for len(page) == 0 {
+			if !truncated {
+				return nil, "", io.EOF
+			}
+			resp, err := driver.Bucket.List(prefix, "", marker, 1000)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, key := range resp.Contents {
+				marker = key.Key
+				// placeholders of directories
+				if strings.HasSuffix(key.Key, "/") && key.Size == 0 {
+					continue
+				}
+				page = append(page, key.Key)
+			}
+			truncated = resp.IsTruncated && len(resp.Contents) > 0
+		}
+		key := page[0]
+		page = page[1:]
+		object := url.URL{Scheme: "s3", Host: u.Host, Path: "/" + key}
+		return []string{object.String()}, key, nil
+	}
+}
+
+func parseManifestEntry(fields []string) (*manifestEntry, error) {
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) != 1 && len(fields) != 2 && len(fields) != 4 {
+		return nil, errors.New("Entry should have 1, 2 or 4 fields")
+	}
+	u, err := url.Parse(fields[0])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, errors.New("Bad url " + fields[0])
+	}
+	if u.User != nil {
+		// credentials are given with the job, never in plain text
+		return nil, errors.New("User info is not allowed in url " + fields[0])
+	}
+	entry := &manifestEntry{url: fields[0]}
+	if len(fields) > 1 {
+		entry.targetKey = strings.TrimLeft(fields[1], "/")
+	}
+	// either digest could be empty
+	if len(fields) == 4 && (fields[2] != "" || fields[3] != "") {
+		if !isHex(fields[2], 32) || !isHex(fields[3], 64) {
+			return nil, errors.New("Bad checksum for " + fields[0])
+		}
+		entry.checksum = &common.Checksum{
+			MD5:    strings.ToLower(fields[2]),
+			SHA256: strings.ToLower(fields[3]),
+		}
+	}
+	return entry, nil
+}
+
+// resumeManifests goes on expanding manifests after scheduler restarts
+func resumeManifests() {
+	jobUuids, err := getExpandingJobs()
+	if err != nil {
+		logger.Println("Error querying expanding jobs with error", err)
+		return
+	}
+	for _, jobUuid := range jobUuids {
+		go expandManifest(jobUuid)
+	}
+}
+
+// expandManifest expands manifest of the job into tasks, reading the manifest
+// again from where it stopped on errors
+func expandManifest(jobUuid string) {
+	attempts := 0
+	paused := false
+	for {
+		manifestExpanders <- true
+		err := expandManifestOnce(jobUuid)
+		<-manifestExpanders
+		if err != errManifestQuota {
+			paused = false
+		}
+		switch err {
+		case nil:
+			logger.Println("Manifest of job", jobUuid, "is expanded")
+			finishManifest(jobUuid, "")
+			return
+		case errManifestStopped:
+			logger.Println("Stop expanding manifest of job", jobUuid)
+			return
+		case errManifestQuota:
+			// retried until files are done, not counted as attempts
+			if !paused {
+				logger.Println("Expanding manifest of job", jobUuid,
+					"is paused until quota of the user is available")
+				paused = true
+			}
+			time.Sleep(manifestRetryInterval)
+			continue
+		}
+		attempts++
+		if _, ok := err.(*manifestError); ok || attempts >= manifestFetchAttempts {
+			logger.Println("Error expanding manifest of job", jobUuid, "with error", err)
+			finishManifest(jobUuid, err.Error())
+			return
+		}
+		logger.Println("Error reading manifest of job", jobUuid, "with error", err, ", will retry")
+		time.Sleep(manifestRetryInterval)
+	}
+}
+
+func expandManifestOnce(jobUuid string) error {
+	state, files, position, err := getManifestState(jobUuid)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return errManifestStopped
+	}
+	// next returns fields of the next entry and the position after it
+	var next func() ([]string, string, error)
+	if state.Manifest.Format == ManifestFormatListing {
+		next = listingReader(state.Manifest.Url, state.Task, position)
+	} else {
+		var offset int64
+		if position != "" {
+			offset, err = strconv.ParseInt(position, 10, 64)
+			if err != nil {
+				return &manifestError{"Malformed manifest position " + position}
+			}
+		}
+		body, err := openManifest(state.Manifest, state.Task, offset)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		nextEntry := manifestReader(state.Manifest.Format, body)
+		next = func() ([]string, string, error) {
+			fields, read, err := nextEntry()
+			return fields, strconv.FormatInt(offset+read, 10), err
+		}
+	}
+
+	// tasks larger than queued files quota would never be inserted
+	quota, err := getUserQuota(state.Task.UId)
+	if err != nil {
+		return err
+	}
+	filesPerTask := CONFIG.FilesPerTask
+	if quota.MaxQueuedUrls > 0 && quota.MaxQueuedUrls < filesPerTask {
+		filesPerTask = quota.MaxQueuedUrls
+	}
+
+	read := files
+	if position == "" && files > 0 {
+		// expanded before positions are saved, entries are skipped
+		for read = 0; read < files; read++ {
+			if _, _, err := next(); err != nil {
+				if err == io.EOF {
+					return errManifestShorter
+				}
+				return err
+			}
+		}
+	}
+	for {
+		task := *state.Task
+		task.OriginUrls = nil
+		task.Checksums = make(map[string]*common.Checksum)
+		task.TargetKeys = make(map[string]string)
+		var after string
+		for len(task.OriginUrls) < filesPerTask {
+			fields, entryPosition, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			read++
+			after = entryPosition
+			entry, err := parseManifestEntry(fields)
+			if err != nil {
+				return &manifestError{"Entry " + strconv.FormatInt(read, 10) + ": " + err.Error()}
+			}
+			task.OriginUrls = append(task.OriginUrls, entry.url)
+			if entry.targetKey != "" {
+				task.TargetKeys[entry.url] = entry.targetKey
+			}
+			if entry.checksum != nil {
+				task.Checksums[entry.url] = entry.checksum
+			}
+		}
+		if len(task.OriginUrls) == 0 {
+			return nil
+		}
+		exceeded, err := checkSubmitQuota(task.UId, len(task.OriginUrls))
+		if err != nil {
+			return err
+		}
+		if exceeded != "" {
+			return errManifestQuota
+		}
+		inserted, err := insertManifestTask(&task, files, after)
+		if err != nil {
+			return err
+		}
+		if !inserted {
+			return errManifestStopped
+		}
+		files = read
+		if task.Status != "Pending" {
+			continue
+		}
+		err = chkAndAddSchedUser(task.UId)
+		if err != nil {
+			logger.Println("Error checking and adding user to sched list: ", err)
+		}
+	}
+}
+
+// finishManifest marks expansion of the job done, failed if message is not
+// empty, and completes the job if all its tasks are done
+func finishManifest(jobUuid string, message string) {
+	err := stopExpanding(jobUuid, message)
+	if err != nil {
+		logger.Println("Error finishing manifest of job", jobUuid, "with error", err)
+		return
+	}
+	finishJobIfDone(jobUuid)
+}
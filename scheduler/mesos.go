@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesos/mesos-go/scheduler"
+)
+
+const frameworkName = "Optimus Prime"
+
+// mesosBackend runs tasks on a Mesos cluster, it implements
+// scheduler.Scheduler interface and passes Mesos events to Scheduler
+type mesosBackend struct {
+	scheduler *Scheduler
+	driver    scheduler.SchedulerDriver
+}
+
+func newMesosBackend(sched *Scheduler) (ClusterBackend, error) {
+	backend := &mesosBackend{scheduler: sched}
+	frameworkInfo := &mesosproto.FrameworkInfo{
+		User: proto.String(""), // let mesos-go fill in
+		Name: proto.String(frameworkName),
+		// tasks keep running for this long after scheduler is gone, a new
+		// scheduler re-registered with the same framework ID takes them over
+		FailoverTimeout: proto.Float64(CONFIG.FailoverTimeout.Seconds()),
+	}
+	frameworkId, err := getFrameworkId(frameworkName)
+	if err != nil {
+		logger.Println("Error querying framework ID: ", err)
+	}
+	if frameworkId != "" {
+		logger.Println("Failing over framework", frameworkId)
+		frameworkInfo.Id = &mesosproto.FrameworkID{Value: proto.String(frameworkId)}
+	}
+
+	config := scheduler.DriverConfig{
+		Scheduler: backend,
+		Framework: frameworkInfo,
+		Master:    CONFIG.MesosMaster,
+	}
+	driver, err := scheduler.NewMesosSchedulerDriver(config)
+	if err != nil {
+		logger.Println("Unable to create SchedulerDriver: ", err.Error())
+		return nil, err
+	}
+	backend.driver = driver
+	return backend, nil
+}
+
+func (backend *mesosBackend) Run() error {
+	status, err := backend.driver.Run()
+	if err != nil {
+		logger.Println("Framework stopped with status ", status.String(),
+			"and error ", err.Error())
+	}
+	return err
+}
+
+// Stop disconnects from master with tasks left running, so they could be
+// taken over by the next scheduler
+func (backend *mesosBackend) Stop() {
+	backend.driver.Stop(true)
+}
+
+func (backend *mesosBackend) LaunchTasks(offerId string, tasks []*mesosproto.TaskInfo) error {
+	_, err := backend.driver.LaunchTasks(
+		[]*mesosproto.OfferID{{Value: proto.String(offerId)}},
+		tasks, &mesosproto.Filters{})
+	return err
+}
+
+func (backend *mesosBackend) DeclineOffer(offerId string) {
+	backend.driver.DeclineOffer(&mesosproto.OfferID{Value: proto.String(offerId)},
+		&mesosproto.Filters{})
+}
+
+func (backend *mesosBackend) KillTask(taskId string) error {
+	status, err := backend.driver.KillTask(&mesosproto.TaskID{Value: proto.String(taskId)})
+	if err == nil && status != mesosproto.Status_DRIVER_RUNNING {
+		err = errors.New("Driver is not running")
+	}
+	return err
+}
+
+func (backend *mesosBackend) SendFrameworkMessage(executorId string, slaveId string,
+	message string) error {
+	_, err := backend.driver.SendFrameworkMessage(
+		&mesosproto.ExecutorID{Value: proto.String(executorId)},
+		&mesosproto.SlaveID{Value: proto.String(slaveId)}, message)
+	return err
+}
+
+func (backend *mesosBackend) Registered(driver scheduler.SchedulerDriver,
+	frameworkID *mesosproto.FrameworkID, masterInfo *mesosproto.MasterInfo) {
+	logger.Println("Framework registered.")
+	logger.Println("Framework ID: ", frameworkID.GetValue())
+	logger.Println("Master: ", masterInfo)
+	err := saveFrameworkId(frameworkName, frameworkID.GetValue())
+	if err != nil {
+		logger.Println("Error saving framework ID: ", err)
+	}
+	backend.reconcile(driver)
+}
+
+func (backend *mesosBackend) Reregistered(driver scheduler.SchedulerDriver,
+	masterInfo *mesosproto.MasterInfo) {
+	logger.Println("Framework re-registered.")
+	logger.Println("Master: ", masterInfo)
+	backend.reconcile(driver)
+}
+
+// reconcile asks master for the latest states of tasks. Tasks active in
+// database are reconciled explicitly, for those unknown to Mesos TASK_LOST is
+// sent back and they will be run again. Then all tasks known to Mesos are
+// reconciled implicitly, to get updates missed while disconnected.
+func (backend *mesosBackend) reconcile(driver scheduler.SchedulerDriver) {
+	tasks := getActiveTasks()
+	logger.Println("Reconciling", len(tasks), "active tasks")
+	if len(tasks) > 0 {
+		_, err := driver.ReconcileTasks(tasks)
+		if err != nil {
+			logger.Println("Error reconciling tasks explicitly: ", err)
+		}
+	}
+	_, err := driver.ReconcileTasks([]*mesosproto.TaskStatus{})
+	if err != nil {
+		logger.Println("Error reconciling tasks implicitly: ", err)
+	}
+}
+
+// the driver reconnects to master automatically, tasks are reconciled when
+// it's re-registered
+func (backend *mesosBackend) Disconnected(driver scheduler.SchedulerDriver) {
+	logger.Println("Disconnected from master!")
+}
+
+func (backend *mesosBackend) ResourceOffers(driver scheduler.SchedulerDriver,
+	offers []*mesosproto.Offer) {
+	var resourceOffers []*Offer
+	for _, offer := range offers {
+		resourceOffer := &Offer{
+			Id:       offer.GetId().GetValue(),
+			SlaveId:  offer.GetSlaveId().GetValue(),
+			Hostname: offer.GetHostname(),
+		}
+		for _, resource := range offer.GetResources() {
+			switch resource.GetName() {
+			case "cpus":
+				resourceOffer.Cpus += resource.GetScalar().GetValue()
+			case "mem":
+				resourceOffer.Mem += resource.GetScalar().GetValue()
+			case "disk":
+				resourceOffer.Disk += resource.GetScalar().GetValue()
+			}
+		}
+		resourceOffers = append(resourceOffers, resourceOffer)
+	}
+	backend.scheduler.resourceOffers(resourceOffers)
+}
+
+func (backend *mesosBackend) OfferRescinded(driver scheduler.SchedulerDriver,
+	offer *mesosproto.OfferID) {
+	logger.Println("Offer rescinded: ", offer)
+	// TODO: track tasks
+}
+
+func (backend *mesosBackend) StatusUpdate(driver scheduler.SchedulerDriver,
+	taskStatus *mesosproto.TaskStatus) {
+	backend.scheduler.statusUpdate(taskStatus)
+}
+
+func (backend *mesosBackend) FrameworkMessage(driver scheduler.SchedulerDriver,
+	executorID *mesosproto.ExecutorID, slaveID *mesosproto.SlaveID, message string) {
+	backend.scheduler.frameworkMessage(executorID.GetValue(), slaveID.GetValue(), message)
+}
+
+func (backend *mesosBackend) SlaveLost(driver scheduler.SchedulerDriver,
+	slaveID *mesosproto.SlaveID) {
+	logger.Printf("Slave lost: %v", slaveID)
+	backend.scheduler.slaveLost(slaveID.GetValue())
+}
+
+func (backend *mesosBackend) ExecutorLost(driver scheduler.SchedulerDriver,
+	executorID *mesosproto.ExecutorID, slaveID *mesosproto.SlaveID, code int) {
+	logger.Printf("Executor %q lost on slave %q code %d",
+		executorID, slaveID, code)
+	backend.scheduler.executorLost(executorID.GetValue())
+}
+
+func (backend *mesosBackend) Error(driver scheduler.SchedulerDriver, error string) {
+	logger.Println("Unrecoverable error: ", error)
+	// e.g. the framework is removed by master, register as a new one next time
+	err := saveFrameworkId(frameworkName, "")
+	if err != nil {
+		logger.Println("Error clearing framework ID: ", err)
+	}
+	driver.Stop(false)
+}
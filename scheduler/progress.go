@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+const (
+	defaultProgressTTL    = time.Hour
+	progressSweepInterval = time.Minute
+	redisProgressPrefix   = "optimus:progress:"
+)
+
+// ProgressStore keeps progress of files reported by executors in framework
+// messages, keyed by job, task and url. Progress not updated for ProgressTTL
+// is dropped.
+type ProgressStore interface {
+	Update(reports []*common.ProgressReport)
+	// Finish stops the speed of a file which is no longer transferred, a
+	// file Finished is shown as 100%
+	Finish(update *common.UrlUpdate)
+	JobProgress(jobUuid string) []common.UrlInfo
+	TaskProgress(taskId int64) []common.UrlInfo
+	// Lookup returns the latest progress of each url in its job, or in any
+	// job of user uid if JobId is empty, a zero UrlInfo for urls not found
+	Lookup(uid string, urls []UrlReq) []common.UrlInfo
+	Close()
+}
+
+var (
+	progressLock  sync.RWMutex
+	progressStore ProgressStore
+)
+
+// progress returns the store in use, it's replaced when the configuration is
+// reloaded
+func progress() ProgressStore {
+	progressLock.RLock()
+	defer progressLock.RUnlock()
+	return progressStore
+}
+
+func setProgressStore(store ProgressStore) {
+	progressLock.Lock()
+	old := progressStore
+	progressStore = store
+	progressLock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// newProgressStore creates the store configured by ProgressStore, which is
+// "memory"(default), "redis" using RedisAddress[0], or "sentinel" using
+// RedisAddress as sentinels of master RedisMasterName
+func newProgressStore(config *Config) (ProgressStore, error) {
+	switch config.ProgressStore {
+	case "", "memory":
+		return newMemoryProgressStore(), nil
+	case "redis":
+		if len(config.RedisAddress) == 0 {
+			return nil, errors.New("RedisAddress is not configured")
+		}
+		return &redisProgressStore{pool: newRedisPool(config.RedisAddress[0], "")}, nil
+	case "sentinel":
+		if len(config.RedisAddress) == 0 || config.RedisMasterName == "" {
+			return nil, errors.New("RedisAddress or RedisMasterName is not configured")
+		}
+		return &redisProgressStore{
+			pool: newSentinelPool(config.RedisAddress, config.RedisMasterName),
+		}, nil
+	default:
+		return nil, errors.New("Unknown progress store " + config.ProgressStore)
+	}
+}
+
+func progressStoreChanged(old *Config, new *Config) bool {
+	if old.ProgressStore != new.ProgressStore || old.RedisMasterName != new.RedisMasterName ||
+		len(old.RedisAddress) != len(new.RedisAddress) {
+		return true
+	}
+	for i := range old.RedisAddress {
+		if old.RedisAddress[i] != new.RedisAddress[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func progressTTL() time.Duration {
+	if CONFIG.ProgressTTL > 0 {
+		return CONFIG.ProgressTTL
+	}
+	return defaultProgressTTL
+}
+
+// memoryProgressStore keeps progress in memory of scheduler
+type memoryProgressStore struct {
+	lock     sync.RWMutex
+	jobs     map[string]map[progressKey]*progressEntry // keyed by job uuid
+	taskJobs map[int64]string                          // job uuid of tasks
+	stop     chan bool
+}
+
+type progressKey struct {
+	taskId int64
+	url    string
+}
+
+type progressEntry struct {
+	uid     string
+	info    common.UrlInfo
+	updated time.Time
+}
+
+func newMemoryProgressStore() *memoryProgressStore {
+	store := &memoryProgressStore{
+		jobs:     make(map[string]map[progressKey]*progressEntry),
+		taskJobs: make(map[int64]string),
+		stop:     make(chan bool),
+	}
+	go store.sweeper()
+	return store
+}
+
+func (store *memoryProgressStore) Update(reports []*common.ProgressReport) {
+	now := time.Now()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for _, report := range reports {
+		entries, ok := store.jobs[report.JobUuid]
+		if !ok {
+			entries = make(map[progressKey]*progressEntry)
+			store.jobs[report.JobUuid] = entries
+		}
+		entries[progressKey{taskId: report.TaskId, url: report.Info.Url}] = &progressEntry{
+			uid:     report.UId,
+			info:    report.Info,
+			updated: now,
+		}
+		store.taskJobs[report.TaskId] = report.JobUuid
+	}
+}
+
+func (store *memoryProgressStore) Finish(update *common.UrlUpdate) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	jobUuid, ok := store.taskJobs[update.TaskId]
+	if !ok {
+		return
+	}
+	entry, ok := store.jobs[jobUuid][progressKey{taskId: update.TaskId, url: update.OriginUrl}]
+	if !ok {
+		return
+	}
+	finishProgress(&entry.info, update)
+	entry.updated = time.Now()
+}
+
+func finishProgress(info *common.UrlInfo, update *common.UrlUpdate) {
+	info.Speed = 0
+	if update.Status == "Finished" {
+		info.Size = update.Size
+		info.Percentage = 100
+	}
+}
+
+func (store *memoryProgressStore) JobProgress(jobUuid string) (infos []common.UrlInfo) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for _, entry := range store.jobs[jobUuid] {
+		infos = append(infos, entry.info)
+	}
+	return
+}
+
+func (store *memoryProgressStore) TaskProgress(taskId int64) (infos []common.UrlInfo) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for key, entry := range store.jobs[store.taskJobs[taskId]] {
+		if key.taskId == taskId {
+			infos = append(infos, entry.info)
+		}
+	}
+	return
+}
+
+func (store *memoryProgressStore) Lookup(uid string, urls []UrlReq) []common.UrlInfo {
+	infos := make([]common.UrlInfo, len(urls))
+	latest := make([]time.Time, len(urls))
+	// indexes in urls of each url
+	wanted := make(map[string][]int)
+	for i, url := range urls {
+		wanted[url.Url] = append(wanted[url.Url], i)
+	}
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for job, entries := range store.jobs {
+		for key, entry := range entries {
+			if entry.uid != uid {
+				continue
+			}
+			for _, i := range wanted[key.url] {
+				if (urls[i].JobId != "" && urls[i].JobId != job) || entry.updated.Before(latest[i]) {
+					continue
+				}
+				infos[i], latest[i] = entry.info, entry.updated
+			}
+		}
+	}
+	return infos
+}
+
+func (store *memoryProgressStore) Close() {
+	close(store.stop)
+}
+
+func (store *memoryProgressStore) sweeper() {
+	ticker := time.NewTicker(progressSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			store.sweep()
+		case <-store.stop:
+			return
+		}
+	}
+}
+
+func (store *memoryProgressStore) sweep() {
+	deadline := time.Now().Add(-progressTTL())
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for jobUuid, entries := range store.jobs {
+		for key, entry := range entries {
+			if entry.updated.Before(deadline) {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(store.jobs, jobUuid)
+		}
+	}
+	for taskId, jobUuid := range store.taskJobs {
+		if _, ok := store.jobs[jobUuid]; !ok {
+			delete(store.taskJobs, taskId)
+		}
+	}
+}
+
+// redisProgressStore keeps progress in Redis, so it's shared by schedulers
+// and survives restarts. Keys, all expire after ProgressTTL:
+//
+//	optimus:progress:url:<job uuid>:<task id>:<url>  progress of a file, in JSON
+//	optimus:progress:joburls:<job uuid>              url keys of the job, in a
+//	                                                 sorted set scored by expiry
+//	optimus:progress:latest:<uid>:<job uuid>:<url>   url key of the latest update
+//	                                                 of url in the job, or in any
+//	                                                 job if job uuid is empty
+//	optimus:progress:task:<task id>                  job uuid of the task
+type redisProgressStore struct {
+	pool *redis.Pool
+}
+
+type storedProgress struct {
+	common.ProgressReport
+	Updated int64 `json:"updated"` // unix time in nanoseconds
+}
+
+func redisUrlKey(jobUuid string, taskId int64, url string) string {
+	return redisProgressPrefix + "url:" + jobUuid + ":" + strconv.FormatInt(taskId, 10) + ":" + url
+}
+
+func redisJobKey(jobUuid string) string {
+	return redisProgressPrefix + "joburls:" + jobUuid
+}
+
+func redisLatestKey(uid string, jobUuid string, url string) string {
+	return redisProgressPrefix + "latest:" + uid + ":" + jobUuid + ":" + url
+}
+
+func redisTaskKey(taskId int64) string {
+	return redisProgressPrefix + "task:" + strconv.FormatInt(taskId, 10)
+}
+
+func (store *redisProgressStore) Update(reports []*common.ProgressReport) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	ttl := int(progressTTL() / time.Second)
+	now := time.Now()
+	expiry := now.Add(progressTTL()).Unix()
+	jobKeys := make(map[string]bool)
+	for _, report := range reports {
+		value, err := json.Marshal(storedProgress{ProgressReport: *report, Updated: now.UnixNano()})
+		if err != nil {
+			logger.Println("Error marshal json: ", err)
+			continue
+		}
+		urlKey := redisUrlKey(report.JobUuid, report.TaskId, report.Info.Url)
+		jobKey := redisJobKey(report.JobUuid)
+		conn.Send("SETEX", urlKey, ttl, value)
+		conn.Send("ZADD", jobKey, expiry, urlKey)
+		conn.Send("EXPIRE", jobKey, ttl)
+		conn.Send("SETEX", redisLatestKey(report.UId, report.JobUuid, report.Info.Url), ttl, urlKey)
+		conn.Send("SETEX", redisLatestKey(report.UId, "", report.Info.Url), ttl, urlKey)
+		conn.Send("SETEX", redisTaskKey(report.TaskId), ttl, report.JobUuid)
+		jobKeys[jobKey] = true
+	}
+	// drop url keys already expired
+	for jobKey := range jobKeys {
+		conn.Send("ZREMRANGEBYSCORE", jobKey, "-inf", now.Unix())
+	}
+	_, err := conn.Do("")
+	if err != nil {
+		logger.Println("Error saving progress to Redis: ", err)
+	}
+}
+
+func (store *redisProgressStore) Finish(update *common.UrlUpdate) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	jobUuid, err := redis.String(conn.Do("GET", redisTaskKey(update.TaskId)))
+	if err != nil {
+		return
+	}
+	urlKey := redisUrlKey(jobUuid, update.TaskId, update.OriginUrl)
+	value, err := redis.Bytes(conn.Do("GET", urlKey))
+	if err != nil {
+		return
+	}
+	var stored storedProgress
+	err = json.Unmarshal(value, &stored)
+	if err != nil {
+		logger.Println("Error Unmarshal json value! key", urlKey)
+		return
+	}
+	finishProgress(&stored.Info, update)
+	stored.Updated = time.Now().UnixNano()
+	value, err = json.Marshal(stored)
+	if err != nil {
+		logger.Println("Error marshal json: ", err)
+		return
+	}
+	_, err = conn.Do("SETEX", urlKey, int(progressTTL()/time.Second), value)
+	if err != nil {
+		logger.Println("Error saving progress to Redis: ", err)
+	}
+}
+
+// members returns progress of url keys not expired in the sorted set
+func (store *redisProgressStore) members(conn redis.Conn, setKey string) []*storedProgress {
+	keys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", setKey, time.Now().Unix(), "+inf"))
+	if err != nil {
+		logger.Println("Error reading progress from Redis: ", err)
+		return nil
+	}
+	return store.get(conn, keys)
+}
+
+// get reads progress of url keys with one MGET, nil for keys not found
+func (store *redisProgressStore) get(conn redis.Conn, keys []string) (result []*storedProgress) {
+	if len(keys) == 0 {
+		return
+	}
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	values, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		logger.Println("Error reading progress from Redis: ", err)
+		return
+	}
+	for i, value := range values {
+		if value == nil {
+			continue // expired
+		}
+		var stored storedProgress
+		err = json.Unmarshal(value, &stored)
+		if err != nil {
+			logger.Println("Error Unmarshal json value! key", keys[i])
+			continue
+		}
+		result = append(result, &stored)
+	}
+	return
+}
+
+func (store *redisProgressStore) JobProgress(jobUuid string) (infos []common.UrlInfo) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	for _, stored := range store.members(conn, redisJobKey(jobUuid)) {
+		infos = append(infos, stored.Info)
+	}
+	return
+}
+
+func (store *redisProgressStore) TaskProgress(taskId int64) (infos []common.UrlInfo) {
+	conn := store.pool.Get()
+	defer conn.Close()
+	jobUuid, err := redis.String(conn.Do("GET", redisTaskKey(taskId)))
+	if err != nil {
+		return
+	}
+	for _, stored := range store.members(conn, redisJobKey(jobUuid)) {
+		if stored.TaskId == taskId {
+			infos = append(infos, stored.Info)
+		}
+	}
+	return
+}
+
+// Lookup reads url keys of the latest updates with one MGET, and then their
+// progress with another
+func (store *redisProgressStore) Lookup(uid string, urls []UrlReq) []common.UrlInfo {
+	infos := make([]common.UrlInfo, len(urls))
+	if len(urls) == 0 {
+		return infos
+	}
+	conn := store.pool.Get()
+	defer conn.Close()
+	args := make([]interface{}, len(urls))
+	for i, url := range urls {
+		args[i] = redisLatestKey(uid, url.JobId, url.Url)
+	}
+	pointers, err := redis.Strings(conn.Do("MGET", args...))
+	if err != nil {
+		logger.Println("Error reading progress from Redis: ", err)
+		return infos
+	}
+	var keys []string
+	for _, key := range pointers {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	progress := make(map[string]common.UrlInfo)
+	for _, stored := range store.get(conn, keys) {
+		progress[redisUrlKey(stored.JobUuid, stored.TaskId, stored.Info.Url)] = stored.Info
+	}
+	for i, key := range pointers {
+		infos[i] = progress[key]
+	}
+	return infos
+}
+
+func (store *redisProgressStore) Close() {
+	store.pool.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Quotas of users are kept in user table, 0 means unlimited. Jobs exceeding
+// max queued urls, or submitted when daily or monthly bytes are used up, are
+// rejected with 429. Tasks of a user are not scheduled while the user has
+// max running tasks or has used up daily or monthly bytes, they wait until
+// the quota is available again. Bytes of finished files are counted per day
+// in user_usage table.
+
+// Quota of a user, 0 for unlimited
+type Quota struct {
+	MaxRunningTasks int   `json:"max-running-tasks"`
+	MaxQueuedUrls   int   `json:"max-queued-urls"`
+	DailyBytes      int64 `json:"daily-bytes"`
+	MonthlyBytes    int64 `json:"monthly-bytes"`
+}
+
+type Usage struct {
+	RunningTasks int   `json:"running-tasks"` // tasks scheduled or running
+	QueuedUrls   int   `json:"queued-urls"`   // files not finished, failed or cancelled
+	DailyBytes   int64 `json:"daily-bytes"`
+	MonthlyBytes int64 `json:"monthly-bytes"`
+}
+
+type UsageResponse struct {
+	Quota *Quota `json:"quota"`
+	Usage *Usage `json:"usage"`
+}
+
+func bytesUsedUp(quota *Quota, usage *Usage) string {
+	if quota.DailyBytes > 0 && usage.DailyBytes >= quota.DailyBytes {
+		return "Daily bytes quota " + strconv.FormatInt(quota.DailyBytes, 10) + " is used up"
+	}
+	if quota.MonthlyBytes > 0 && usage.MonthlyBytes >= quota.MonthlyBytes {
+		return "Monthly bytes quota " + strconv.FormatInt(quota.MonthlyBytes, 10) + " is used up"
+	}
+	return ""
+}
+
+// urls of jobs accepted but not inserted into database yet, keyed by user,
+// they're counted as queued
+var (
+	reservedLock sync.Mutex
+	reservedUrls = make(map[string]int)
+)
+
+// checkSubmitQuota returns why a new job with urls files of the user is
+// rejected, or "" if it's within quota
+func checkSubmitQuota(accessKey string, urls int) (string, error) {
+	reservedLock.Lock()
+	defer reservedLock.Unlock()
+	return checkQuota(accessKey, urls)
+}
+
+// reserveSubmitQuota is checkSubmitQuota, and reserves urls in queued urls
+// if it's within quota, until releaseSubmitQuota after the job is inserted
+func reserveSubmitQuota(accessKey string, urls int) (string, error) {
+	reservedLock.Lock()
+	defer reservedLock.Unlock()
+	exceeded, err := checkQuota(accessKey, urls)
+	if err == nil && exceeded == "" && urls > 0 {
+		reservedUrls[accessKey] += urls
+	}
+	return exceeded, err
+}
+
+func releaseSubmitQuota(accessKey string, urls int) {
+	if urls <= 0 {
+		return
+	}
+	reservedLock.Lock()
+	defer reservedLock.Unlock()
+	reservedUrls[accessKey] -= urls
+	if reservedUrls[accessKey] <= 0 {
+		delete(reservedUrls, accessKey)
+	}
+}
+
+func checkQuota(accessKey string, urls int) (string, error) {
+	quota, err := getUserQuota(accessKey)
+	if err != nil {
+		return "", err
+	}
+	usage, err := getUserUsage(accessKey)
+	if err != nil {
+		return "", err
+	}
+	usage.QueuedUrls += reservedUrls[accessKey]
+	return submitQuotaExceeded(quota, usage, urls), nil
+}
+
+// submitQuotaExceeded returns why a new job with urls files is rejected
+// under quota and usage, or "" if it's within quota
+func submitQuotaExceeded(quota *Quota, usage *Usage, urls int) string {
+	if quota.MaxQueuedUrls > 0 && usage.QueuedUrls+urls > quota.MaxQueuedUrls {
+		return fmt.Sprintf("Queued files quota %d exceeded, %d files are queued",
+			quota.MaxQueuedUrls, usage.QueuedUrls)
+	}
+	return bytesUsedUp(quota, usage)
+}
+
+// taskSlotsOfUser returns how many more tasks of the user could be scheduled,
+// -1 for unlimited
+func taskSlotsOfUser(accessKey string) int {
+	quota, err := getUserQuota(accessKey)
+	if err != nil {
+		logger.Println("Error querying quota of user", accessKey, "with error", err)
+		return -1
+	}
+	if quota.MaxRunningTasks == 0 && quota.DailyBytes == 0 && quota.MonthlyBytes == 0 {
+		return -1
+	}
+	usage, err := getUserUsage(accessKey)
+	if err != nil {
+		logger.Println("Error querying usage of user", accessKey, "with error", err)
+		return -1
+	}
+	return taskSlots(quota, usage)
+}
+
+// taskSlots returns how many more tasks could be scheduled under quota and
+// usage, -1 for unlimited
+func taskSlots(quota *Quota, usage *Usage) int {
+	if bytesUsedUp(quota, usage) != "" {
+		return 0
+	}
+	if quota.MaxRunningTasks == 0 {
+		return -1
+	}
+	if usage.RunningTasks >= quota.MaxRunningTasks {
+		return 0
+	}
+	return quota.MaxRunningTasks - usage.RunningTasks
+}
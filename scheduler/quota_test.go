@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func Test_BytesUsedUp(t *testing.T) {
+	cases := []struct {
+		quota  Quota
+		usage  Usage
+		usedUp bool
+	}{
+		{Quota{}, Usage{DailyBytes: 100, MonthlyBytes: 100}, false},
+		{Quota{DailyBytes: 100}, Usage{DailyBytes: 99}, false},
+		{Quota{DailyBytes: 100}, Usage{DailyBytes: 100}, true},
+		{Quota{MonthlyBytes: 100}, Usage{DailyBytes: 100, MonthlyBytes: 99}, false},
+		{Quota{MonthlyBytes: 100}, Usage{MonthlyBytes: 101}, true},
+		{Quota{DailyBytes: 100, MonthlyBytes: 1000}, Usage{DailyBytes: 10, MonthlyBytes: 1000}, true},
+	}
+	for _, c := range cases {
+		if usedUp := bytesUsedUp(&c.quota, &c.usage) != ""; usedUp != c.usedUp {
+			t.Error("Bytes of quota", c.quota, "usage", c.usage, "should be used up:", c.usedUp)
+		}
+	}
+}
+
+func Test_SubmitQuotaExceeded(t *testing.T) {
+	cases := []struct {
+		quota    Quota
+		usage    Usage
+		urls     int
+		exceeded bool
+	}{
+		{Quota{}, Usage{QueuedUrls: 1000}, 1000, false},
+		{Quota{MaxQueuedUrls: 100}, Usage{QueuedUrls: 90}, 10, false},
+		{Quota{MaxQueuedUrls: 100}, Usage{QueuedUrls: 90}, 11, true},
+		// a job without files is rejected only if bytes are used up
+		{Quota{MaxQueuedUrls: 100}, Usage{QueuedUrls: 100}, 0, false},
+		{Quota{MaxQueuedUrls: 100, DailyBytes: 10}, Usage{DailyBytes: 10}, 1, true},
+	}
+	for _, c := range cases {
+		exceeded := submitQuotaExceeded(&c.quota, &c.usage, c.urls) != ""
+		if exceeded != c.exceeded {
+			t.Error("Quota", c.quota, "usage", c.usage, "with", c.urls,
+				"urls should be exceeded:", c.exceeded)
+		}
+	}
+}
+
+func Test_TaskSlots(t *testing.T) {
+	cases := []struct {
+		quota Quota
+		usage Usage
+		slots int
+	}{
+		{Quota{}, Usage{RunningTasks: 10}, -1},
+		{Quota{DailyBytes: 100}, Usage{RunningTasks: 10}, -1},
+		{Quota{DailyBytes: 100}, Usage{DailyBytes: 100}, 0},
+		{Quota{MaxRunningTasks: 10}, Usage{RunningTasks: 3}, 7},
+		{Quota{MaxRunningTasks: 10}, Usage{RunningTasks: 10}, 0},
+		// running tasks could exceed quota after it's lowered
+		{Quota{MaxRunningTasks: 10}, Usage{RunningTasks: 12}, 0},
+		{Quota{MaxRunningTasks: 10, MonthlyBytes: 100}, Usage{MonthlyBytes: 100}, 0},
+	}
+	for _, c := range cases {
+		if slots := taskSlots(&c.quota, &c.usage); slots != c.slots {
+			t.Error("Slots of quota", c.quota, "usage", c.usage, "should be", c.slots,
+				"but got", slots)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"legitlab.letv.cn/optimus/optimus/common"
+)
+
+// Limits of users and jobs set by /setmaxspeed are enforced across the
+// cluster by rebalancer. It sums up speed of running tasks of every limited
+// job and user from progress reports and splits the limit among the tasks,
+// so the rate a task can't use is left to other tasks of the job or user.
+// Limit of a job is split first, and what a task gets caps its rate within
+// the limit of its user. New rates are sent to executors as framework
+// messages and applied to token buckets of tasks.
+
+const (
+	defaultRebalanceInterval = 5 * time.Second
+
+	// a task using more than saturatedRatio of its rate may go faster
+	saturatedRatio = 0.9
+	// a task not using up its rate asks for rateHeadroom times its speed
+	rateHeadroom = 1.25
+	// a task always gets at least 1/minShareDivisor of an even share
+	minShareDivisor = 10
+	// a new rate is sent only if it differs from the old one by more than
+	// rateChangeRatio, to avoid flooding executors
+	rateChangeRatio = 0.05
+)
+
+type RunningTask struct {
+	Id          int64
+	UId         string
+	JobUuid     string
+	ExecutorId  string
+	SlaveId     string
+	JobMaxSpeed int64
+}
+
+// wakes up rebalancer when a task starts running or limit of a user or job
+// changes
+var rebalancerWakeup = make(chan bool, 1)
+
+// rates sent to running tasks, keyed by task id, only accessed by rebalancer
+var taskRates = make(map[int64]int64)
+
+func wakeRebalancer() {
+	select {
+	case rebalancerWakeup <- true:
+	default:
+	}
+}
+
+func rebalancer() {
+	interval := CONFIG.RebalanceInterval
+	if interval <= 0 {
+		interval = defaultRebalanceInterval
+	}
+	for {
+		rebalance()
+		select {
+		case <-rebalancerWakeup:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func rebalance() {
+	tasks, err := getRunningTasks()
+	if err != nil {
+		logger.Println("Error querying running tasks: ", err)
+		return
+	}
+	userTasks := make(map[string][]*RunningTask)
+	running := make(map[int64]bool)
+	for _, task := range tasks {
+		userTasks[task.UId] = append(userTasks[task.UId], task)
+		running[task.Id] = true
+	}
+	for taskId := range taskRates {
+		if !running[taskId] {
+			delete(taskRates, taskId)
+		}
+	}
+
+	// rates of tasks within limits of their jobs, 0 for unlimited
+	jobCaps := make(map[int64]int64)
+	jobTasks := make(map[string][]*RunningTask)
+	for _, task := range tasks {
+		if task.JobMaxSpeed > 0 {
+			jobTasks[task.JobUuid] = append(jobTasks[task.JobUuid], task)
+		}
+	}
+	for _, tasks := range jobTasks {
+		jobSpeed := tasks[0].JobMaxSpeed
+		demands := make([]int64, len(tasks))
+		for i, task := range tasks {
+			demands[i] = taskDemand(task, jobSpeed, 0)
+		}
+		rates := allocateRates(jobSpeed, demands)
+		for i, task := range tasks {
+			jobCaps[task.Id] = rates[i]
+		}
+	}
+
+	for uid, tasks := range userTasks {
+		userSpeed, limited := getUserMaxSpeed(uid)
+		var rates []int64
+		if limited {
+			demands := make([]int64, len(tasks))
+			for i, task := range tasks {
+				demands[i] = taskDemand(task, userSpeed, jobCaps[task.Id])
+			}
+			rates = allocateRates(userSpeed, demands)
+		}
+		for i, task := range tasks {
+			// tasks not limited by their user or job are sent 0 once, in
+			// case they were limited before
+			rate := jobCaps[task.Id]
+			if limited {
+				rate = minSpeed(rates[i], rate)
+			}
+			if old, ok := taskRates[task.Id]; ok && !rateChanged(old, rate) {
+				continue
+			}
+			if setTaskRate(task, rate) {
+				taskRates[task.Id] = rate
+			}
+		}
+	}
+}
+
+// taskDemand estimates how fast the task would go if it had limit all for
+// itself, within maxRate if it's not 0
+func taskDemand(task *RunningTask, limit int64, maxRate int64) int64 {
+	demand := limit
+	var speed int64
+	for _, urlInfo := range progress().TaskProgress(task.Id) {
+		speed += int64(urlInfo.Speed)
+	}
+	rate, ok := taskRates[task.Id]
+	if ok && rate > 0 && float64(speed) < float64(rate)*saturatedRatio {
+		demand = int64(float64(speed) * rateHeadroom)
+	}
+	if maxRate > 0 && maxRate < demand {
+		demand = maxRate
+	}
+	return demand
+}
+
+// allocateRates splits total among demands by max-min fairness: tasks asking
+// for less than an even share get what they ask for, and what is left is
+// split evenly among the others. Every task gets at least a small share so
+// it could show it wants more. Rates are never 0, which means unlimited.
+func allocateRates(total int64, demands []int64) []int64 {
+	rates := make([]int64, len(demands))
+	if len(demands) == 0 {
+		return rates
+	}
+	floor := total / int64(len(demands)*minShareDivisor)
+	if floor < 1 {
+		floor = 1
+	}
+	left := total
+	var pending []int
+	for i := range demands {
+		pending = append(pending, i)
+	}
+	for len(pending) > 0 {
+		share := left / int64(len(pending))
+		if share < floor {
+			share = floor
+		}
+		var unsatisfied []int
+		for _, i := range pending {
+			demand := demands[i]
+			if demand < floor {
+				demand = floor
+			}
+			if demand <= share {
+				rates[i] = demand
+				left -= demand
+			} else {
+				unsatisfied = append(unsatisfied, i)
+			}
+		}
+		if len(unsatisfied) == len(pending) {
+			for _, i := range unsatisfied {
+				rates[i] = share
+			}
+			break
+		}
+		pending = unsatisfied
+	}
+	return rates
+}
+
+func rateChanged(old int64, rate int64) bool {
+	if old == 0 || rate == 0 {
+		return old != rate
+	}
+	diff := rate - old
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) > float64(old)*rateChangeRatio
+}
+
+func setTaskRate(task *RunningTask, rate int64) bool {
+	message, _ := json.Marshal(&common.SchedulerMessage{
+		Type:     common.MsgRate,
+		TaskId:   task.Id,
+		MaxSpeed: rate,
+	})
+	err := sched.backend.SendFrameworkMessage(task.ExecutorId, task.SlaveId, string(message))
+	if err != nil {
+		logger.Println("Error setting rate of task", task.Id, "with error", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_AllocateRates(t *testing.T) {
+	cases := []struct {
+		total   int64
+		demands []int64
+		rates   []int64
+	}{
+		{1000, []int64{}, []int64{}},
+		// even split when all want more than their share
+		{1000, []int64{1000, 1000}, []int64{500, 500}},
+		// all get what they ask for
+		{1000, []int64{100, 200}, []int64{100, 200}},
+		// what a slow task leaves is split among the others
+		{1000, []int64{100, 1000, 1000}, []int64{100, 450, 450}},
+		// idle tasks get the floor of 1/10 of an even share
+		{1000, []int64{0, 1000}, []int64{50, 950}},
+		// rates are never 0
+		{1, []int64{5, 5}, []int64{1, 1}},
+	}
+	for _, c := range cases {
+		rates := allocateRates(c.total, c.demands)
+		if !reflect.DeepEqual(rates, c.rates) {
+			t.Error("Rates of", c.demands, "in", c.total, "should be", c.rates, "but got", rates)
+		}
+	}
+}
+
+func Test_RateChanged(t *testing.T) {
+	cases := []struct {
+		old, rate int64
+		changed   bool
+	}{
+		{0, 0, false},
+		{0, 100, true},
+		{100, 0, true},
+		{100, 105, false},
+		{100, 95, false},
+		{100, 106, true},
+		{100, 94, true},
+	}
+	for _, c := range cases {
+		if rateChanged(c.old, c.rate) != c.changed {
+			t.Error("Rate", c.old, "to", c.rate, "should be changed:", c.changed)
+		}
+	}
+}
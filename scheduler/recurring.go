@@ -0,0 +1,126 @@
+package main
+
+import (
+	"time"
+)
+
+// Jobs submitted with "not-before" in the future or with "cron" are kept as
+// recurring definitions instead of running at once. recurringRunner turns a
+// definition into a new job, whose parent is the definition, every time it's
+// due. A definition without cron runs once.
+
+const (
+	recurringPollInterval = 15 * time.Second
+
+	// statuses of recurring definitions
+	RecurringActive  = "Active"
+	RecurringDone    = "Done"
+	RecurringDeleted = "Deleted"
+)
+
+type RecurringJob struct {
+	Id         string `json:"id"`
+	Cron       string `json:"cron,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	Status     string `json:"status"`
+	NextTime   int64  `json:"next-time,omitempty"`
+	Runs       int    `json:"runs"`
+	LastJobId  string `json:"last-jobid,omitempty"`
+	CreateTime int64  `json:"create-time"`
+
+	Request *TransferRequest `json:"request"`
+}
+
+type RecurringResponse struct {
+	Id       string `json:"recurring-id"`
+	NextTime int64  `json:"next-time"`
+}
+
+// cronNext returns the first time after from matching the cron expression
+// in timezone, zero time if it never matches
+func cronNext(expression string, timezone string, from time.Time) (time.Time, error) {
+	cron, err := parseCron(expression)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cron.next(from.In(location)), nil
+}
+
+// nextRunTime returns the first run time of a new definition, zero time if
+// it never runs
+func nextRunTime(req *TransferRequest, now time.Time) (time.Time, error) {
+	notBefore := time.Unix(req.NotBefore, 0)
+	if req.Cron == "" {
+		return notBefore, nil
+	}
+	from := now
+	if notBefore.After(from) {
+		// runs at not-before if it matches
+		from = notBefore.Add(-time.Nanosecond)
+	}
+	return cronNext(req.Cron, req.Timezone, from)
+}
+
+func recurringRunner() {
+	for {
+		for _, recurring := range getDueRecurringJobs() {
+			runRecurringJob(recurring)
+		}
+		time.Sleep(recurringPollInterval)
+	}
+}
+
+// runRecurringJob submits a job of the definition and moves it to its next
+// run. The run is deferred while the user is over quota, and the definition
+// is moved only after the job is saved, so a run is never lost.
+func runRecurringJob(recurring *RecurringJob) {
+	status := RecurringDone
+	var next time.Time
+	if recurring.Cron != "" {
+		// runs missed while scheduler was down are skipped
+		var err error
+		next, err = cronNext(recurring.Cron, recurring.Timezone, time.Now())
+		if err != nil {
+			logger.Println("Bad cron of recurring job", recurring.Id, "with error", err)
+		}
+		if !next.IsZero() {
+			status = RecurringActive
+		}
+	}
+
+	req := recurring.Request
+	exceeded, err := reserveSubmitQuota(req.accessKey, len(req.OriginUrls))
+	if err != nil {
+		logger.Println("Error checking quota of user", req.accessKey, "with error", err)
+		return
+	}
+	if exceeded != "" {
+		logger.Println("Recurring job", recurring.Id, "is deferred:", exceeded)
+		return
+	}
+	req.NotBefore = 0
+	req.Cron = ""
+	req.Timezone = ""
+	req.uuid = newUuid()
+	req.parentUuid = recurring.Id
+	req.reservedUrls = len(req.OriginUrls)
+	req.inserted = make(chan error, 1)
+	requestBuffer <- *req
+	if err = <-req.inserted; err != nil {
+		// still due, retried in next poll
+		return
+	}
+	logger.Println("Run recurring job", recurring.Id, "as job", req.uuid)
+	moved, err := advanceRecurringJob(recurring.Id, recurring.NextTime, status, next, req.uuid)
+	if err != nil {
+		logger.Println("Error advancing recurring job", recurring.Id, "with error", err)
+		return
+	}
+	if !moved {
+		logger.Println("Recurring job", recurring.Id, "has been moved by others")
+	}
+}
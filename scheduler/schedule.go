@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule of a user tells when tasks of the user could be scheduled. Tasks
+// are not scheduled in any deny window, and if there are allow windows, they
+// are scheduled only in one of them. Users without windows are scheduled any
+// time.
+
+const (
+	ScheduleAllow = "allow"
+	ScheduleDeny  = "deny"
+
+	maxScheduleWindows = 20
+	minutesPerDay      = 24 * 60
+)
+
+type Schedule struct {
+	Timezone string    `json:"timezone"` // IANA name, e.g. "Asia/Shanghai"
+	Windows  []*Window `json:"windows"`
+
+	location *time.Location
+}
+
+// Window is a period of day on certain days of week. A window ends on the
+// next day if End is not later than Start, so "22:00" to "06:00" is overnight
+// and "00:00" to "00:00" is the whole day.
+type Window struct {
+	Action string `json:"action"`         // allow or deny
+	Days   []int  `json:"days,omitempty"` // days of week the window starts, 0 is Sunday, empty for every day
+	Start  string `json:"start"`          // "HH:MM"
+	End    string `json:"end"`            // "HH:MM", "24:00" for end of day
+
+	start int // minutes of day
+	end   int
+}
+
+func (schedule *Schedule) String() string {
+	text, _ := json.Marshal(schedule)
+	return string(text)
+}
+
+// parseClock parses "HH:MM" into minutes of day, "24:00" is allowed if
+// endOfDay
+func parseClock(clock string, endOfDay bool) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, errors.New("Bad time " + clock + ", should be HH:MM")
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, errors.New("Bad time " + clock + ", should be HH:MM")
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, errors.New("Bad time " + clock + ", should be HH:MM")
+	}
+	minutes := hour*60 + minute
+	if hour < 0 || minutes > minutesPerDay || (minutes == minutesPerDay && !endOfDay) {
+		return 0, errors.New("Bad time " + clock + ", should be HH:MM")
+	}
+	return minutes, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// validate checks the schedule and prepares it for blocked
+func (schedule *Schedule) validate() error {
+	if len(schedule.Windows) > maxScheduleWindows {
+		return fmt.Errorf("Maximum number of windows are %d", maxScheduleWindows)
+	}
+	if len(schedule.Windows) > 0 && schedule.Timezone == "" {
+		return errors.New("Missing timezone")
+	}
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return errors.New("Unknown timezone " + schedule.Timezone)
+	}
+	schedule.location = location
+	for _, window := range schedule.Windows {
+		if window == nil {
+			return errors.New("Empty window")
+		}
+		if window.Action != ScheduleAllow && window.Action != ScheduleDeny {
+			return errors.New("Unknown action " + window.Action)
+		}
+		for _, day := range window.Days {
+			if day < 0 || day > 6 {
+				return fmt.Errorf("Bad day of week %d", day)
+			}
+		}
+		sort.Ints(window.Days)
+		window.start, err = parseClock(window.Start, false)
+		if err != nil {
+			return err
+		}
+		window.end, err = parseClock(window.End, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (window *Window) onDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, d := range window.Days {
+		if d == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains tells if t, in timezone of the schedule, is in the window
+func (window *Window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if window.start < window.end {
+		return window.onDay(t.Weekday()) && minute >= window.start && minute < window.end
+	}
+	// the window crosses midnight, the part after midnight belongs to the
+	// window started yesterday
+	if minute >= window.start {
+		return window.onDay(t.Weekday())
+	}
+	if minute < window.end {
+		return window.onDay((t.Weekday() + 6) % 7)
+	}
+	return false
+}
+
+// blocked tells if tasks of the user should not be scheduled at now
+func (schedule *Schedule) blocked(now time.Time) bool {
+	if schedule == nil || len(schedule.Windows) == 0 {
+		return false
+	}
+	if schedule.location != nil {
+		now = now.In(schedule.location)
+	}
+	var hasAllow, allowed bool
+	for _, window := range schedule.Windows {
+		in := window.contains(now)
+		if window.Action == ScheduleDeny {
+			if in {
+				return true
+			}
+			continue
+		}
+		hasAllow = true
+		allowed = allowed || in
+	}
+	return hasAllow && !allowed
+}
+
+// scheduleFromSpans converts hour spans of the old API, which are deny
+// windows in local time of scheduler host
+func scheduleFromSpans(spans []Span) (*Schedule, error) {
+	schedule := &Schedule{Timezone: "Local"}
+	for _, span := range spans {
+		if span.Start == 0 && span.End == 0 {
+			// [{"start": 0, "end": 0}] clears the schedule
+			continue
+		}
+		if span.Start < 0 || span.End > 24 || span.Start >= span.End {
+			return nil, errors.New("The start time is greater than end time")
+		}
+		schedule.Windows = append(schedule.Windows, &Window{
+			Action: ScheduleDeny,
+			Start:  formatClock(span.Start * 60),
+			End:    formatClock(span.End * 60),
+		})
+	}
+	for i := range spans {
+		for j := i + 1; j < len(spans); j++ {
+			if spans[i].End == 0 || spans[j].End == 0 {
+				continue
+			}
+			if spans[i].Start <= spans[j].End && spans[i].End >= spans[j].Start {
+				return nil, errors.New("There are overlaps in the entries")
+			}
+		}
+	}
+	return schedule, schedule.validate()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ScheduleBlocked(t *testing.T) {
+	schedule := &Schedule{
+		Timezone: "Asia/Shanghai",
+		Windows: []*Window{
+			// workdays at night, across midnight
+			{Action: ScheduleAllow, Days: []int{1, 2, 3, 4, 5}, Start: "22:30", End: "06:00"},
+			// whole weekend
+			{Action: ScheduleAllow, Days: []int{0, 6}, Start: "00:00", End: "00:00"},
+			{Action: ScheduleDeny, Start: "12:00", End: "12:15"},
+		},
+	}
+	if err := schedule.validate(); err != nil {
+		t.Fatal("Error validating schedule:", err)
+	}
+	location, _ := time.LoadLocation("Asia/Shanghai")
+	cases := []struct {
+		time    time.Time
+		blocked bool
+	}{
+		// 2016-10-17 is Monday
+		{time.Date(2016, 10, 17, 10, 0, 0, 0, location), true},
+		{time.Date(2016, 10, 17, 22, 29, 0, 0, location), true},
+		{time.Date(2016, 10, 17, 22, 30, 0, 0, location), false},
+		{time.Date(2016, 10, 18, 5, 59, 0, 0, location), false},
+		{time.Date(2016, 10, 18, 6, 0, 0, 0, location), true},
+		// Saturday morning is allowed by both windows, Friday night goes on
+		{time.Date(2016, 10, 22, 3, 0, 0, 0, location), false},
+		// the weekend window ends at midnight, and Sunday night is not a
+		// workday night
+		{time.Date(2016, 10, 17, 3, 0, 0, 0, location), true},
+		// deny wins
+		{time.Date(2016, 10, 22, 12, 10, 0, 0, location), true},
+		{time.Date(2016, 10, 22, 12, 15, 0, 0, location), false},
+		// the same moment in UTC, 2016-10-17 10:00 in Shanghai
+		{time.Date(2016, 10, 17, 2, 0, 0, 0, time.UTC), true},
+		// 2016-10-16 23:00 Sunday in Shanghai
+		{time.Date(2016, 10, 16, 15, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		if blocked := schedule.blocked(c.time); blocked != c.blocked {
+			t.Error("Time", c.time, "blocked:", blocked, "expected:", c.blocked)
+		}
+	}
+}
+
+func Test_ScheduleDenyOnly(t *testing.T) {
+	schedule := &Schedule{
+		Timezone: "UTC",
+		Windows:  []*Window{{Action: ScheduleDeny, Days: []int{5}, Start: "23:00", End: "01:30"}},
+	}
+	if err := schedule.validate(); err != nil {
+		t.Fatal("Error validating schedule:", err)
+	}
+	// 2016-10-21 is Friday
+	if !schedule.blocked(time.Date(2016, 10, 22, 1, 29, 0, 0, time.UTC)) {
+		t.Error("Saturday 01:29 should be blocked by window started on Friday")
+	}
+	if schedule.blocked(time.Date(2016, 10, 21, 1, 0, 0, 0, time.UTC)) {
+		t.Error("Friday 01:00 should not be blocked")
+	}
+	if schedule.blocked(time.Date(2016, 10, 21, 22, 59, 0, 0, time.UTC)) {
+		t.Error("Friday 22:59 should not be blocked")
+	}
+	var empty *Schedule
+	if empty.blocked(time.Now()) {
+		t.Error("Users without schedule should never be blocked")
+	}
+}
+
+func Test_ScheduleValidate(t *testing.T) {
+	bad := []*Schedule{
+		{Windows: []*Window{{Action: ScheduleAllow, Start: "01:00", End: "02:00"}}},
+		{Timezone: "Mars/Olympus", Windows: []*Window{{Action: ScheduleAllow, Start: "01:00", End: "02:00"}}},
+		{Timezone: "UTC", Windows: []*Window{{Action: "maybe", Start: "01:00", End: "02:00"}}},
+		{Timezone: "UTC", Windows: []*Window{{Action: ScheduleDeny, Days: []int{7}, Start: "01:00", End: "02:00"}}},
+		{Timezone: "UTC", Windows: []*Window{{Action: ScheduleDeny, Start: "24:00", End: "02:00"}}},
+		{Timezone: "UTC", Windows: []*Window{{Action: ScheduleDeny, Start: "1:00", End: "02:00"}}},
+		{Timezone: "UTC", Windows: []*Window{{Action: ScheduleDeny, Start: "01:60", End: "02:00"}}},
+	}
+	for _, schedule := range bad {
+		if err := schedule.validate(); err == nil {
+			t.Error("Schedule", schedule, "should be invalid")
+		}
+	}
+	good := &Schedule{Timezone: "UTC", Windows: []*Window{{Action: ScheduleDeny, Start: "18:00", End: "24:00"}}}
+	if err := good.validate(); err != nil {
+		t.Error("Error validating schedule:", err)
+	}
+}
+
+func Test_ScheduleFromSpans(t *testing.T) {
+	schedule, err := scheduleFromSpans([]Span{{Start: 9, End: 18}})
+	if err != nil {
+		t.Fatal("Error converting spans:", err)
+	}
+	now := time.Now()
+	at := func(hour int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.Local)
+	}
+	if !schedule.blocked(at(9)) || !schedule.blocked(at(17)) || schedule.blocked(at(18)) {
+		t.Error("Spans should be deny windows in local time")
+	}
+	schedule, err = scheduleFromSpans([]Span{{Start: 0, End: 0}})
+	if err != nil || len(schedule.Windows) != 0 {
+		t.Error("Span 0 to 0 should clear the schedule")
+	}
+	if _, err = scheduleFromSpans([]Span{{Start: 9, End: 12}, {Start: 11, End: 18}}); err == nil {
+		t.Error("Overlapping spans should be rejected")
+	}
+}
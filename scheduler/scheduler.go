@@ -5,50 +5,22 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/mesos/mesos-go/mesosproto"
 	"github.com/mesos/mesos-go/mesosutil"
-	"github.com/mesos/mesos-go/scheduler"
 	"math"
 	"strconv"
 
 	"legitlab.letv.cn/optimus/optimus/common"
-	"github.com/garyburd/redigo/redis"
 	"database/sql"
 )
 
-const MAX_TASK_NUMBER = 1000
-
-type TaskIns  struct {
-	Id           int64
-	UId          string
-	Status       string   //Queued, Running, Exited
-	Urls         []string
-}
-
-type Scheduler struct { // implements scheduler.Scheduler interface
+// Scheduler decides which tasks to run with resources offered by backend and
+// keeps task states in database up to date
+type Scheduler struct {
 	// TODO: more instance variables
-	taskIns    map[string][]*TaskIns
+	backend ClusterBackend
 }
 
 func newScheduler() *Scheduler {
-	return &Scheduler{taskIns: make(map[string][]*TaskIns)}
-}
-
-func (scheduler *Scheduler) Registered(driver scheduler.SchedulerDriver,
-	frameworkID *mesosproto.FrameworkID, masterInfo *mesosproto.MasterInfo) {
-	logger.Println("Framework registered.")
-	logger.Println("Framework ID: ", frameworkID.GetValue())
-	logger.Println("Master: ", masterInfo)
-}
-
-func (scheduler *Scheduler) Reregistered(driver scheduler.SchedulerDriver,
-	masterInfo *mesosproto.MasterInfo) {
-	logger.Println("Framework re-registered.")
-	logger.Println("Master: ", masterInfo)
-}
-
-func (scheduler *Scheduler) Disconnected(driver scheduler.SchedulerDriver) {
-	logger.Println("Disconnected from master!")
-	driver.Stop(true)
-	// TODO: fail-over
+	return &Scheduler{}
 }
 
 func buildUris() []*mesosproto.CommandInfo_URI {
@@ -86,9 +58,9 @@ func newTask(task *common.TransferTask, executorId string,
 	taskID := &mesosproto.TaskID{
 		Value: proto.String(strconv.FormatInt(task.Id, 10)),
 	}
-	addrs, err := json.Marshal(CONFIG.RedisAddress)
-	if err != nil {
-		logger.Println("Error marshal json: ", err)
+	var arguments []string
+	if CONFIG.DownloadThreads > 0 {
+		arguments = append(arguments, "--download-threads", strconv.Itoa(CONFIG.DownloadThreads))
 	}
 	executor := &mesosproto.ExecutorInfo{
 		ExecutorId: &mesosproto.ExecutorID{
@@ -98,7 +70,7 @@ func newTask(task *common.TransferTask, executorId string,
 			Shell: proto.Bool(false),
 			Value: proto.String(CONFIG.ExecuteCommand),
 			Uris:  buildUris(),
-			Arguments:  []string{"--redis-master-name", CONFIG.RedisMasterName,"--redis-addr", string(addrs)},
+			Arguments:  arguments,
 		},
 		Resources: []*mesosproto.Resource{
 			mesosutil.NewScalarResource("cpus", CONFIG.CpuPerExecutor),
@@ -108,16 +80,20 @@ func newTask(task *common.TransferTask, executorId string,
 	if err != nil {
 		logger.Println("Error marshal json: ", err)
 	}
+	resources := []*mesosproto.Resource{
+		mesosutil.NewScalarResource("mem", CONFIG.MemoryPerTask),
+	}
+	// files of a streaming task are never written to local disk
+	if task.TransferMode != common.TransferModeStream {
+		resources = append(resources, mesosutil.NewScalarResource("disk", CONFIG.DiskPerTask))
+	}
 	mesosTask = &mesosproto.TaskInfo{
-		Name:     proto.String("Transfer-" + strconv.FormatInt(task.Id, 10)),
-		TaskId:   taskID,
-		SlaveId:  slaveId,
-		Executor: executor,
-		Resources: []*mesosproto.Resource{
-			mesosutil.NewScalarResource("mem", CONFIG.MemoryPerTask),
-			mesosutil.NewScalarResource("disk", CONFIG.DiskPerTask),
-		},
-		Data: jsonData,
+		Name:      proto.String("Transfer-" + strconv.FormatInt(task.Id, 10)),
+		TaskId:    taskID,
+		SlaveId:   slaveId,
+		Executor:  executor,
+		Resources: resources,
+		Data:      jsonData,
 	}
 	return
 }
@@ -132,149 +108,71 @@ func newTaskAndExecutor(task *common.TransferTask,
 	return newTask(task, newUuid(), slaveId)
 }
 
-func reCalculateLimit(scheduler *Scheduler, ak string) (limit int, err error){
-	pool := newSentinelPool(CONFIG.RedisAddress, CONFIG.RedisMasterName)
-	defer pool.Close()
-	conn := pool.Get()
-	defer conn.Close()
-
-	var totalSpeed, avgSpeed int64
-	var running, queued int
-	var chkedTaskIns []*TaskIns
-	if taskIns, ok := scheduler.taskIns[ak]; ok {
-		for _, task := range taskIns {
-			if task.Status == "Exited" {
-				continue
-			}
-			chkedTaskIns = append(chkedTaskIns, task)
-			if task.Status == "Queued" {
-				queued++
-				continue
-			}
-			for _, url := range task.Urls {
-				var urlInfo common.UrlInfo
-				value, err := redis.Bytes(conn.Do("GET", url))
-				if err != nil {
-					continue
-				} else {
-					err = json.Unmarshal(value, &urlInfo)
-					if err != nil {
-						logger.Println("Error Unmarshal json value! key", url)
-					}
-				}
-				if (urlInfo.Percentage == -1) || (urlInfo.Percentage > 0 && urlInfo.Percentage < 50)  {
-					totalSpeed += int64(urlInfo.Speed)
-				}
-			}
-			running++
-		}
-		//logger.Println("totalSpeed:", totalSpeed, "userMaxSpeed[ak]", userMaxSpeed[ak], "running", running)
-
-		scheduler.taskIns[ak] = chkedTaskIns
-		if totalSpeed < userMaxSpeed[ak] {
-			if running == 0 {
-				limit = MAX_TASK_NUMBER
-				return
-			}
-			avgSpeed = totalSpeed / int64(running)
-			if avgSpeed == 0 {
-				limit = MAX_TASK_NUMBER
-				return
-			}
-			limit = int((userMaxSpeed[ak] - totalSpeed) / avgSpeed)
-			if limit > queued {
-				limit = limit - queued
-			} else {
-				limit = 0
-			}
-		}
-	} else {
-		limit = MAX_TASK_NUMBER
-	}
+func getUserMaxSpeed(ak string) (maxSpeed int64, ok bool) {
+	userSpeedLock.RLock()
+	defer userSpeedLock.RUnlock()
+	maxSpeed, ok = userMaxSpeed[ak]
 	return
 }
 
-func addTaskIns(scheduler *Scheduler, ak string, tasks []*common.TransferTask) {
-	for _, task := range tasks {
-		scheduler.taskIns[ak] = append(scheduler.taskIns[ak], &TaskIns{Id: task.Id,
-			                                                          UId: task.UId,
-			                                                          Status: "Queued",
-			                                                          Urls: task.OriginUrls})
-	}
-}
-
 func getNextUserPendingTasks(scheduler *Scheduler, tx *sql.Tx, limit int) (tasks []*common.TransferTask) {
 	if limit == 0 {
 		return
 	}
+	if CONFIG.SchedulePolicy == SchedulePolicyFairShare {
+		return getFairSharePendingTasks(tx, limit)
+	}
+	skipped := make(map[string]bool)
 	for {
-		ak, err := getNextUser()
+		ak, err := getNextUser(skipped)
 		if err != nil {
 			logger.Println("Error get next user: ", err)
 		}
 		if ak == "" {
 			break
 		}
-		if _, ok := userMaxSpeed[ak]; ok {
-			calcLimit, err := reCalculateLimit(scheduler, ak)
-			if err != nil {
-				logger.Println("Error calculating limit: ", err)
-			}
-			//logger.Println("reCalculateLimit:", calcLimit)
-			if calcLimit == 0 {
-				return
-			}
-			if calcLimit < limit {
-				limit = calcLimit
-			}
+		userLimit := limit
+		slots := taskSlotsOfUser(ak)
+		if slots == 0 {
+			// quota of the user is used up, other users take the offer
+			skipped[ak] = true
+			continue
 		}
-
-		tasks = getPendingTasks(ak, tx, limit)
+		if slots > 0 && slots < userLimit {
+			userLimit = slots
+		}
+		tasks = getPendingTasks(ak, tx, userLimit)
 		if len(tasks) == 0 {
 			removeSchedUser(ak)
 		} else {
-			if _, ok := userMaxSpeed[ak]; ok {
-				addTaskIns(scheduler, ak, tasks)
-			}
 			return
 		}
 	}
 	return
 }
 
-func (scheduler *Scheduler) ResourceOffers(driver scheduler.SchedulerDriver,
-	offers []*mesosproto.Offer) {
+func (scheduler *Scheduler) resourceOffers(offers []*Offer) {
 	for _, offer := range offers {
 		err := upsertSlave(&Slave{
-			uuid:     offer.SlaveId.GetValue(),
-			hostname: *offer.Hostname,
+			uuid:     offer.SlaveId,
+			hostname: offer.Hostname,
 			status:   "Active",
 		})
 		if err != nil {
 			logger.Println("Error upsert slave: ", err)
-			driver.DeclineOffer(offer.Id, &mesosproto.Filters{})
+			scheduler.backend.DeclineOffer(offer.Id)
 			continue
 		}
-		var totalCpu, totalMemory, totalDisk float64
-		for _, resource := range offer.Resources {
-			switch resource.GetName() {
-			case "cpus":
-				totalCpu += *resource.GetScalar().Value
-			case "mem":
-				totalMemory += *resource.GetScalar().Value
-			case "disk":
-				totalDisk += *resource.GetScalar().Value
-			}
-		}
-		executorCapacity, taskCapacity := calculateCapacity(totalCpu, totalMemory, totalDisk)
+		executorCapacity, taskCapacity := calculateCapacity(offer.Cpus, offer.Mem, offer.Disk)
 
 		tx, err := db.Begin()
 		if err != nil {
 			logger.Println("Failed to begin transaction: ", err)
-			driver.DeclineOffer(offer.Id, &mesosproto.Filters{})
+			scheduler.backend.DeclineOffer(offer.Id)
 			continue
 		}
-		idleExecutors := getIdleExecutorsOnSlave(tx, offer.SlaveId.GetValue())
+		slaveId := &mesosproto.SlaveID{Value: proto.String(offer.SlaveId)}
+		idleExecutors := getIdleExecutorsOnSlave(tx, offer.SlaveId)
 		slaveCapacity := Min(executorCapacity+len(idleExecutors), taskCapacity)
 		pendingTasks := getNextUserPendingTasks(scheduler, tx, slaveCapacity)
 
@@ -283,92 +181,125 @@ func (scheduler *Scheduler) ResourceOffers(driver scheduler.SchedulerDriver,
 		for _, pendingTask := range pendingTasks {
 			if executorCursor < len(idleExecutors) {
 				task := newTaskForExecutor(pendingTask, idleExecutors[executorCursor],
-					offer.SlaveId)
+					slaveId)
 				tasks = append(tasks, task)
 				executorCursor++
 				continue
 			}
-			task := newTaskAndExecutor(pendingTask, offer.SlaveId)
+			task := newTaskAndExecutor(pendingTask, slaveId)
 			tasks = append(tasks, task)
 		}
-		driver.LaunchTasks([]*mesosproto.OfferID{offer.Id},
-			tasks, &mesosproto.Filters{})
+		err = scheduler.backend.LaunchTasks(offer.Id, tasks)
+		if err != nil {
+			logger.Println("Error launching tasks: ", err)
+			tx.Rollback()
+			// offer is not used, release it so it's offered again
+			scheduler.backend.DeclineOffer(offer.Id)
+			continue
+		}
 
 		if len(tasks) == 0 {
 			tx.Rollback()
 			continue
 		}
-		initializeTaskStatus(tx, tasks, offer.SlaveId.GetValue())
+		initializeTaskStatus(tx, tasks, offer.SlaveId)
 		// TODO: reschedule Failed tasks
 	}
 }
 
-func (scheduler *Scheduler) OfferRescinded(driver scheduler.SchedulerDriver,
-	offer *mesosproto.OfferID) {
-	logger.Println("Offer rescinded: ", offer)
-	// TODO: track tasks
-}
-
-func updateTaskIns(scheduler *Scheduler, taskId string, status string) {
-	taskIdInt, _ := strconv.ParseInt(taskId, 10, 64)
-	for _, taskIns := range scheduler.taskIns {
-		for _, task := range taskIns {
-			if task.Id == taskIdInt {
-				task.Status = status
-				return
-			}
-		}
+func (scheduler *Scheduler) statusUpdate(taskStatus *mesosproto.TaskStatus) {
+	// updates could be delivered again by reconciliation, and tasks of
+	// cancelled jobs are Cancelled before killed
+	status, err := getTaskStatus(taskStatus.TaskId.GetValue())
+	if err == nil && (status == "Finished" || status == "Failed" || status == "Cancelled") {
+		logger.Println("Ignore update of task", taskStatus.TaskId.GetValue(), "in status", status)
+		events.forgetTask(taskStatus.TaskId.GetValue())
+		return
 	}
-}
-
-func (scheduler *Scheduler) StatusUpdate(driver scheduler.SchedulerDriver,
-	taskStatus *mesosproto.TaskStatus) {
 	switch *taskStatus.State {
 	case mesosproto.TaskState_TASK_RUNNING:
-		updateTaskIns(scheduler, taskStatus.TaskId.GetValue(), "Running")
 		updateTask(taskStatus.TaskId.GetValue(), taskStatus.ExecutorId.GetValue(), "Running")
+		wakeRebalancer()
 	case mesosproto.TaskState_TASK_ERROR, mesosproto.TaskState_TASK_FAILED:
-		updateTaskIns(scheduler, taskStatus.TaskId.GetValue(), "Exited")
 		updateTask(taskStatus.TaskId.GetValue(), taskStatus.ExecutorId.GetValue(), "Failed")
 		tryFinishJob(taskStatus.TaskId.GetValue())
-	case mesosproto.TaskState_TASK_LOST:
-		updateTaskIns(scheduler, taskStatus.TaskId.GetValue(), "Exited")
+		events.forgetTask(taskStatus.TaskId.GetValue())
+	case mesosproto.TaskState_TASK_LOST, mesosproto.TaskState_TASK_KILLED:
 		taskLostUpdate(taskStatus.TaskId.GetValue(), taskStatus.ExecutorId.GetValue())
+		publishRequeuedEvents(taskStatus.TaskId.GetValue())
+		events.forgetTask(taskStatus.TaskId.GetValue())
 	case mesosproto.TaskState_TASK_FINISHED:
-		updateTaskIns(scheduler, taskStatus.TaskId.GetValue(), "Exited")
 		updateTask(taskStatus.TaskId.GetValue(), taskStatus.ExecutorId.GetValue(), "Finished")
 		tryFinishJob(taskStatus.TaskId.GetValue())
+		events.forgetTask(taskStatus.TaskId.GetValue())
 	default:
 		logger.Println("Status update: task", taskStatus.TaskId.GetValue(),
 			" is in state ", taskStatus.State.Enum().String())
 	}
 }
 
-func (scheduler *Scheduler) FrameworkMessage(driver scheduler.SchedulerDriver,
-	executorID *mesosproto.ExecutorID, slaveID *mesosproto.SlaveID, message string) {
-	var urlUpdate common.UrlUpdate
-	err := json.Unmarshal([]byte(message), &urlUpdate)
+func (scheduler *Scheduler) frameworkMessage(executorId string, slaveId string, message string) {
+	var msg common.ExecutorMessage
+	err := json.Unmarshal([]byte(message), &msg)
 	if err != nil {
 		logger.Println("Malformed framework message: ", message, "with error: ", err)
 		return
 	}
-	updateUrl(&urlUpdate)
+	switch msg.Type {
+	case common.MsgProgress:
+		progress().Update(msg.Progress)
+		for _, report := range msg.Progress {
+			publishProgressEvent(report)
+		}
+		return
+	case common.MsgUrlUpdate:
+	case "":
+		// executors of older versions send bare UrlUpdate
+		msg.Update = &common.UrlUpdate{}
+		json.Unmarshal([]byte(message), msg.Update)
+	default:
+		logger.Println("Unknown framework message: ", message)
+		return
+	}
+	urlUpdate := msg.Update
+	if urlUpdate == nil {
+		logger.Println("Framework message without update: ", message)
+		return
+	}
+	publishUrlEvent(urlUpdate)
+	switch urlUpdate.Status {
+	case "Uploading":
+		saveUploadState(urlUpdate)
+	case "Downloading":
+		// only streamed to clients of /events
+	default:
+		progress().Finish(urlUpdate)
+		updateUrl(urlUpdate)
+	}
 }
 
-func (scheduler *Scheduler) SlaveLost(driver scheduler.SchedulerDriver,
-	slaveID *mesosproto.SlaveID) {
-	logger.Printf("Slave lost: %v", slaveID)
-	slaveLostUpdate(slaveID.GetValue())
+// cancelJob stops a job, tasks already sent to executors are killed
+func (scheduler *Scheduler) cancelJob(jobUuid string) error {
+	activeTasks, err := cancelJob(jobUuid)
+	if err != nil {
+		return err
+	}
+	for _, taskId := range activeTasks {
+		err = scheduler.backend.KillTask(taskId)
+		if err != nil {
+			logger.Println("Error killing task", taskId, "with error", err)
+		}
+	}
+	publishJobEvent(jobUuid, "Cancelled")
+	go sendJobCallback(jobUuid)
+	releaseChildren(jobUuid)
+	return nil
 }
 
-func (scheduler *Scheduler) ExecutorLost(driver scheduler.SchedulerDriver,
-	executorID *mesosproto.ExecutorID, slaveID *mesosproto.SlaveID, code int) {
-	logger.Printf("Executor %q lost on slave %q code %d",
-		executorID, slaveID, code)
-	executorLostUpdate(executorID.GetValue())
+func (scheduler *Scheduler) slaveLost(slaveId string) {
+	slaveLostUpdate(slaveId)
 }
 
-func (scheduler *Scheduler) Error(driver scheduler.SchedulerDriver, error string) {
-	logger.Println("Unrecoverable error: ", error)
-	driver.Stop(false)
+func (scheduler *Scheduler) executorLost(executorId string) {
+	executorLostUpdate(executorId)
 }
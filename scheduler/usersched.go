@@ -7,6 +7,7 @@ import (
 
 const MAX_PRI_NUMBER = 10
 
+// Span is an hour range of the old /schedule API, see scheduleFromSpans
 type Span struct {
 	Start int `json:"start"`
 	End   int `json:"end"`
@@ -14,7 +15,8 @@ type Span struct {
 
 type schedUserInfo struct {
 	ak                 string
-	timeSpans          []Span
+	schedule           *Schedule
+	weight             int // used by fair share policy, at least 1
 }
 
 var (
@@ -23,9 +25,10 @@ var (
 	lock               sync.Mutex
 )
 
-func getNextUser() (string, error) {
+// getNextUser returns the next user to schedule, users in skipped are passed
+// over like users blocked by their schedules
+func getNextUser(skipped map[string]bool) (string, error) {
 	now := time.Now()
-	hour := now.Hour()
 
 	lock.Lock()
 	defer lock.Unlock()
@@ -39,14 +42,7 @@ func getNextUser() (string, error) {
 		var idx int
 		var unHitUsers []string
 		for idx = 0; idx < len(schedUsers[pri]); idx++ {
-			var hit bool
-			for _, span := range schedUsers[pri][idx].timeSpans {
-				if hour >= span.Start && hour < span.End {
-					hit = true
-					break
-				}
-			}
-		    if hit {
+			if schedUsers[pri][idx].schedule.blocked(now) || skipped[schedUsers[pri][idx].ak] {
 				continue
 			}
 			unHitUsers = append(unHitUsers, schedUsers[pri][idx].ak)
@@ -72,6 +68,36 @@ func getNextUser() (string, error) {
 	return currUser, nil
 }
 
+// getActiveSchedUsers returns users of all priorities not blocked by their
+// schedules
+func getActiveSchedUsers(now time.Time) (users []schedUserInfo) {
+	lock.Lock()
+	defer lock.Unlock()
+	for pri := 0; pri < MAX_PRI_NUMBER; pri++ {
+		for _, user := range schedUsers[pri] {
+			if user.schedule.blocked(now) {
+				continue
+			}
+			users = append(users, user)
+		}
+	}
+	return
+}
+
+// updateSchedUserWeight changes weight of the user if it's in the list
+func updateSchedUserWeight(ak string, weight int) {
+	lock.Lock()
+	defer lock.Unlock()
+	for pri := 0; pri < MAX_PRI_NUMBER; pri++ {
+		for idx := range schedUsers[pri] {
+			if schedUsers[pri][idx].ak == ak {
+				schedUsers[pri][idx].weight = weight
+				return
+			}
+		}
+	}
+}
+
 func removeSchedUser(ak string) error {
 	lock.Lock()
 	defer lock.Unlock()
@@ -125,7 +151,7 @@ func addSchedUser(pri int, schedUser schedUserInfo) error{
 	}
 	schedUsers[pri] = append(schedUsers[pri], schedUser)
 	for idx = 0; idx < len(schedUsers[pri]); idx++ {
-		logger.Println("addSchedUser(): user:", schedUser.ak, "pri:", pri, "spans:", schedUser.timeSpans)
+		logger.Println("addSchedUser(): user:", schedUser.ak, "pri:", pri, "schedule:", schedUser.schedule)
 	}
 	return nil
 }
@@ -145,9 +171,14 @@ func chkAndAddSchedUser(ak string) error {
 		return err
 	}
 	var schedUser schedUserInfo
-	err = getUserTimeSpans(ak, &schedUser.timeSpans)
+	schedUser.schedule, err = getUserSchedule(ak)
 	if err != nil {
-		logger.Println("Error get user time spans: ", err)
+		logger.Println("Error get user schedule: ", err)
+		return err
+	}
+	schedUser.weight, err = getUserWeight(ak)
+	if err != nil {
+		logger.Println("Error get user weight from db:", err)
 		return err
 	}
 	schedUser.ak = ak
@@ -159,7 +190,7 @@ func chkAndAddSchedUser(ak string) error {
 	return nil
 }
 
-func chkAndUpdateSchedUser(ak string, spans []Span) error {
+func chkAndUpdateSchedUser(ak string, schedule *Schedule) error {
 	exist, err := isSchedUserExist(ak)
 	if err != nil {
 		logger.Println("Error checking if scheduler user is exist:", err)
@@ -175,10 +206,13 @@ func chkAndUpdateSchedUser(ak string, spans []Span) error {
 	}
 	var schedUser schedUserInfo
 	schedUser.ak = ak
-	if len(spans) != 0 {
-		schedUser.timeSpans = spans
+	schedUser.schedule = schedule
+	schedUser.weight, err = getUserWeight(ak)
+	if err != nil {
+		logger.Println("Error get user weight from db:", err)
+		return err
 	}
-	logger.Println("chkAndUpdateSchedUser(): schedUser.timeSpans:", schedUser.timeSpans)
+	logger.Println("chkAndUpdateSchedUser(): schedUser.schedule:", schedUser.schedule)
 	err = addSchedUser(pri, schedUser)
 	if err != nil {
 		logger.Println("Error add sched user: ", err)
@@ -187,13 +221,13 @@ func chkAndUpdateSchedUser(ak string, spans []Span) error {
 	return nil
 }
 
-func updateScheduleEntry(accessKey string, spans []Span) error {
-	err := chkAndUpdateSchedUser(accessKey, spans)
+func updateScheduleEntry(accessKey string, schedule *Schedule) error {
+	err := chkAndUpdateSchedUser(accessKey, schedule)
 	if err != nil {
 		logger.Println("Error check and update sched user: ", err)
 		return err
 	}
-	err = delAndInsertScheTable(accessKey, spans)
+	err = saveUserSchedule(accessKey, schedule)
 	if err != nil {
 		logger.Println("Error updating schedule table with error ", err)
 		return err
@@ -215,12 +249,17 @@ func initScheduledUsers() error {
 			logger.Println("Error get user priority ", err)
 			continue
 		}
-		err = getUserTimeSpans(ak, &schedUser.timeSpans)
+		schedUser.schedule, err = getUserSchedule(ak)
+		if err != nil {
+			logger.Println("Error get user schedule ", err)
+			continue
+		}
+		schedUser.weight, err = getUserWeight(ak)
 		if err != nil {
-			logger.Println("Error get user time spans ", err)
+			logger.Println("Error get user weight ", err)
 			continue
 		}
-		logger.Println("user:", ak, "pri:", pri, "spans:", schedUser.timeSpans)
+		logger.Println("user:", ak, "pri:", pri, "schedule:", schedUser.schedule)
 		schedUser.ak = ak
 		schedUsers[pri] = append(schedUsers[pri], schedUser)
 	}
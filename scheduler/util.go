@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/hex"
+
 	"github.com/satori/go.uuid"
 )
 
@@ -14,3 +16,12 @@ func Min(a int, b int) int {
 func newUuid() string {
 	return uuid.NewV4().String()
 }
+
+// isHex returns true if s is empty or a hex string of length n
+func isHex(s string, n int) bool {
+	if s == "" {
+		return true
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == n
+}